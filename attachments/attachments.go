@@ -0,0 +1,313 @@
+// Package attachments stores files attached to tasks in a local directory,
+// with their metadata in the database.
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrNotFound     = errors.New("Attachment not found")
+	ErrTaskNotFound = errors.New("Task not found")
+	ErrTooLarge     = errors.New("File is too large")
+	ErrType         = errors.New("File type is not allowed")
+)
+
+// DefaultTypes are the media types accepted unless TODO_ATTACH_TYPES says
+// otherwise.
+var DefaultTypes = []string{
+	"application/pdf", "image/png", "image/jpeg", "image/gif", "image/webp", "text/plain",
+}
+
+type Attachment struct {
+	ID          string `json:"id"`
+	TaskID      string `json:"task_id"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	CreatedAt   string `json:"created_at"`
+	stored      string
+}
+
+// Store keeps the files in dir. Files larger than maxSize or of types not
+// in types are refused.
+type Store struct {
+	db      *sql.DB
+	dir     string
+	maxSize int64
+	types   map[string]bool
+}
+
+func NewStore(db *sql.DB, dir string, maxSize int64, types []string) *Store {
+	s := &Store{db: db, dir: dir, maxSize: maxSize, types: make(map[string]bool)}
+	for _, t := range types {
+		s.types[strings.ToLower(strings.TrimSpace(t))] = true
+	}
+	return s
+}
+
+const selectAttachment = `SELECT id, task_id, name, content_type, size, sha256, created_at, stored
+	FROM attachments WHERE orphaned_at = 0`
+
+func scanAttachment(row interface{ Scan(...any) error }) (Attachment, error) {
+	var (
+		a              Attachment
+		id, taskID, at int64
+	)
+	err := row.Scan(&id, &taskID, &a.Name, &a.ContentType, &a.Size, &a.SHA256, &at, &a.stored)
+	a.ID = strconv.FormatInt(id, 10)
+	a.TaskID = strconv.FormatInt(taskID, 10)
+	a.CreatedAt = time.Unix(at, 0).Format(time.RFC3339)
+	return a, err
+}
+
+// List returns the attachments of a task in the order they were added.
+func (s *Store) List(ctx context.Context, taskID string) ([]Attachment, error) {
+	if err := s.checkTask(ctx, taskID); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, selectAttachment+" AND task_id = ? ORDER BY id", taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Attachment{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func (s *Store) Get(ctx context.Context, id string) (Attachment, error) {
+	a, err := scanAttachment(s.db.QueryRowContext(ctx, selectAttachment+" AND id = ?", id))
+	if err == sql.ErrNoRows {
+		return Attachment{}, ErrNotFound
+	}
+	return a, err
+}
+
+// Open opens the file of an attachment.
+func (s *Store) Open(a Attachment) (*os.File, error) {
+	f, err := os.Open(filepath.Join(s.dir, a.stored))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *Store) checkTask(ctx context.Context, taskID string) error {
+	var n int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM scheduler WHERE id = ?", taskID).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+// cleanName keeps the base name of an uploaded file without control
+// characters, as it is sent back in Content-Disposition.
+func cleanName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if r := []rune(name); len(r) > 200 {
+		name = string(r[:200])
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+func newStoredName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Save stores the file read from r under name for the task taskID. The type
+// is detected from the contents, whatever the client claims.
+func (s *Store) Save(ctx context.Context, taskID, name string, r io.Reader) (Attachment, error) {
+	if err := s.checkTask(ctx, taskID); err != nil {
+		return Attachment{}, err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return Attachment{}, err
+	}
+	stored, err := newStoredName()
+	if err != nil {
+		return Attachment{}, err
+	}
+	path := filepath.Join(s.dir, stored)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return Attachment{}, err
+	}
+	saved := false
+	defer func() {
+		if !saved {
+			os.Remove(path)
+		}
+	}()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		f.Close()
+		return Attachment{}, err
+	}
+	head = head[:n]
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !s.types[contentType] {
+		f.Close()
+		return Attachment{}, fmt.Errorf("%w: %s", ErrType, contentType)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(io.MultiReader(bytes.NewReader(head), r), s.maxSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Attachment{}, err
+	}
+	if size > s.maxSize {
+		return Attachment{}, ErrTooLarge
+	}
+
+	a := Attachment{
+		TaskID:      taskID,
+		Name:        cleanName(name),
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		stored:      stored,
+	}
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO attachments (task_id, name, content_type, size, sha256, stored, created_at)
+		SELECT ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM scheduler WHERE id = ?)`,
+		taskID, a.Name, a.ContentType, a.Size, a.SHA256, stored, now.Unix(), taskID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// The task was deleted during the upload.
+		return Attachment{}, ErrTaskNotFound
+	}
+	id, _ := res.LastInsertId()
+	a.ID = strconv.FormatInt(id, 10)
+	a.CreatedAt = now.Format(time.RFC3339)
+	saved = true
+	return a, nil
+}
+
+// Delete removes an attachment and its file.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	a, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM attachments WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, a.stored)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Attachments: %v", err)
+	}
+	return nil
+}
+
+// Sweep removes the attachments of tasks deleted more than grace ago.
+// Until then the deletion can be undone and the files are kept.
+func (s *Store) Sweep(ctx context.Context, grace time.Duration) (int, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, stored FROM attachments a WHERE orphaned_at != 0 AND orphaned_at < ?
+			AND NOT EXISTS (SELECT 1 FROM scheduler s WHERE s.id = a.task_id)`,
+		time.Now().Add(-grace).Unix())
+	if err != nil {
+		return 0, err
+	}
+	type orphan struct {
+		id     int64
+		stored string
+	}
+	var orphans []orphan
+	for rows.Next() {
+		var o orphan
+		if err := rows.Scan(&o.id, &o.stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orphans = append(orphans, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, o := range orphans {
+		// The task may have been restored since it was listed.
+		res, err := s.db.ExecContext(ctx, "DELETE FROM attachments WHERE id = ? AND orphaned_at != 0", o.id)
+		if err != nil {
+			return removed, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, o.stored)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Attachments: %v", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Run sweeps the attachments of deleted tasks every interval until ctx is
+// done.
+func (s *Store) Run(ctx context.Context, interval, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n, err := s.Sweep(ctx, grace); err != nil {
+			log.Printf("Attachments: %v", err)
+		} else if n > 0 {
+			log.Printf("Attachments: removed %d files of deleted tasks", n)
+		}
+	}
+}
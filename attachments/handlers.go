@@ -0,0 +1,150 @@
+package attachments
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func respondWithError(w http.ResponseWriter, head int, message string) {
+	w.WriteHeader(head)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+}
+
+func respondWithStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrTaskNotFound):
+		respondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrTooLarge):
+		respondWithError(w, http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, ErrType):
+		respondWithError(w, http.StatusUnsupportedMediaType, err.Error())
+	default:
+		log.Printf("Attachments: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+	}
+}
+
+// AttachmentsHandler serves /api/task/attachments: GET ?task_id=... lists
+// the attachments of a task, POST ?task_id=... uploads the "file" part of a
+// multipart/form-data body and DELETE ?id=... removes an attachment.
+func AttachmentsHandler(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			taskID := r.URL.Query().Get("task_id")
+			if taskID == "" {
+				respondWithError(w, http.StatusBadRequest, "Missed task_id")
+				return
+			}
+			list, err := s.List(r.Context(), taskID)
+			if err != nil {
+				respondWithStoreError(w, err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]Attachment{"attachments": list})
+		case http.MethodPost:
+			upload(s, w, r)
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				respondWithError(w, http.StatusBadRequest, "Missed id")
+				return
+			}
+			if err := s.Delete(r.Context(), id); err != nil {
+				respondWithStoreError(w, err)
+				return
+			}
+			json.NewEncoder(w).Encode(struct{}{})
+		default:
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+		}
+	}
+}
+
+// upload streams the file to the store without buffering the whole body;
+// the body may exceed the file limit only by the multipart overhead.
+func upload(s *Store, w http.ResponseWriter, r *http.Request) {
+	taskID := r.URL.Query().Get("task_id")
+	if _, err := strconv.ParseInt(taskID, 10, 64); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Missed task_id")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxSize+64<<10)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Body must be multipart/form-data")
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				respondWithStoreError(w, ErrTooLarge)
+				return
+			}
+			respondWithError(w, http.StatusBadRequest, "No file part")
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		a, err := s.Save(r.Context(), taskID, part.FileName(), part)
+		part.Close()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			err = ErrTooLarge
+		}
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+		return
+	}
+}
+
+// DownloadHandler serves GET /api/task/attachments/file?id=... with the file
+// of an attachment, always as a download so that it is never rendered as a
+// page of this site.
+func DownloadHandler(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Content-Type", "application/json")
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		a, err := s.Get(r.Context(), r.URL.Query().Get("id"))
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			respondWithStoreError(w, err)
+			return
+		}
+		f, err := s.Open(a)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			respondWithStoreError(w, err)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("ETag", `"`+a.SHA256+`"`)
+		created, _ := time.Parse(time.RFC3339, a.CreatedAt)
+		http.ServeContent(w, r, "", created, f)
+	}
+}
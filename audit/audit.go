@@ -0,0 +1,196 @@
+// Package audit records sign-in attempts and requests that change data, so
+// it can be told later who did what and from where.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// Entry is one recorded request.
+type Entry struct {
+	ID       int64  `json:"id"`
+	At       string `json:"at"`
+	IP       string `json:"ip"`
+	Session  string `json:"session"`
+	Method   string `json:"method"`
+	Endpoint string `json:"endpoint"`
+	TaskID   string `json:"task_id"`
+	Status   int    `json:"status"`
+	Outcome  string `json:"outcome"`
+}
+
+type entryKey struct{}
+
+// SetTaskID names the tasks the request worked on, when they are not given
+// by the id parameter of the query, e.g. for a created task. Several ids are
+// joined with commas.
+func SetTaskID(ctx context.Context, ids ...string) {
+	if e, ok := ctx.Value(entryKey{}).(*Entry); ok {
+		e.TaskID = strings.Join(ids, ",")
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// audited tells the requests that are recorded whatever their outcome:
+// sign-in attempts and everything but reading under /api/ and /dav/.
+func audited(r *http.Request) bool {
+	if r.URL.Path == "/api/signin" {
+		return true
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/dav/") {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND", "REPORT":
+		return false
+	}
+	return true
+}
+
+// Middleware records the audited requests and every request refused with
+// 401 or 403. The entry is written before the response is complete, so a
+// client that got its answer finds the request in the log.
+func Middleware(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &Entry{TaskID: r.URL.Query().Get("id")}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), entryKey{}, e)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		denied := rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden
+		if !denied && !audited(r) {
+			return
+		}
+		e.IP = clientIP(r)
+		e.Session = session(r, rec.Header())
+		e.Method = r.Method
+		e.Endpoint = r.URL.Path
+		e.Status = rec.status
+		switch {
+		case denied:
+			e.Outcome = OutcomeDenied
+		case rec.status < http.StatusBadRequest:
+			e.Outcome = OutcomeSuccess
+		default:
+			e.Outcome = OutcomeFailure
+		}
+		if err := insert(context.WithoutCancel(r.Context()), db, e); err != nil {
+			log.Printf("Audit: %v", err)
+		}
+	})
+}
+
+// clientIP is the address of the peer. Behind a reverse proxy, with
+// TODO_TRUST_PROXY set, it is the first address of X-Forwarded-For instead;
+// otherwise the header could be forged by anyone.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TODO_TRUST_PROXY") != "" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ip, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// session identifies who made the request without storing credentials: a
+// hash of the token cookie, also of one just issued by /api/signin, or the
+// user name of basic auth.
+func session(r *http.Request, header http.Header) string {
+	token := ""
+	if c, err := r.Cookie("token"); err == nil {
+		token = c.Value
+	}
+	for _, c := range (&http.Response{Header: header}).Cookies() {
+		if c.Name == "token" {
+			token = c.Value
+		}
+	}
+	if token != "" {
+		return fmt.Sprintf("token:%x", sha256.Sum256([]byte(token)))[:len("token:")+12]
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return "basic:" + user
+	}
+	return ""
+}
+
+func insert(ctx context.Context, db *sql.DB, e *Entry) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO audit_log (at, ip, session, method, endpoint, task_id, status, outcome)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().UnixMilli(), e.IP, e.Session, e.Method, e.Endpoint, e.TaskID, e.Status, e.Outcome)
+	return err
+}
+
+// Prune removes the entries older than the given number of days.
+func Prune(ctx context.Context, db *sql.DB, days int) (int64, error) {
+	before := time.Now().AddDate(0, 0, -days).UnixMilli()
+	res, err := db.ExecContext(ctx, "DELETE FROM audit_log WHERE at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Run prunes the log once a day until ctx is done.
+func Run(ctx context.Context, db *sql.DB, days int) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := Prune(ctx, db, days); err != nil {
+			log.Printf("Audit: %v", err)
+		} else if n > 0 {
+			log.Printf("Audit: pruned %d entries", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
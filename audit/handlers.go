@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defLimit = 100
+	maxLimit = 1000
+)
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type LogResponse struct {
+	Entries []Entry `json:"entries"`
+	// NextBeforeID is passed as before_id for the next, older page.
+	NextBeforeID int64 `json:"next_before_id,omitempty"`
+}
+
+func respondWithError(w http.ResponseWriter, head int, message string) {
+	w.WriteHeader(head)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+}
+
+// parseTime reads a from/to filter: a day as 20060102 or an RFC 3339 time.
+// A day given as to includes the whole day.
+func parseTime(s string, end bool) (int64, error) {
+	if t, err := time.ParseInLocation("20060102", s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t.UnixMilli(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.New("from and to must be YYYYMMDD or RFC 3339")
+	}
+	if end {
+		t = t.Add(time.Millisecond)
+	}
+	return t.UnixMilli(), nil
+}
+
+// filter turns the query parameters into the conditions of the log query.
+func filter(r *http.Request) (string, []any, error) {
+	params := r.URL.Query()
+	var where []string
+	var args []any
+	for _, p := range []struct {
+		name, cond string
+		end        bool
+	}{{"from", "at >= ?", false}, {"to", "at < ?", true}} {
+		if v := params.Get(p.name); v != "" {
+			at, err := parseTime(v, p.end)
+			if err != nil {
+				return "", nil, err
+			}
+			where = append(where, p.cond)
+			args = append(args, at)
+		}
+	}
+	for _, p := range []struct{ name, cond string }{
+		{"ip", "ip = ?"},
+		{"session", "session = ?"},
+		{"method", "method = ?"},
+		{"outcome", "outcome = ?"},
+		{"task_id", "',' || task_id || ',' LIKE '%,' || ? || ',%'"},
+	} {
+		if v := params.Get(p.name); v != "" {
+			if p.name == "method" {
+				v = strings.ToUpper(v)
+			}
+			where = append(where, p.cond)
+			args = append(args, v)
+		}
+	}
+	if v := params.Get("endpoint"); v != "" {
+		where = append(where, "substr(endpoint, 1, ?) = ?")
+		args = append(args, len(v), v)
+	}
+	if v := params.Get("before_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", nil, errors.New("before_id must be a number")
+		}
+		where = append(where, "id < ?")
+		args = append(args, id)
+	}
+	if len(where) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(where, " AND "), args, nil
+}
+
+// LogHandler serves GET /api/audit: the entries matching the filters from,
+// to, ip, session, method, endpoint (a path prefix), task_id and outcome,
+// newest first. Pages are limit entries long and follow each other with
+// before_id. format=jsonl streams all the matching entries as JSON lines.
+func LogHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		where, args, err := filter(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "jsonl" {
+			respondWithError(w, http.StatusBadRequest, "format must be json or jsonl")
+			return
+		}
+
+		query := `SELECT id, at, ip, session, method, endpoint, task_id, status, outcome
+			FROM audit_log` + where + " ORDER BY id DESC"
+		limit := defLimit
+		if format != "jsonl" {
+			if v := r.URL.Query().Get("limit"); v != "" {
+				limit, err = strconv.Atoi(v)
+				if err != nil || limit < 1 || limit > maxLimit {
+					respondWithError(w, http.StatusBadRequest, "limit must be from 1 to "+strconv.Itoa(maxLimit))
+					return
+				}
+			}
+			query += " LIMIT " + strconv.Itoa(limit+1)
+		}
+
+		rows, err := db.QueryContext(r.Context(), query, args...)
+		if err != nil {
+			log.Printf("Audit: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer rows.Close()
+
+		var enc *json.Encoder
+		if format == "jsonl" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+			enc = json.NewEncoder(w)
+		}
+		resp := LogResponse{Entries: []Entry{}}
+		for rows.Next() {
+			var e Entry
+			var at int64
+			if err := rows.Scan(&e.ID, &at, &e.IP, &e.Session, &e.Method, &e.Endpoint, &e.TaskID, &e.Status, &e.Outcome); err != nil {
+				log.Printf("Audit: %v", err)
+				if enc == nil {
+					respondWithError(w, http.StatusInternalServerError, "Server error")
+				}
+				return
+			}
+			e.At = time.UnixMilli(at).Format(time.RFC3339Nano)
+			if enc != nil {
+				if err := enc.Encode(e); err != nil {
+					return
+				}
+				continue
+			}
+			if len(resp.Entries) == limit {
+				resp.NextBeforeID = resp.Entries[limit-1].ID
+				break
+			}
+			resp.Entries = append(resp.Entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Audit: %v", err)
+			if enc == nil {
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+			}
+			return
+		}
+		if enc == nil {
+			json.NewEncoder(w).Encode(resp)
+		}
+	}
+}
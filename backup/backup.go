@@ -0,0 +1,224 @@
+// Package backup keeps rotated snapshots of the database in a directory and
+// restores them.
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"main.go/database"
+)
+
+const nameTime = "20060102-150405"
+
+// namePattern matches snapshot names; anything else is refused, so names
+// from requests can't point outside the directory.
+var namePattern = regexp.MustCompile(`^scheduler-\d{8}-\d{6}(-\d+)?\.db$`)
+
+var ErrNotFound = errors.New("Snapshot not found")
+
+type Snapshot struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Manager takes snapshots into dir and keeps the newest keep of them.
+// Operations are serialized, so a restore never runs during a snapshot.
+type Manager struct {
+	// OnRestore, if set, is called after the database is restored.
+	OnRestore func()
+
+	db   *sql.DB
+	dir  string
+	keep int
+	mu   sync.Mutex
+}
+
+func NewManager(db *sql.DB, dir string, keep int) *Manager {
+	return &Manager{db: db, dir: dir, keep: keep}
+}
+
+func (m *Manager) path(name string) (string, error) {
+	if !namePattern.MatchString(name) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(m.dir, name), nil
+}
+
+// Create takes a snapshot and removes the oldest ones beyond the limit.
+func (m *Manager) Create(ctx context.Context) (Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.create(ctx, "")
+}
+
+// create takes a snapshot. Rotation never removes the snapshot named keep.
+func (m *Manager) create(ctx context.Context, keep string) (Snapshot, error) {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return Snapshot{}, err
+	}
+	base := "scheduler-" + time.Now().Format(nameTime)
+	name := base + ".db"
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(m.dir, name)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = base + "-" + strconv.Itoa(i) + ".db"
+	}
+
+	// The snapshot gets its name only when complete, so a failed one is
+	// never listed or restored.
+	tmp := filepath.Join(m.dir, "."+name+".tmp")
+	os.Remove(tmp)
+	if err := database.Snapshot(ctx, m.db, tmp); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, err
+	}
+	if err := os.Rename(tmp, filepath.Join(m.dir, name)); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, err
+	}
+
+	list, err := m.list()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var created Snapshot
+	kept := 0
+	for _, s := range list {
+		if s.Name == name {
+			created = s
+		}
+		if kept < m.keep || s.Name == keep {
+			kept++
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.dir, s.Name)); err != nil {
+			log.Printf("Backup rotation: %v", err)
+		}
+	}
+	return created, nil
+}
+
+// List returns the snapshots, newest first.
+func (m *Manager) List() ([]Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.list()
+}
+
+func (m *Manager) list() ([]Snapshot, error) {
+	entries, err := os.ReadDir(m.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []Snapshot{}
+	for _, e := range entries {
+		if e.IsDir() || !namePattern.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, Snapshot{
+			Name:      e.Name(),
+			Size:      info.Size(),
+			CreatedAt: info.ModTime().Format(time.RFC3339),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		ti, ni := order(list[i].Name)
+		tj, nj := order(list[j].Name)
+		if ti != tj {
+			return ti > tj
+		}
+		return ni > nj
+	})
+	return list, nil
+}
+
+// order splits a snapshot name into its time and the number that tells
+// snapshots of the same second apart.
+func order(name string) (string, int) {
+	rest := name[len("scheduler-") : len(name)-len(".db")]
+	n := 1
+	if len(rest) > len(nameTime) {
+		n, _ = strconv.Atoi(rest[len(nameTime)+1:])
+	}
+	return rest[:len(nameTime)], n
+}
+
+func (m *Manager) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path, err := m.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Restore validates the snapshot and replaces the database with it. The
+// current state is saved as a new snapshot first, which is returned, so a
+// restore can be undone by restoring that one.
+func (m *Manager) Restore(ctx context.Context, name string) (Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path, err := m.path(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return Snapshot{}, ErrNotFound
+	}
+	if err := database.CheckSnapshot(ctx, path); err != nil {
+		return Snapshot{}, err
+	}
+	before, err := m.create(ctx, name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := database.Restore(ctx, m.db, path); err != nil {
+		return before, err
+	}
+	if m.OnRestore != nil {
+		m.OnRestore()
+	}
+	return before, nil
+}
+
+// Run takes a snapshot every interval until ctx is done.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s, err := m.Create(ctx); err != nil {
+			log.Printf("Backup: %v", err)
+		} else {
+			log.Printf("Backup: %s", s.Name)
+		}
+	}
+}
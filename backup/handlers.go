@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"main.go/database"
+)
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type RestoreResponse struct {
+	Restored string `json:"restored"`
+	// Before is the snapshot of the database as it was before the restore.
+	Before Snapshot `json:"before"`
+}
+
+func respondWithError(w http.ResponseWriter, head int, message string) {
+	w.WriteHeader(head)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+}
+
+func respondWithManagerError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		respondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, database.ErrInvalidSnapshot):
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		log.Printf("Backup: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+	}
+}
+
+// BackupsHandler serves /api/backups: GET lists the snapshots, POST takes
+// one and DELETE ?name=... removes one.
+func BackupsHandler(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			list, err := m.List()
+			if err != nil {
+				respondWithManagerError(w, err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]Snapshot{"backups": list})
+		case http.MethodPost:
+			s, err := m.Create(r.Context())
+			if err != nil {
+				respondWithManagerError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(s)
+		case http.MethodDelete:
+			if err := m.Delete(r.URL.Query().Get("name")); err != nil {
+				respondWithManagerError(w, err)
+				return
+			}
+			json.NewEncoder(w).Encode(struct{}{})
+		default:
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+		}
+	}
+}
+
+// RestoreHandler serves POST /api/backups/restore?name=... A snapshot that
+// fails validation is refused with 422 and the database is left as is.
+func RestoreHandler(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		name := r.URL.Query().Get("name")
+		before, err := m.Restore(r.Context(), name)
+		if err != nil {
+			respondWithManagerError(w, err)
+			return
+		}
+		log.Printf("Backup: restored %s, the previous state is in %s", name, before.Name)
+		json.NewEncoder(w).Encode(RestoreResponse{Restored: name, Before: before})
+	}
+}
@@ -0,0 +1,392 @@
+// Package caldav serves a single task calendar over the subset of CalDAV
+// (RFC 4791) that calendar and reminder apps use to sync: PROPFIND on the
+// principal and the calendar, REPORT calendar-query and calendar-multiget,
+// and GET, PUT and DELETE of calendar objects. Storage is left to a Backend.
+package caldav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrNotFound = errors.New("Not found")
+	// ErrPrecondition is returned when If-Match or If-None-Match fails.
+	ErrPrecondition = errors.New("Precondition failed")
+)
+
+// BadRequestError is an invalid calendar object sent by the client.
+type BadRequestError struct {
+	Err error
+}
+
+func (e BadRequestError) Error() string {
+	return e.Err.Error()
+}
+
+// Object is a calendar object resource of the calendar.
+type Object struct {
+	// Name is the last part of the path, such as 12.ics.
+	Name string
+	ETag string
+	// Data is the iCalendar text. List may leave it empty.
+	Data string
+}
+
+// Backend stores the objects of the calendar. ETags are passed and returned
+// with quotes, as in HTTP headers; an empty ifMatch matches any object and
+// ifNoneMatch "*" only a missing one.
+type Backend interface {
+	// CTag changes whenever any object of the calendar changes.
+	CTag(ctx context.Context) (string, error)
+	List(ctx context.Context, withData bool) ([]Object, error)
+	Get(ctx context.Context, name string) (Object, error)
+	Put(ctx context.Context, name, data, ifMatch, ifNoneMatch string) (etag string, created bool, err error)
+	Delete(ctx context.Context, name, ifMatch string) error
+}
+
+const maxObjectSize = 1 << 20
+
+// Handler serves the principal at prefix and the calendar at
+// prefix+"tasks/". prefix must end with a slash.
+type Handler struct {
+	Prefix      string
+	DisplayName string
+	Backend     Backend
+}
+
+func (h *Handler) calendarPath() string {
+	return h.Prefix + "tasks/"
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("DAV", "1, 3, calendar-access")
+	path := r.URL.Path
+	if path+"/" == h.Prefix || path+"/" == h.calendarPath() {
+		path += "/"
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, REPORT, GET, HEAD, PUT, DELETE")
+		return
+	case "PROPFIND":
+		err = h.propfind(w, r, path)
+	case "REPORT":
+		err = h.report(w, r, path)
+	case http.MethodGet, http.MethodHead:
+		err = h.get(w, r, path)
+	case http.MethodPut:
+		err = h.put(w, r, path)
+	case http.MethodDelete:
+		err = h.delete(w, r, path)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var bad BadRequestError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrPrecondition):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.As(err, &bad):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+// objectName returns the object name of a path inside the calendar.
+func (h *Handler) objectName(path string) (string, bool) {
+	name, ok := strings.CutPrefix(path, h.calendarPath())
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []response) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, multistatus(responses))
+}
+
+// requestedProps returns the properties named in a prop element, or nil for
+// allprop and an empty body.
+func requestedProps(root *node) []xml.Name {
+	if root == nil {
+		return nil
+	}
+	prop := root.child(nsDAV, "prop")
+	if prop == nil {
+		return nil
+	}
+	names := make([]xml.Name, len(prop.children))
+	for i, c := range prop.children {
+		names[i] = c.name
+	}
+	return names
+}
+
+// props picks the requested properties out of the available ones. With no
+// request all available properties are returned, except calendar-data.
+func props(requested []xml.Name, available []property) ([]property, []xml.Name) {
+	if requested == nil {
+		var all []property
+		for _, p := range available {
+			if p.name.Local != "calendar-data" {
+				all = append(all, p)
+			}
+		}
+		return all, nil
+	}
+	var (
+		found   []property
+		missing []xml.Name
+	)
+next:
+	for _, name := range requested {
+		for _, p := range available {
+			if p.name == name {
+				found = append(found, p)
+				continue next
+			}
+		}
+		missing = append(missing, name)
+	}
+	return found, missing
+}
+
+func (h *Handler) principalProps() []property {
+	href := hrefXML(h.Prefix)
+	return []property{
+		{xml.Name{Space: nsDAV, Local: "resourcetype"}, "<d:collection/><d:principal/>"},
+		{xml.Name{Space: nsDAV, Local: "displayname"}, escape(h.DisplayName)},
+		{xml.Name{Space: nsDAV, Local: "current-user-principal"}, href},
+		{xml.Name{Space: nsDAV, Local: "principal-URL"}, href},
+		{xml.Name{Space: nsCalDAV, Local: "calendar-home-set"}, href},
+	}
+}
+
+func (h *Handler) calendarProps(ctag string) []property {
+	return []property{
+		{xml.Name{Space: nsDAV, Local: "resourcetype"}, "<d:collection/><c:calendar/>"},
+		{xml.Name{Space: nsDAV, Local: "displayname"}, escape(h.DisplayName)},
+		{xml.Name{Space: nsDAV, Local: "current-user-principal"}, hrefXML(h.Prefix)},
+		{xml.Name{Space: nsDAV, Local: "current-user-privilege-set"},
+			"<d:privilege><d:read/></d:privilege><d:privilege><d:write/></d:privilege>"},
+		{xml.Name{Space: nsDAV, Local: "supported-report-set"},
+			"<d:supported-report><d:report><c:calendar-query/></d:report></d:supported-report>" +
+				"<d:supported-report><d:report><c:calendar-multiget/></d:report></d:supported-report>"},
+		{xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"}, `<c:comp name="VTODO"/>`},
+		{xml.Name{Space: nsCS, Local: "getctag"}, escape(ctag)},
+		{xml.Name{Space: nsDAV, Local: "getetag"}, escape(ctag)},
+	}
+}
+
+func objectProps(o Object) []property {
+	available := []property{
+		{xml.Name{Space: nsDAV, Local: "resourcetype"}, ""},
+		{xml.Name{Space: nsDAV, Local: "getetag"}, escape(o.ETag)},
+		{xml.Name{Space: nsDAV, Local: "getcontenttype"}, "text/calendar; charset=utf-8; component=VTODO"},
+	}
+	if o.Data != "" {
+		available = append(available, property{xml.Name{Space: nsCalDAV, Local: "calendar-data"}, escape(o.Data)})
+	}
+	return available
+}
+
+func (h *Handler) propfind(w http.ResponseWriter, r *http.Request, path string) error {
+	root, err := parseXML(r.Body)
+	if err != nil {
+		return BadRequestError{err}
+	}
+	requested := requestedProps(root)
+	depth := r.Header.Get("Depth")
+	if depth == "" {
+		depth = "infinity"
+	}
+
+	var responses []response
+	add := func(href string, available []property) {
+		found, missing := props(requested, available)
+		responses = append(responses, response{href: href, found: found, missing: missing})
+	}
+
+	switch path {
+	case h.Prefix:
+		add(h.Prefix, h.principalProps())
+		if depth != "0" {
+			ctag, err := h.Backend.CTag(r.Context())
+			if err != nil {
+				return err
+			}
+			add(h.calendarPath(), h.calendarProps(ctag))
+		}
+	case h.calendarPath():
+		ctag, err := h.Backend.CTag(r.Context())
+		if err != nil {
+			return err
+		}
+		add(h.calendarPath(), h.calendarProps(ctag))
+		if depth != "0" {
+			objects, err := h.Backend.List(r.Context(), false)
+			if err != nil {
+				return err
+			}
+			for _, o := range objects {
+				add(h.calendarPath()+o.Name, objectProps(o))
+			}
+		}
+	default:
+		name, ok := h.objectName(path)
+		if !ok {
+			return ErrNotFound
+		}
+		o, err := h.Backend.Get(r.Context(), name)
+		if err != nil {
+			return err
+		}
+		o.Data = ""
+		add(h.calendarPath()+o.Name, objectProps(o))
+	}
+	writeMultistatus(w, responses)
+	return nil
+}
+
+// report answers calendar-query with every object, as the calendar holds
+// VTODOs only and time ranges are left to the client, and calendar-multiget
+// with the listed objects.
+func (h *Handler) report(w http.ResponseWriter, r *http.Request, path string) error {
+	if path != h.calendarPath() {
+		return ErrNotFound
+	}
+	root, err := parseXML(r.Body)
+	if err != nil || root == nil {
+		return BadRequestError{errors.New("Invalid REPORT body")}
+	}
+	requested := requestedProps(root)
+
+	var responses []response
+	switch {
+	case root.name.Space == nsCalDAV && root.name.Local == "calendar-query":
+		if !queriesTodos(root) {
+			break
+		}
+		objects, err := h.Backend.List(r.Context(), true)
+		if err != nil {
+			return err
+		}
+		for _, o := range objects {
+			found, missing := props(requested, objectProps(o))
+			responses = append(responses, response{href: h.calendarPath() + o.Name, found: found, missing: missing})
+		}
+	case root.name.Space == nsCalDAV && root.name.Local == "calendar-multiget":
+		for _, href := range root.find(nsDAV, "href") {
+			target := strings.TrimSpace(href.text)
+			name, ok := h.objectName(target)
+			if !ok {
+				responses = append(responses, response{href: target, status: "404 Not Found"})
+				continue
+			}
+			o, err := h.Backend.Get(r.Context(), name)
+			if errors.Is(err, ErrNotFound) {
+				responses = append(responses, response{href: target, status: "404 Not Found"})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			found, missing := props(requested, objectProps(o))
+			responses = append(responses, response{href: target, found: found, missing: missing})
+		}
+	default:
+		http.Error(w, "Unsupported report", http.StatusForbidden)
+		return nil
+	}
+	writeMultistatus(w, responses)
+	return nil
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, path string) error {
+	name, ok := h.objectName(path)
+	if !ok {
+		return ErrNotFound
+	}
+	o, err := h.Backend.Get(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", o.ETag)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, o.Data)
+	}
+	return nil
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, path string) error {
+	name, ok := h.objectName(path)
+	if !ok || !strings.HasSuffix(name, ".ics") {
+		http.Error(w, "Objects must be PUT into the calendar as .ics", http.StatusForbidden)
+		return nil
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxObjectSize))
+	if err != nil {
+		return BadRequestError{err}
+	}
+	etag, created, err := h.Backend.Put(r.Context(), name, string(data),
+		r.Header.Get("If-Match"), r.Header.Get("If-None-Match"))
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request, path string) error {
+	name, ok := h.objectName(path)
+	if !ok {
+		http.Error(w, "Only objects can be deleted", http.StatusForbidden)
+		return nil
+	}
+	if err := h.Backend.Delete(r.Context(), name, r.Header.Get("If-Match")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// queriesTodos reports whether a calendar-query can match VTODOs: its
+// filter names no component inside VCALENDAR or names VTODO.
+func queriesTodos(root *node) bool {
+	filter := root.child(nsCalDAV, "filter")
+	if filter == nil {
+		return true
+	}
+	cal := filter.child(nsCalDAV, "comp-filter")
+	if cal == nil {
+		return true
+	}
+	comp := cal.child(nsCalDAV, "comp-filter")
+	return comp == nil || strings.EqualFold(comp.attrs["name"], "VTODO")
+}
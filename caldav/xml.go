@@ -0,0 +1,161 @@
+package caldav
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsCS     = "http://calendarserver.org/ns/"
+)
+
+// prefixes are used for the namespaces this package writes.
+var prefixes = map[string]string{nsDAV: "d", nsCalDAV: "c", nsCS: "cs"}
+
+// node is an element of a request body. Attributes are kept by local name.
+type node struct {
+	name     xml.Name
+	attrs    map[string]string
+	children []*node
+	text     string
+}
+
+func (n *node) child(space, local string) *node {
+	for _, c := range n.children {
+		if c.name.Space == space && c.name.Local == local {
+			return c
+		}
+	}
+	return nil
+}
+
+// find returns all descendants with the name, in document order.
+func (n *node) find(space, local string) []*node {
+	var found []*node
+	for _, c := range n.children {
+		if c.name.Space == space && c.name.Local == local {
+			found = append(found, c)
+		}
+		found = append(found, c.find(space, local)...)
+	}
+	return found
+}
+
+// parseXML reads a request body. An empty body gives a nil node.
+func parseXML(r io.Reader) (*node, error) {
+	dec := xml.NewDecoder(r)
+	var (
+		root  *node
+		stack []*node
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name, attrs: make(map[string]string, len(t.Attr))}
+			for _, a := range t.Attr {
+				n.attrs[a.Name.Local] = a.Value
+			}
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, errors.New("more than one root element")
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	return root, nil
+}
+
+// property is a property in a response: its name and inner XML, already
+// escaped.
+type property struct {
+	name  xml.Name
+	inner string
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func hrefXML(href string) string {
+	return "<d:href>" + escape(href) + "</d:href>"
+}
+
+// response is one resource in a multistatus body. Properties are grouped by
+// status: found ones get 200, missing ones 404.
+type response struct {
+	href    string
+	found   []property
+	missing []xml.Name
+	// status is set for resources that are missing as a whole.
+	status string
+}
+
+func writeElement(b *strings.Builder, name xml.Name, inner string) {
+	prefix, ok := prefixes[name.Space]
+	tag := prefix + ":" + name.Local
+	if !ok {
+		tag = "x:" + name.Local
+		b.WriteString("<" + tag + ` xmlns:x="` + escape(name.Space) + `"`)
+	} else {
+		b.WriteString("<" + tag)
+	}
+	if inner == "" {
+		b.WriteString("/>")
+		return
+	}
+	b.WriteString(">" + inner + "</" + tag + ">")
+}
+
+func multistatus(responses []response) string {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:c="` + nsCalDAV + `" xmlns:cs="` + nsCS + `">`)
+	for _, r := range responses {
+		b.WriteString("<d:response>" + hrefXML(r.href))
+		if r.status != "" {
+			b.WriteString("<d:status>HTTP/1.1 " + r.status + "</d:status></d:response>")
+			continue
+		}
+		if len(r.found) > 0 {
+			b.WriteString("<d:propstat><d:prop>")
+			for _, p := range r.found {
+				writeElement(&b, p.name, p.inner)
+			}
+			b.WriteString("</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>")
+		}
+		if len(r.missing) > 0 {
+			b.WriteString("<d:propstat><d:prop>")
+			for _, name := range r.missing {
+				writeElement(&b, name, "")
+			}
+			b.WriteString("</d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>")
+		}
+		b.WriteString("</d:response>")
+	}
+	b.WriteString("</d:multistatus>")
+	return b.String()
+}
@@ -0,0 +1,281 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ErrInvalidSnapshot is returned by CheckSnapshot and Restore for files that
+// are not a usable copy of this database.
+var ErrInvalidSnapshot = errors.New("Invalid snapshot")
+
+// restoreTimeout limits how long Restore waits for other connections to
+// release the database.
+const restoreTimeout = 10 * time.Second
+
+// Snapshot writes a consistent copy of the database to path with VACUUM
+// INTO. Writers are not blocked while it runs; path must not exist.
+func Snapshot(ctx context.Context, db *sql.DB, path string) error {
+	_, err := db.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+// CheckSnapshot opens the snapshot read-only and checks that it is an intact
+// database with the scheduler table, made by this or an older version of
+// the server.
+func CheckSnapshot(ctx context.Context, path string) error {
+	snap, err := openSnapshot(path)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	var result string
+	if err := snap.QueryRowContext(ctx, "PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, result)
+	}
+
+	var version int
+	if err := snap.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%w: schema version %d is newer than %d", ErrInvalidSnapshot, version, len(migrations))
+	}
+
+	rows, err := snap.QueryContext(ctx, "SELECT name FROM pragma_table_info('scheduler')")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range []string{"id", "date", "title", "comment", "repeat"} {
+		if !columns[name] {
+			return fmt.Errorf("%w: no column scheduler.%s", ErrInvalidSnapshot, name)
+		}
+	}
+	return nil
+}
+
+// snapshotURI returns the read-only SQLite URI of the file at path, with
+// the characters that have a meaning in URIs escaped.
+func snapshotURI(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: "mode=ro"}
+	return u.String(), nil
+}
+
+func openSnapshot(path string) (*sql.DB, error) {
+	uri, err := snapshotURI(path)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite", uri)
+}
+
+type restorer interface {
+	NewRestore(srcURI string) (*sqlite.Backup, error)
+}
+
+// Restore replaces the contents of db with the snapshot at path through the
+// SQLite backup API, which all connections see at once, and migrates it to
+// the current schema. The change counter continues from the current one,
+// so sync clients don't take restored tasks for what they already have; so
+// do the ids of task events, which clients of /api/events resume from, and
+// the todo.txt sync starts over as with a new file. The audit log is not
+// rolled back: entries made after the snapshot are kept. Neither are the
+// reminder deliveries, so a reminder sent after the snapshot isn't sent
+// again.
+func Restore(ctx context.Context, db *sql.DB, path string) error {
+	if err := CheckSnapshot(ctx, path); err != nil {
+		return err
+	}
+	var counter, eventSeq int64
+	if err := db.QueryRowContext(ctx, "SELECT counter FROM sync_state WHERE id = 1").Scan(&counter); err != nil {
+		return err
+	}
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'task_events'").
+		Scan(&eventSeq)
+	if err != nil {
+		return err
+	}
+	audit, err := newerAuditEntries(ctx, db, path)
+	if err != nil {
+		return err
+	}
+	deliveries, err := reminderDeliveries(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn any) error {
+		r, ok := driverConn.(restorer)
+		if !ok {
+			return errors.New("the driver can't restore backups")
+		}
+		uri, err := snapshotURI(path)
+		if err != nil {
+			return err
+		}
+		// The copy needs the database to itself; readers and writers of
+		// other connections are waited for.
+		deadline := time.Now().Add(restoreTimeout)
+		for {
+			b, err := r.NewRestore(uri)
+			if err != nil {
+				return err
+			}
+			_, err = b.Step(-1)
+			if finishErr := b.Finish(); err == nil {
+				err = finishErr
+			}
+			if err == nil || !isBusy(err) || time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("can't restore %s: %v", path, err)
+	}
+
+	if err := migrate(db); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE sync_state SET counter = MAX(counter, ?) + 1", counter); err != nil {
+		return err
+	}
+	if err := keepSequence(ctx, db, "task_events", eventSeq); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM todotxt_sync"); err != nil {
+		return err
+	}
+	for _, e := range audit {
+		if _, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO audit_log
+			(id, at, ip, session, method, endpoint, task_id, status, outcome)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, e...); err != nil {
+			return err
+		}
+	}
+	for _, d := range deliveries {
+		if _, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO reminder_deliveries
+			(key, notifier, task_id, date, payload, status, attempts, next_attempt_at, last_error, created_at, sent_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepSequence makes the AUTOINCREMENT ids of table go on after seq.
+func keepSequence(ctx context.Context, db *sql.DB, table string, seq int64) error {
+	res, err := db.ExecContext(ctx, "UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = ?", seq, table)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 || seq == 0 {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO sqlite_sequence (name, seq) VALUES (?, ?)", table, seq)
+	return err
+}
+
+// newerAuditEntries reads the audit log entries of db that the snapshot at
+// path doesn't have.
+func newerAuditEntries(ctx context.Context, db *sql.DB, path string) ([][]any, error) {
+	snap, err := openSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+	var last, tables int64
+	// Snapshots older than the audit log have no such table.
+	if err := snap.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'audit_log'").Scan(&tables); err != nil {
+		return nil, err
+	}
+	if tables > 0 {
+		if err := snap.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM audit_log").Scan(&last); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT id, at, ip, session, method, endpoint, task_id, status, outcome
+		FROM audit_log WHERE id > ? ORDER BY id`, last)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries [][]any
+	for rows.Next() {
+		var id, at, status int64
+		var ip, session, method, endpoint, taskID, outcome string
+		if err := rows.Scan(&id, &at, &ip, &session, &method, &endpoint, &taskID, &status, &outcome); err != nil {
+			return nil, err
+		}
+		entries = append(entries, []any{id, at, ip, session, method, endpoint, taskID, status, outcome})
+	}
+	return entries, rows.Err()
+}
+
+// reminderDeliveries reads the reminder deliveries of db. A delivery only
+// goes from pending to sent or failed, so none of them is behind the copy of
+// it in a snapshot.
+func reminderDeliveries(ctx context.Context, db *sql.DB) ([][]any, error) {
+	rows, err := db.QueryContext(ctx, `SELECT key, notifier, task_id, date, payload, status, attempts,
+		next_attempt_at, last_error, created_at, sent_at FROM reminder_deliveries`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries [][]any
+	for rows.Next() {
+		var taskID, attempts, nextAttempt, createdAt, sentAt int64
+		var key, notifier, date, payload, status, lastError string
+		if err := rows.Scan(&key, &notifier, &taskID, &date, &payload, &status, &attempts,
+			&nextAttempt, &lastError, &createdAt, &sentAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries,
+			[]any{key, notifier, taskID, date, payload, status, attempts, nextAttempt, lastError, createdAt, sentAt})
+	}
+	return deliveries, rows.Err()
+}
+
+func isBusy(err error) bool {
+	var e *sqlite.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	code := e.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
@@ -10,13 +10,279 @@ import (
 
 const defDBFile = "./scheduler.db"
 
+// migrations are applied in order on start. The number of applied statements
+// is stored in PRAGMA user_version, so the list must only ever grow: existing
+// databases pick up new tables and columns without touching scheduler rows.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS projects (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		color TEXT NOT NULL DEFAULT '',
+		archived INTEGER NOT NULL DEFAULT 0,
+		sort_order INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_projects_sort ON projects (archived, sort_order)`,
+	// task_meta keeps attributes added after the original scheduler schema,
+	// one row per task, added by the scheduler_meta_insert trigger below.
+	`CREATE TABLE IF NOT EXISTS task_meta (
+		task_id INTEGER PRIMARY KEY,
+		project_id INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_task_meta_project ON task_meta (project_id)`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_meta_delete AFTER DELETE ON scheduler BEGIN
+		DELETE FROM task_meta WHERE task_id = OLD.id;
+	END`,
+	`ALTER TABLE task_meta ADD COLUMN priority INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE task_meta ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE task_meta ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0`,
+	`INSERT OR IGNORE INTO task_meta (task_id, created_at, updated_at)
+		SELECT id, unixepoch(), unixepoch() FROM scheduler`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_meta_insert AFTER INSERT ON scheduler BEGIN
+		INSERT OR IGNORE INTO task_meta (task_id, created_at, updated_at)
+		VALUES (NEW.id, unixepoch(), unixepoch());
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_meta_update AFTER UPDATE ON scheduler BEGIN
+		UPDATE task_meta SET updated_at = unixepoch() WHERE task_id = NEW.id;
+	END`,
+	`CREATE INDEX IF NOT EXISTS idx_task_meta_priority ON task_meta (priority, task_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_task_meta_created ON task_meta (created_at, task_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_task_meta_updated ON task_meta (updated_at, task_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_title ON scheduler (title COLLATE NOCASE, id)`,
+	`CREATE TABLE IF NOT EXISTS checklist_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		task_id INTEGER NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		text TEXT NOT NULL,
+		done INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_checklist_task ON checklist_items (task_id, position)`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_checklist_delete AFTER DELETE ON scheduler BEGIN
+		DELETE FROM checklist_items WHERE task_id = OLD.id;
+	END`,
+	// scheduler_fts indexes titles and comments for /api/tasks?search=. It
+	// stores no text of its own and is kept in sync by the triggers below.
+	`CREATE VIRTUAL TABLE IF NOT EXISTS scheduler_fts USING fts5(
+		title, comment, content='scheduler', content_rowid='id'
+	)`,
+	`INSERT INTO scheduler_fts (scheduler_fts) VALUES ('rebuild')`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_fts_insert AFTER INSERT ON scheduler BEGIN
+		INSERT INTO scheduler_fts (rowid, title, comment) VALUES (NEW.id, NEW.title, NEW.comment);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_fts_delete AFTER DELETE ON scheduler BEGIN
+		INSERT INTO scheduler_fts (scheduler_fts, rowid, title, comment)
+		VALUES ('delete', OLD.id, OLD.title, OLD.comment);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_fts_update AFTER UPDATE OF title, comment ON scheduler BEGIN
+		INSERT INTO scheduler_fts (scheduler_fts, rowid, title, comment)
+		VALUES ('delete', OLD.id, OLD.title, OLD.comment);
+		INSERT INTO scheduler_fts (rowid, title, comment) VALUES (NEW.id, NEW.title, NEW.comment);
+	END`,
+	// scheduler_trigram finds candidates for typo-tolerant search by shared
+	// trigrams; the similarity itself is computed by the tasks package.
+	`CREATE VIRTUAL TABLE IF NOT EXISTS scheduler_trigram USING fts5(
+		title, comment, content='scheduler', content_rowid='id', tokenize='trigram'
+	)`,
+	`INSERT INTO scheduler_trigram (scheduler_trigram) VALUES ('rebuild')`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_trigram_insert AFTER INSERT ON scheduler BEGIN
+		INSERT INTO scheduler_trigram (rowid, title, comment) VALUES (NEW.id, NEW.title, NEW.comment);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_trigram_delete AFTER DELETE ON scheduler BEGIN
+		INSERT INTO scheduler_trigram (scheduler_trigram, rowid, title, comment)
+		VALUES ('delete', OLD.id, OLD.title, OLD.comment);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_trigram_update AFTER UPDATE OF title, comment ON scheduler BEGIN
+		INSERT INTO scheduler_trigram (scheduler_trigram, rowid, title, comment)
+		VALUES ('delete', OLD.id, OLD.title, OLD.comment);
+		INSERT INTO scheduler_trigram (rowid, title, comment) VALUES (NEW.id, NEW.title, NEW.comment);
+	END`,
+	// version is bumped on every change of a task and is used as its ETag.
+	`ALTER TABLE task_meta ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	`DROP TRIGGER IF EXISTS scheduler_meta_update`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_meta_update AFTER UPDATE ON scheduler BEGIN
+		UPDATE task_meta SET updated_at = unixepoch(), version = version + 1 WHERE task_id = NEW.id;
+	END`,
+	// calendar_feeds are the .ics subscriptions. Calendar clients can't log
+	// in, so each feed is reached by its secret token.
+	`CREATE TABLE IF NOT EXISTS calendar_feeds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL DEFAULT '',
+		component TEXT NOT NULL DEFAULT 'VEVENT',
+		project_id INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL DEFAULT 0
+	)`,
+	// sync_state.counter grows with every change of a task and serves as the
+	// CalDAV ctag. Updates of scheduler reach it through scheduler_meta_update.
+	`CREATE TABLE IF NOT EXISTS sync_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		counter INTEGER NOT NULL DEFAULT 0
+	)`,
+	`INSERT OR IGNORE INTO sync_state (id, counter) VALUES (1, 0)`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_sync_insert AFTER INSERT ON scheduler BEGIN
+		UPDATE sync_state SET counter = counter + 1;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_sync_delete AFTER DELETE ON scheduler BEGIN
+		UPDATE sync_state SET counter = counter + 1;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS task_meta_sync_update AFTER UPDATE ON task_meta BEGIN
+		UPDATE sync_state SET counter = counter + 1;
+	END`,
+	// dav_objects keeps the resource names and UIDs chosen by CalDAV clients.
+	// Other tasks are served as <id>.ics with the UID of the .ics feed.
+	`CREATE TABLE IF NOT EXISTS dav_objects (
+		task_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		uid TEXT NOT NULL
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_dav_delete AFTER DELETE ON scheduler BEGIN
+		DELETE FROM dav_objects WHERE task_id = OLD.id;
+	END`,
+	`CREATE TABLE IF NOT EXISTS todotxt_sync (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		path TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		counter INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS todotxt_lines (
+		task_id INTEGER PRIMARY KEY,
+		version INTEGER NOT NULL,
+		line TEXT NOT NULL
+	)`,
+	// audit_log records sign-in attempts and changes made through the API;
+	// at is in milliseconds. task_id is a comma-separated list for requests
+	// that touched several tasks.
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		at INTEGER NOT NULL,
+		ip TEXT NOT NULL,
+		session TEXT NOT NULL,
+		method TEXT NOT NULL,
+		endpoint TEXT NOT NULL,
+		task_id TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		outcome TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_log_at ON audit_log (at)`,
+	// task_revisions keeps the state of a task before each update; version
+	// is the version the task had in that state.
+	`CREATE TABLE IF NOT EXISTS task_revisions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		task_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		saved_at INTEGER NOT NULL,
+		date TEXT NOT NULL,
+		title TEXT NOT NULL,
+		comment TEXT NOT NULL,
+		repeat TEXT NOT NULL,
+		project_id INTEGER NOT NULL,
+		priority INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_task_revisions_task ON task_revisions (task_id, version)`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_revisions_delete AFTER DELETE ON scheduler BEGIN
+		DELETE FROM task_revisions WHERE task_id = OLD.id;
+	END`,
+	// undo_log holds the undo tokens of recent operations: the state of the
+	// task before the operation and its version after it, 0 if the
+	// operation deleted it.
+	`CREATE TABLE IF NOT EXISTS undo_log (
+		token TEXT PRIMARY KEY,
+		task_id INTEGER NOT NULL,
+		op TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		state TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`,
+	// attachments describes the files attached to tasks; the files are kept
+	// in TODO_ATTACH_DIR under stored. Attachments of a deleted task are
+	// marked with orphaned_at and their files are removed once the deletion
+	// can no longer be undone; an undo clears the mark.
+	`CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		task_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		stored TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		orphaned_at INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_attachments_task ON attachments (task_id)`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_attachments_delete AFTER DELETE ON scheduler BEGIN
+		UPDATE attachments SET orphaned_at = unixepoch() WHERE task_id = OLD.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS scheduler_attachments_insert AFTER INSERT ON scheduler BEGIN
+		UPDATE attachments SET orphaned_at = 0 WHERE task_id = NEW.id;
+	END`,
+	`ALTER TABLE task_meta ADD COLUMN remind_before INTEGER NOT NULL DEFAULT 0`,
+	// reminder_deliveries has a row per reminder and notifier. key names the
+	// reminder (task, date and kind), so a reminder is queued once however
+	// often the scheduler runs, and a sent one is never sent again.
+	`CREATE TABLE IF NOT EXISTS reminder_deliveries (
+		key TEXT NOT NULL,
+		notifier TEXT NOT NULL,
+		task_id INTEGER NOT NULL,
+		date TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		sent_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (key, notifier)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_reminder_deliveries_status ON reminder_deliveries (status, next_attempt_at)`,
+	// task_events is the outbox of task changes, written in the transaction
+	// of the change; webhooks read it from last_event_id on.
+	`CREATE TABLE IF NOT EXISTS task_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		task_id INTEGER NOT NULL,
+		task TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT '',
+		secret TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_event_id INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event_id INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL DEFAULT 0,
+		response_status INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		delivered_at INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (webhook_id, event_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status ON webhook_deliveries (status, next_attempt_at)`,
+	// uid names events and deliveries to receivers. Unlike the row ids, which
+	// are used again after a restore from a backup, it never repeats.
+	`ALTER TABLE task_events ADD COLUMN uid TEXT NOT NULL DEFAULT ''`,
+	`UPDATE task_events SET uid = lower(hex(randomblob(16))) WHERE uid = ''`,
+	`CREATE INDEX IF NOT EXISTS idx_task_events_uid ON task_events (uid)`,
+	`ALTER TABLE webhook_deliveries ADD COLUMN uid TEXT NOT NULL DEFAULT ''`,
+	`UPDATE webhook_deliveries SET uid = lower(hex(randomblob(16))) WHERE uid = ''`,
+}
+
 func InitDatabase() (*sql.DB, error) {
 	dbFile := os.Getenv("TODO_DBFILE")
 	if dbFile == "" {
 		dbFile = defDBFile
 	}
 
-	db, err := sql.Open("sqlite", dbFile)
+	// Transactions take the write lock when they begin: one that reads and
+	// then writes would otherwise fail at once with SQLITE_BUSY when another
+	// writer gets there first, without waiting for the busy timeout.
+	db, err := sql.Open("sqlite", dbFile+"?_pragma=busy_timeout(5000)&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("can't open database: %v", err)
 	}
@@ -49,5 +315,33 @@ func InitDatabase() (*sql.DB, error) {
 		fmt.Printf("Using existing database: %s\n", dbFile)
 	}
 
+	if err = migrate(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("can't read schema version: %v", err)
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("can't apply migration %d: %v", i+1, err)
+		}
+		if _, err = tx.Exec(migrations[i]); err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("can't apply migration %d: %v", i+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("can't apply migration %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
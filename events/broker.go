@@ -0,0 +1,258 @@
+// Package events pushes task events to clients of /api/events. The tasks
+// handlers write every change to the task_events outbox; the broker reads
+// new events from it while anyone is subscribed and publishes them to the
+// subscribers, keeping the latest ones for clients that reconnect.
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many events may wait for a slow client before it
+// is disconnected; it resumes with Last-Event-ID.
+const subscriberBuffer = 64
+
+// Event is an event of the outbox. ID orders the events for Last-Event-ID;
+// UID, unlike it, is not used again after a restore.
+type Event struct {
+	ID        int64
+	UID       string
+	Type      string
+	CreatedAt time.Time
+	Task      json.RawMessage
+}
+
+type Broker struct {
+	db   *sql.DB
+	size int
+	wake chan struct{}
+	// polling makes polls run one at a time.
+	polling sync.Mutex
+
+	mu     sync.Mutex
+	buf    []Event
+	lastID int64
+	// resetID is the last id published before a restore of the database.
+	// Clients that have seen no later one have the state of the old
+	// database.
+	resetID int64
+	subs    map[chan Event]struct{}
+}
+
+// NewBroker returns a broker that keeps the last size events.
+func NewBroker(db *sql.DB, size int) *Broker {
+	return &Broker{
+		db:   db,
+		size: size,
+		wake: make(chan struct{}, 1),
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// Notify makes the broker look for new events now rather than on its next
+// tick.
+func (b *Broker) Notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe returns a channel with the events after lastID, or after the
+// latest one if lastID is 0. complete is false if some of those events are
+// no longer kept. cancel must be called when the client is gone; the
+// channel is closed by it, or earlier if the client can't keep up.
+func (b *Broker) Subscribe(ctx context.Context, lastID int64) (ch <-chan Event, complete bool, cancel func(), err error) {
+	// Events written while nobody was subscribed are read first.
+	b.polling.Lock()
+	defer b.polling.Unlock()
+	if err := b.poll(ctx); err != nil {
+		return nil, false, nil, err
+	}
+
+	c := make(chan Event, subscriberBuffer+b.size)
+	b.mu.Lock()
+	complete = lastID == 0 || lastID > b.resetID
+	if complete && lastID != 0 && lastID < b.lastID {
+		complete = len(b.buf) > 0 && b.buf[0].ID <= lastID+1
+		for _, e := range b.buf {
+			if e.ID > lastID {
+				c <- e
+			}
+		}
+	}
+	b.subs[c] = struct{}{}
+	b.mu.Unlock()
+	return c, complete, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[c]; ok {
+			delete(b.subs, c)
+			close(c)
+		}
+	}, nil
+}
+
+func (b *Broker) subscribed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+// Run publishes new events until ctx is done. It looks for them when
+// notified and every interval, but only while anyone is subscribed.
+func (b *Broker) Run(ctx context.Context, interval time.Duration) {
+	// Events from before the start are not published.
+	b.polling.Lock()
+	var lastID int64
+	err := b.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM task_events").Scan(&lastID)
+	if err != nil {
+		log.Printf("Events: %v", err)
+	}
+	b.mu.Lock()
+	if b.lastID == 0 {
+		b.lastID = lastID
+	}
+	b.mu.Unlock()
+	b.polling.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+		if !b.subscribed() {
+			continue
+		}
+		b.polling.Lock()
+		err := b.poll(ctx)
+		b.polling.Unlock()
+		if err != nil {
+			log.Printf("Events: %v", err)
+		}
+	}
+}
+
+// Restored tells the broker that the database was restored from a backup,
+// whether or not anyone is subscribed. The kept events are dropped and the
+// subscribers are disconnected; they reconnect and get a "reset" event.
+func (b *Broker) Restored() {
+	b.polling.Lock()
+	defer b.polling.Unlock()
+	var maxID int64
+	err := b.db.QueryRowContext(context.Background(), "SELECT COALESCE(MAX(id), 0) FROM task_events").Scan(&maxID)
+	if err != nil {
+		log.Printf("Events: %v", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset(maxID)
+}
+
+// reset drops the kept events and the subscribers, and goes on from maxID.
+// b.mu must be held.
+func (b *Broker) reset(maxID int64) {
+	b.resetID = max(b.resetID, b.lastID)
+	b.buf, b.lastID = nil, maxID
+	for c := range b.subs {
+		delete(b.subs, c)
+		close(c)
+	}
+}
+
+// poll publishes the events after the last published one.
+func (b *Broker) poll(ctx context.Context) error {
+	b.mu.Lock()
+	lastID := b.lastID
+	b.mu.Unlock()
+
+	var maxID int64
+	if err := b.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM task_events").Scan(&maxID); err != nil {
+		return err
+	}
+	if maxID < lastID {
+		// The database was restored from a backup without Restored.
+		b.mu.Lock()
+		b.reset(maxID)
+		b.mu.Unlock()
+		return nil
+	}
+	if maxID == lastID {
+		return nil
+	}
+	if maxID-lastID > int64(b.size) {
+		// Only the last size events would be kept anyway. The subscribers
+		// miss the others, so they are disconnected to start over.
+		lastID = maxID - int64(b.size)
+		b.mu.Lock()
+		b.buf = nil
+		for c := range b.subs {
+			delete(b.subs, c)
+			close(c)
+		}
+		b.mu.Unlock()
+	}
+
+	rows, err := b.db.QueryContext(ctx,
+		"SELECT id, uid, type, task, created_at FROM task_events WHERE id > ? ORDER BY id", lastID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e    Event
+			task string
+			at   int64
+		)
+		if err := rows.Scan(&e.ID, &e.UID, &e.Type, &task, &at); err != nil {
+			return err
+		}
+		e.Task = json.RawMessage(task)
+		e.CreatedAt = time.UnixMilli(at)
+		b.publish(e)
+	}
+	return rows.Err()
+}
+
+func (b *Broker) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, e)
+	if len(b.buf) > b.size {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.size:]...)
+	}
+	b.lastID = e.ID
+	for c := range b.subs {
+		select {
+		case c <- e:
+		default:
+			// The client is too slow; it reconnects and resumes.
+			delete(b.subs, c)
+			close(c)
+		}
+	}
+}
+
+// Middleware notifies b after every request that may have changed tasks, so
+// that the change is pushed at once.
+func Middleware(b *Broker, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			b.Notify()
+		}
+	})
+}
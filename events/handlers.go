@@ -0,0 +1,108 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// keepAlive is how often a comment is sent to an idle stream, so that
+// proxies don't close it.
+const keepAlive = 25 * time.Second
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func respondWithError(w http.ResponseWriter, head int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(head)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+}
+
+// Payload is the data of an event, the same as the body of a webhook.
+type Payload struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt string          `json:"created_at"`
+	Task      json.RawMessage `json:"task"`
+}
+
+// StreamHandler serves GET /api/events as Server-Sent Events: one event per
+// task change, named by its type and with the outbox id as the event id. A
+// client that reconnects with Last-Event-ID (or ?last_event_id=...) gets the
+// events it missed; if they are no longer kept, it gets a "reset" event and
+// should load the tasks again.
+func StreamHandler(b *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			respondWithError(w, http.StatusInternalServerError, "Streaming is not supported")
+			return
+		}
+		last := r.Header.Get("Last-Event-ID")
+		if last == "" {
+			last = r.URL.Query().Get("last_event_id")
+		}
+		var lastID int64
+		if last != "" {
+			var err error
+			if lastID, err = strconv.ParseInt(last, 10, 64); err != nil || lastID < 0 {
+				respondWithError(w, http.StatusBadRequest, "Last-Event-ID must be a number")
+				return
+			}
+		}
+
+		events, complete, cancel, err := b.Subscribe(r.Context(), lastID)
+		if err != nil {
+			log.Printf("Events: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		fmt.Fprint(w, "retry: 3000\n\n")
+		if !complete {
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case e, ok := <-events:
+				if !ok {
+					// Disconnected by the broker; the client reconnects.
+					return
+				}
+				data, err := json.Marshal(Payload{
+					ID:        e.UID,
+					Type:      e.Type,
+					CreatedAt: e.CreatedAt.Format(time.RFC3339Nano),
+					Task:      e.Task,
+				})
+				if err != nil {
+					log.Printf("Events: %v", err)
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Package ical reads and writes the subset of iCalendar (RFC 5545) needed to
+// exchange tasks with calendar clients: components, properties with
+// parameters, text escaping and line folding.
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DateFormat is the format of DATE values, the same as task dates.
+	DateFormat = "20060102"
+	// DateTimeFormat is the format of UTC DATE-TIME values.
+	DateTimeFormat = "20060102T150405Z"
+)
+
+// Property is a content line such as DTSTART;VALUE=DATE:20261103. Value is
+// kept as it appears on the line; use Text for TEXT values.
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Text returns the value with TEXT escapes removed.
+func (p *Property) Text() string {
+	return Unescape(p.Value)
+}
+
+// Component is a BEGIN/END block with its properties and nested components.
+type Component struct {
+	Name       string
+	Props      []Property
+	Components []*Component
+	// Line is the line of BEGIN in decoded input.
+	Line int
+}
+
+func NewComponent(name string) *Component {
+	return &Component{Name: name}
+}
+
+// Add appends a property with a raw value. params are name, value pairs.
+func (c *Component) Add(name, value string, params ...string) {
+	p := Property{Name: name, Value: value}
+	if len(params) > 0 {
+		p.Params = make(map[string]string, len(params)/2)
+		for i := 0; i+1 < len(params); i += 2 {
+			p.Params[params[i]] = params[i+1]
+		}
+	}
+	c.Props = append(c.Props, p)
+}
+
+// AddText appends a property with an escaped TEXT value.
+func (c *Component) AddText(name, value string) {
+	c.Add(name, Escape(value))
+}
+
+// AddDate appends a DATE value.
+func (c *Component) AddDate(name string, date time.Time) {
+	c.Add(name, date.Format(DateFormat), "VALUE", "DATE")
+}
+
+// AddTime appends a DATE-TIME value in UTC.
+func (c *Component) AddTime(name string, t time.Time) {
+	c.Add(name, t.UTC().Format(DateTimeFormat))
+}
+
+// Get returns the first property with the name or nil.
+func (c *Component) Get(name string) *Property {
+	for i := range c.Props {
+		if c.Props[i].Name == name {
+			return &c.Props[i]
+		}
+	}
+	return nil
+}
+
+// Value returns the raw value of the first property with the name.
+func (c *Component) Value(name string) string {
+	if p := c.Get(name); p != nil {
+		return p.Value
+	}
+	return ""
+}
+
+// Escape escapes a TEXT value.
+func Escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// Unescape reverses Escape.
+func Unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// Encoder writes components as content lines folded at 75 octets.
+type Encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Begin and End write a component in parts, for streaming large calendars.
+func (e *Encoder) Begin(name string) {
+	e.line("BEGIN:" + name)
+}
+
+func (e *Encoder) End(name string) {
+	e.line("END:" + name)
+}
+
+func (e *Encoder) Property(p Property) {
+	var b strings.Builder
+	b.WriteString(p.Name)
+	names := make([]string, 0, len(p.Params))
+	for name := range p.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := p.Params[name]
+		if strings.ContainsAny(value, ":;,") {
+			value = `"` + value + `"`
+		}
+		b.WriteString(";" + name + "=" + value)
+	}
+	b.WriteString(":" + p.Value)
+	e.line(b.String())
+}
+
+// Encode writes a whole component with its children.
+func (e *Encoder) Encode(c *Component) {
+	e.Begin(c.Name)
+	for _, p := range c.Props {
+		e.Property(p)
+	}
+	for _, child := range c.Components {
+		e.Encode(child)
+	}
+	e.End(c.Name)
+}
+
+// Flush writes buffered lines and returns the first error.
+func (e *Encoder) Flush() error {
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.err
+}
+
+// line writes a content line, folding it without splitting UTF-8 sequences.
+func (e *Encoder) line(s string) {
+	if e.err != nil {
+		return
+	}
+	for limit := 75; len(s) > limit; limit = 74 {
+		cut := limit
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		_, e.err = e.w.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+	}
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s + "\r\n")
+	}
+}
+
+// Decode reads all top-level components, usually a single VCALENDAR.
+func Decode(r io.Reader) ([]*Component, error) {
+	var (
+		top   []*Component
+		stack []*Component
+	)
+	err := readLines(r, func(n int, line string) error {
+		p, err := parseLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		switch p.Name {
+		case "BEGIN":
+			c := &Component{Name: strings.ToUpper(p.Value), Line: n}
+			if len(stack) == 0 {
+				top = append(top, c)
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(p.Value) {
+				return fmt.Errorf("line %d: unexpected END:%s", n, p.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return fmt.Errorf("line %d: property outside of a component", n)
+			}
+			c := stack[len(stack)-1]
+			c.Props = append(c.Props, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("missed END:%s", stack[len(stack)-1].Name)
+	}
+	if len(top) == 0 {
+		return nil, errors.New("no components")
+	}
+	return top, nil
+}
+
+// readLines unfolds content lines and calls f with each of them and the
+// number of its first physical line.
+func readLines(r io.Reader, f func(n int, line string) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	var (
+		line  strings.Builder
+		start int
+	)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimSuffix(sc.Text(), "\r")
+		if n == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+		if strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t") {
+			line.WriteString(text[1:])
+			continue
+		}
+		if line.Len() > 0 {
+			if err := f(start, line.String()); err != nil {
+				return err
+			}
+		}
+		line.Reset()
+		line.WriteString(text)
+		start = n
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if line.Len() > 0 {
+		return f(start, line.String())
+	}
+	return nil
+}
+
+// parseLine splits a content line into name, parameters and value. Names are
+// upper-cased; quoted parameter values may contain ":", ";" and ",".
+func parseLine(line string) (Property, error) {
+	var p Property
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return p, errors.New("invalid content line")
+	}
+	p.Name = strings.ToUpper(line[:i])
+	rest := line[i:]
+	for rest[0] == ';' {
+		rest = rest[1:]
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return p, errors.New("invalid parameter")
+		}
+		name := strings.ToUpper(rest[:eq])
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return p, errors.New("unterminated quote")
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			j := strings.IndexAny(rest, ";:")
+			if j < 0 {
+				return p, errors.New("missed value")
+			}
+			value, rest = rest[:j], rest[j:]
+		}
+		if rest == "" || (rest[0] != ';' && rest[0] != ':') {
+			return p, errors.New("invalid parameter")
+		}
+		if p.Params == nil {
+			p.Params = make(map[string]string)
+		}
+		p.Params[name] = value
+	}
+	p.Value = rest[1:]
+	return p, nil
+}
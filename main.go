@@ -1,16 +1,29 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"main.go/attachments"
+	"main.go/audit"
+	"main.go/backup"
+	"main.go/caldav"
 	"main.go/database"
+	"main.go/events"
+	"main.go/middleware"
 	"main.go/parsedate"
+	"main.go/projects"
+	"main.go/reminders"
 	"main.go/tasks"
+	"main.go/webhooks"
 	_ "modernc.org/sqlite"
 )
 
@@ -18,6 +31,26 @@ const (
 	defPort   = "7540"
 	webDir    = "./web"
 	defDBFile = "./scheduler.db"
+	// defTodoTxtInterval is how often TODO_TXT_FILE is checked, in seconds.
+	defTodoTxtInterval = 5
+	defBackupDir       = "./backups"
+	defBackupKeep      = 7
+	// defAuditDays is how long audit log entries are kept.
+	defAuditDays  = 90
+	defAttachDir  = "./uploads"
+	defAttachSize = 10 << 20
+	// attachSweepInterval is how often files of deleted tasks are looked for.
+	attachSweepInterval = time.Minute
+	// defRemindInterval is how often due reminders are looked for.
+	defRemindInterval = time.Minute
+	// defWebhookInterval is how often new task events are sent to webhooks.
+	defWebhookInterval = 5 * time.Second
+	// defEventsBuffer is how many task events /api/events keeps for clients
+	// that reconnect.
+	defEventsBuffer = 1000
+	// eventsInterval is how often /api/events looks for changes made outside
+	// of requests, such as by the todo.txt sync.
+	eventsInterval = time.Second
 )
 
 func main() {
@@ -43,6 +76,41 @@ func main() {
 	http.HandleFunc("/api/nextdate", parsedate.NextDateHandler)
 	//http.HandleFunc("/api/task", tasks.AddTaskHandler(db))
 	http.HandleFunc("/api/tasks", tasks.GetTasksHandler(db))
+	http.HandleFunc("/api/tasks/suggest", tasks.SuggestHandler(db))
+	http.HandleFunc("/api/tasks/batch", tasks.BatchHandler(db))
+	http.HandleFunc("/api/calendar", tasks.CalendarHandler(db))
+	http.HandleFunc("/api/calendar.ics", tasks.CalendarICSHandler(db))
+	http.HandleFunc("/api/calendar/feeds", middleware.AuthMiddleware(tasks.CalendarFeedsHandler(db)))
+	http.Handle("/dav/", middleware.BasicAuth(&caldav.Handler{
+		Prefix:      "/dav/",
+		DisplayName: "Tasks",
+		Backend:     tasks.NewDAVBackend(db),
+	}))
+	http.Handle("/.well-known/caldav", http.RedirectHandler("/dav/", http.StatusMovedPermanently))
+	backupDir := os.Getenv("TODO_BACKUP_DIR")
+	if backupDir == "" {
+		backupDir = defBackupDir
+	}
+	keep, err := strconv.Atoi(os.Getenv("TODO_BACKUP_KEEP"))
+	if err != nil || keep < 1 {
+		keep = defBackupKeep
+	}
+	backups := backup.NewManager(db, backupDir, keep)
+	http.HandleFunc("/api/backups", middleware.AuthMiddleware(backup.BackupsHandler(backups)))
+	http.HandleFunc("/api/backups/restore", middleware.AuthMiddleware(backup.RestoreHandler(backups)))
+	http.HandleFunc("/api/audit", middleware.AuthMiddleware(audit.LogHandler(db)))
+	eventsBuffer, err := strconv.Atoi(os.Getenv("TODO_EVENTS_BUFFER"))
+	if err != nil || eventsBuffer < 1 {
+		eventsBuffer = defEventsBuffer
+	}
+	broker := events.NewBroker(db, eventsBuffer)
+	backups.OnRestore = broker.Restored
+	go broker.Run(context.Background(), eventsInterval)
+	http.HandleFunc("/api/events", middleware.AuthMiddleware(events.StreamHandler(broker)))
+	http.HandleFunc("/api/webhooks", middleware.AuthMiddleware(webhooks.WebhooksHandler(db)))
+	http.HandleFunc("/api/webhooks/deliveries", middleware.AuthMiddleware(webhooks.DeliveriesHandler(db)))
+	http.HandleFunc("/api/export", tasks.ExportHandler(db))
+	http.HandleFunc("/api/import", tasks.ImportHandler(db))
 	http.HandleFunc("/api/task/done", tasks.DoneMarkHandler(db))
 	http.HandleFunc("/api/signin", parsedate.SignHandler)
 	http.HandleFunc("/api/task", func(w http.ResponseWriter, r *http.Request) {
@@ -53,6 +121,8 @@ func main() {
 			tasks.GetTaskHandler(db)(w, r)
 		case http.MethodPut:
 			tasks.UpdateTaskHandler(db)(w, r)
+		case http.MethodPatch:
+			tasks.PatchTaskHandler(db)(w, r)
 		case http.MethodDelete:
 			tasks.DeleteTaskHandler(db)(w, r)
 		default:
@@ -61,9 +131,94 @@ func main() {
 		}
 	})
 
+	http.HandleFunc("/api/undo", tasks.UndoHandler(db))
+	http.HandleFunc("/api/task/revisions", tasks.RevisionsHandler(db))
+	http.HandleFunc("/api/task/revisions/restore", tasks.RestoreRevisionHandler(db))
+	attachDir := os.Getenv("TODO_ATTACH_DIR")
+	if attachDir == "" {
+		attachDir = defAttachDir
+	}
+	attachSize, err := strconv.ParseInt(os.Getenv("TODO_ATTACH_MAX_SIZE"), 10, 64)
+	if err != nil || attachSize < 1 {
+		attachSize = defAttachSize
+	}
+	attachTypes := attachments.DefaultTypes
+	if v := os.Getenv("TODO_ATTACH_TYPES"); v != "" {
+		attachTypes = strings.Split(v, ",")
+	}
+	files := attachments.NewStore(db, attachDir, attachSize, attachTypes)
+	http.HandleFunc("/api/task/attachments", middleware.AuthMiddleware(attachments.AttachmentsHandler(files)))
+	http.HandleFunc("/api/task/attachments/file", middleware.AuthMiddleware(attachments.DownloadHandler(files)))
+	go files.Run(context.Background(), attachSweepInterval, tasks.UndoWindow())
+	http.HandleFunc("/api/task/move", tasks.MoveTaskHandler(db))
+	http.HandleFunc("/api/task/checklist", tasks.ChecklistHandler(db))
+	http.HandleFunc("/api/task/checklist/toggle", tasks.ToggleChecklistItemHandler(db))
+	http.HandleFunc("/api/task/checklist/reorder", tasks.ReorderChecklistHandler(db))
+	http.HandleFunc("/api/projects", projects.ProjectsHandler(db))
+	http.HandleFunc("/api/project", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			projects.AddProjectHandler(db)(w, r)
+		case http.MethodGet:
+			projects.GetProjectHandler(db)(w, r)
+		case http.MethodPut:
+			projects.UpdateProjectHandler(db)(w, r)
+		case http.MethodDelete:
+			projects.DeleteProjectHandler(db)(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(projects.ErrorResponse{Error: "Method Not Allowed"})
+		}
+	})
+
+	if path := os.Getenv("TODO_TXT_FILE"); path != "" {
+		interval, err := strconv.Atoi(os.Getenv("TODO_TXT_INTERVAL"))
+		if err != nil || interval < 1 {
+			interval = defTodoTxtInterval
+		}
+		go tasks.NewTodoTxtSync(db, path).Run(context.Background(), time.Duration(interval)*time.Second)
+		log.Printf("Syncing tasks with %s\n", path)
+	}
+
+	if v := os.Getenv("TODO_BACKUP_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			log.Fatalf("Bad TODO_BACKUP_INTERVAL: %q", v)
+		}
+		go backups.Run(context.Background(), interval)
+		log.Printf("Backups every %s to %s\n", interval, backupDir)
+	}
+
+	if url := os.Getenv("TODO_REMIND_WEBHOOK"); url != "" {
+		interval := defRemindInterval
+		if v := os.Getenv("TODO_REMIND_INTERVAL"); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil || interval <= 0 {
+				log.Fatalf("Bad TODO_REMIND_INTERVAL: %q", v)
+			}
+		}
+		go reminders.NewScheduler(db, reminders.NewWebhook(url)).Run(context.Background(), interval)
+		log.Printf("Sending reminders to %s\n", url)
+	}
+
+	webhookInterval := defWebhookInterval
+	if v := os.Getenv("TODO_WEBHOOK_INTERVAL"); v != "" {
+		webhookInterval, err = time.ParseDuration(v)
+		if err != nil || webhookInterval <= 0 {
+			log.Fatalf("Bad TODO_WEBHOOK_INTERVAL: %q", v)
+		}
+	}
+	go webhooks.NewDispatcher(db).Run(context.Background(), webhookInterval)
+
+	auditDays, err := strconv.Atoi(os.Getenv("TODO_AUDIT_DAYS"))
+	if err != nil || auditDays < 1 {
+		auditDays = defAuditDays
+	}
+	go audit.Run(context.Background(), db, auditDays)
+
 	log.Printf("Server on: %s\n", port)
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(":"+port, audit.Middleware(db, events.Middleware(broker, http.DefaultServeMux))); err != nil {
 		log.Fatalf("Server start error: %v", err)
 	}
 }
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+)
+
+// BasicAuth protects endpoints for clients that can't sign in with the token
+// cookie, such as CalDAV apps. Any user name is accepted together with
+// TODO_PASSWORD; without a password the endpoints are open, as with
+// AuthMiddleware.
+func BasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		envPassword := os.Getenv("TODO_PASSWORD")
+		if envPassword == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(envPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tasks", charset="UTF-8"`)
+			http.Error(w, "Auth required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
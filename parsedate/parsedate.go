@@ -165,3 +165,38 @@ func containsMonth(months []time.Month, month time.Month) bool {
 	}
 	return false
 }
+
+// Occurrences lists the dates of a task between from and to inclusive: the
+// task date itself and, for repeating tasks, the dates NextDate would move it
+// to one after another. At most max dates are returned.
+func Occurrences(date string, repeat string, from, to time.Time, max int) ([]string, error) {
+	start, err := time.Parse("20060102", date)
+	if err != nil {
+		return nil, fmt.Errorf("Bad date format %s", date)
+	}
+
+	var dates []string
+	if !start.Before(from) && !start.After(to) {
+		dates = append(dates, date)
+	}
+	if repeat == "" {
+		return dates, nil
+	}
+
+	current := from.AddDate(0, 0, -1)
+	if start.After(current) {
+		current = start
+	}
+	for len(dates) < max {
+		next, err := NextDate(current, date, repeat)
+		if err != nil {
+			return nil, err
+		}
+		current, _ = time.Parse("20060102", next)
+		if current.After(to) {
+			break
+		}
+		dates = append(dates, next)
+	}
+	return dates, nil
+}
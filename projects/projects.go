@@ -0,0 +1,251 @@
+package projects
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"main.go/tasks"
+)
+
+type ProjectRequest struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Color     string `json:"color"`
+	Archived  bool   `json:"archived"`
+	SortOrder *int   `json:"sort_order"`
+}
+
+type JSONProject struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Color     string `json:"color"`
+	Archived  bool   `json:"archived"`
+	SortOrder int    `json:"sort_order"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type SuccessResponse struct {
+	ID int64 `json:"id"`
+}
+
+var colorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func respondWithError(w http.ResponseWriter, head int, message string) {
+	w.WriteHeader(head)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+}
+
+func validateProjectRequest(req *ProjectRequest) error {
+	if req.Name == "" {
+		return errors.New("Missed name")
+	}
+	if req.Color != "" && !colorRe.MatchString(req.Color) {
+		return errors.New("Invalid color, expected #RRGGBB")
+	}
+	return nil
+}
+
+func scanProject(row interface{ Scan(...any) error }) (JSONProject, error) {
+	var (
+		p  JSONProject
+		id int64
+	)
+	err := row.Scan(&id, &p.Name, &p.Color, &p.Archived, &p.SortOrder)
+	p.ID = strconv.FormatInt(id, 10)
+	return p, err
+}
+
+// ProjectsHandler lists projects ordered by sort_order. Archived projects are
+// only included with archived=1.
+func ProjectsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := "SELECT id, name, color, archived, sort_order FROM projects"
+		if r.URL.Query().Get("archived") != "1" {
+			query += " WHERE archived = 0"
+		}
+		query += " ORDER BY sort_order, id"
+
+		rows, err := db.QueryContext(r.Context(), query)
+		if err != nil {
+			log.Printf("Error request: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		defer rows.Close()
+
+		projects := make([]JSONProject, 0)
+		for rows.Next() {
+			p, err := scanProject(rows)
+			if err != nil {
+				log.Printf("Row scan error: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Internal server error")
+				return
+			}
+			projects = append(projects, p)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Rows error: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			Projects []JSONProject `json:"projects"`
+		}{Projects: projects})
+	}
+}
+
+func AddProjectHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var req ProjectRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Wrong request format")
+			return
+		}
+		if err := validateProjectRequest(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var res sql.Result
+		var err error
+		if req.SortOrder != nil {
+			res, err = db.ExecContext(r.Context(),
+				"INSERT INTO projects (name, color, archived, sort_order) VALUES (?, ?, ?, ?)",
+				req.Name, req.Color, req.Archived, *req.SortOrder)
+		} else {
+			res, err = db.ExecContext(r.Context(),
+				`INSERT INTO projects (name, color, archived, sort_order)
+				VALUES (?, ?, ?, (SELECT COALESCE(MAX(sort_order), 0) + 1 FROM projects))`,
+				req.Name, req.Color, req.Archived)
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+
+		id, _ := res.LastInsertId()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(SuccessResponse{ID: id})
+	}
+}
+
+func GetProjectHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed id")
+			return
+		}
+
+		p, err := scanProject(db.QueryRowContext(r.Context(),
+			"SELECT id, name, color, archived, sort_order FROM projects WHERE id = ?", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				respondWithError(w, http.StatusNotFound, "Project not found")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+func UpdateProjectHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var req ProjectRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		if req.ID == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed ID")
+			return
+		}
+		if err := validateProjectRequest(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		res, err := db.ExecContext(r.Context(),
+			`UPDATE projects SET name = ?, color = ?, archived = ?,
+			sort_order = COALESCE(?, sort_order) WHERE id = ?`,
+			req.Name, req.Color, req.Archived, req.SortOrder, req.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Project not found")
+			return
+		}
+		json.NewEncoder(w).Encode(struct{}{})
+	}
+}
+
+// DeleteProjectHandler removes a project. By default its tasks are moved to
+// the inbox; tasks=cascade deletes them together with the project.
+func DeleteProjectHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed id")
+			return
+		}
+		mode := r.URL.Query().Get("tasks")
+		if mode == "" {
+			mode = "inbox"
+		}
+		if mode != "inbox" && mode != "cascade" {
+			respondWithError(w, http.StatusBadRequest, "tasks must be inbox or cascade")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.ExecContext(r.Context(), "DELETE FROM projects WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Project not found")
+			return
+		}
+
+		if err := tasks.ReleaseProjectTasks(r.Context(), tx, id, mode == "cascade"); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		json.NewEncoder(w).Encode(struct{}{})
+	}
+}
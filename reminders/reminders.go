@@ -0,0 +1,298 @@
+// Package reminders sends reminders of due tasks through notifiers, such as
+// a webhook. Every reminder is recorded in the database before it is sent,
+// so it is sent once even if the server restarts.
+package reminders
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	KindDue    = "due"
+	KindBefore = "before"
+)
+
+const (
+	// maxOverdue is how many days overdue a task may be to be reminded of,
+	// so the first start on an old database doesn't flood the notifiers.
+	maxOverdue = 7
+	// maxAttempts is how many times a reminder is tried before it is given
+	// up as failed.
+	maxAttempts = 10
+	// deliverBatch limits the reminders sent by one run.
+	deliverBatch = 100
+	// pruneInterval is how often old reminders are removed.
+	pruneInterval = time.Hour
+)
+
+// Reminder is what notifiers receive. Key is the same for every attempt to
+// send the same reminder and can be used to drop duplicates.
+type Reminder struct {
+	Key        string `json:"key"`
+	Kind       string `json:"kind"`
+	TaskID     string `json:"task_id"`
+	Date       string `json:"date"`
+	Title      string `json:"title"`
+	Comment    string `json:"comment"`
+	Repeat     string `json:"repeat,omitempty"`
+	DaysBefore int    `json:"days_before,omitempty"`
+	Overdue    bool   `json:"overdue,omitempty"`
+}
+
+// Notifier delivers reminders. Name identifies it in the database and must
+// stay the same across restarts.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, r Reminder) error
+}
+
+type Scheduler struct {
+	db        *sql.DB
+	notifiers map[string]Notifier
+	lastPrune time.Time
+}
+
+func NewScheduler(db *sql.DB, notifiers ...Notifier) *Scheduler {
+	s := &Scheduler{db: db, notifiers: make(map[string]Notifier)}
+	for _, n := range notifiers {
+		s.notifiers[n.Name()] = n
+	}
+	return s
+}
+
+// Run looks for reminders every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Tick(ctx, time.Now()); err != nil {
+			log.Printf("Reminders: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick queues the reminders due at now and sends the queued ones.
+func (s *Scheduler) Tick(ctx context.Context, now time.Time) error {
+	if now.Sub(s.lastPrune) >= pruneInterval {
+		if err := s.prune(ctx, now); err != nil {
+			return err
+		}
+		s.lastPrune = now
+	}
+	if err := s.queue(ctx, now); err != nil {
+		return err
+	}
+	return s.deliver(ctx, now)
+}
+
+// prune forgets the finished reminders of dates too old to be queued again.
+func (s *Scheduler) prune(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM reminder_deliveries WHERE status != 'pending' AND date < ?",
+		now.AddDate(0, 0, -maxOverdue-1).Format("20060102"))
+	return err
+}
+
+// due returns the reminders of the tasks as of today: one on the date of a
+// task, or later if it is overdue, and one remind_before days ahead.
+func (s *Scheduler) due(ctx context.Context, now time.Time) ([]Reminder, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT s.id, s.date, s.title, COALESCE(s.comment, ''), COALESCE(s.repeat, ''), COALESCE(m.remind_before, 0)
+		FROM scheduler s LEFT JOIN task_meta m ON m.task_id = s.id
+		WHERE s.date BETWEEN ? AND ? OR (m.remind_before > 0 AND s.date > ?)`,
+		today.AddDate(0, 0, -maxOverdue).Format("20060102"), today.Format("20060102"), today.Format("20060102"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Reminder
+	for rows.Next() {
+		var (
+			r      Reminder
+			id     int64
+			before int
+		)
+		if err := rows.Scan(&id, &r.Date, &r.Title, &r.Comment, &r.Repeat, &before); err != nil {
+			return nil, err
+		}
+		date, err := time.ParseInLocation("20060102", r.Date, time.Local)
+		if err != nil {
+			continue
+		}
+		r.TaskID = fmt.Sprint(id)
+		switch {
+		case !date.After(today):
+			r.Kind = KindDue
+			r.Overdue = date.Before(today)
+		case before > 0 && !date.AddDate(0, 0, -before).After(today):
+			r.Kind = KindBefore
+			r.DaysBefore = before
+		default:
+			continue
+		}
+		// A repeating task moved to its next date gets new reminders.
+		r.Key = r.TaskID + ":" + r.Date + ":" + r.Kind
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// queue records the due reminders for every notifier; those recorded
+// before are left as they are. Nothing is written unless there are new
+// ones, as this runs often and other writers would wait.
+func (s *Scheduler) queue(ctx context.Context, now time.Time) error {
+	list, err := s.due(ctx, now)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		r        Reminder
+		notifier string
+	}
+	var fresh []pending
+	for _, r := range list {
+		for name := range s.notifiers {
+			var n int
+			err := s.db.QueryRowContext(ctx,
+				"SELECT COUNT(*) FROM reminder_deliveries WHERE key = ? AND notifier = ?", r.Key, name).Scan(&n)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				fresh = append(fresh, pending{r, name})
+			}
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range fresh {
+		payload, err := json.Marshal(p.r)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO reminder_deliveries (key, notifier, task_id, date, payload, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			p.r.Key, p.notifier, p.r.TaskID, p.r.Date, string(payload), now.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type delivery struct {
+	key, notifier, taskID, date, payload string
+	attempts                             int
+}
+
+// backoff is the delay before the next attempt after the given number of
+// failed ones: a minute, doubling up to an hour.
+func backoff(attempts int) time.Duration {
+	d := time.Minute << (attempts - 1)
+	if attempts > 7 || d > time.Hour {
+		return time.Hour
+	}
+	return d
+}
+
+// deliver sends the queued reminders that are due for an attempt. Reminders
+// of tasks that were deleted, done or moved since they were queued are
+// canceled.
+func (s *Scheduler) deliver(ctx context.Context, now time.Time) error {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT key, notifier, task_id, date, payload, attempts FROM reminder_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= ? ORDER BY created_at, key LIMIT ?`,
+		now.Unix(), deliverBatch)
+	if err != nil {
+		return err
+	}
+	var queued []delivery
+	for rows.Next() {
+		var d delivery
+		if err := rows.Scan(&d.key, &d.notifier, &d.taskID, &d.date, &d.payload, &d.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		queued = append(queued, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range queued {
+		n, ok := s.notifiers[d.notifier]
+		if !ok {
+			// The notifier is not configured now; the reminder waits for it.
+			continue
+		}
+		var current int
+		err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM scheduler WHERE id = ? AND date = ?", d.taskID, d.date).
+			Scan(&current)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			if err := s.finish(ctx, d, "canceled", "", now); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var r Reminder
+		if err := json.Unmarshal([]byte(d.payload), &r); err != nil {
+			return err
+		}
+		if err := n.Notify(ctx, r); err != nil {
+			log.Printf("Reminders: %s via %s: %v", d.key, d.notifier, err)
+			if d.attempts+1 >= maxAttempts {
+				err = s.finish(ctx, d, "failed", err.Error(), now)
+			} else {
+				_, err = s.db.ExecContext(ctx,
+					`UPDATE reminder_deliveries SET attempts = attempts + 1, last_error = ?, next_attempt_at = ?
+					WHERE key = ? AND notifier = ?`,
+					err.Error(), now.Add(backoff(d.attempts+1)).Unix(), d.key, d.notifier)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.finish(ctx, d, "sent", "", now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) finish(ctx context.Context, d delivery, status, lastError string, now time.Time) error {
+	attempts := d.attempts
+	if status != "canceled" {
+		attempts++
+	}
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE reminder_deliveries SET status = ?, attempts = ?, last_error = ?, sent_at = ?
+		WHERE key = ? AND notifier = ?`,
+		status, attempts, lastError, now.Unix(), d.key, d.notifier)
+	return err
+}
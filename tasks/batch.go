@@ -0,0 +1,263 @@
+package tasks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"main.go/audit"
+)
+
+const maxBatchOperations = 1000
+
+type BatchOperation struct {
+	// Op is one of create, update, delete or done.
+	Op string `json:"op"`
+	// Task is the task to create or update.
+	Task *TaskRequest `json:"task,omitempty"`
+	// ID is the task to delete or mark as done.
+	ID string `json:"id,omitempty"`
+	// Version, if set, must match the stored version of the deleted task.
+	Version string `json:"version,omitempty"`
+}
+
+type BatchRequest struct {
+	// Mode is atomic (the default) or best_effort.
+	Mode       string           `json:"mode"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	ID     string `json:"id,omitempty"`
+	OK     bool   `json:"ok"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	// Applied tells whether the changes were committed. In best_effort mode
+	// it is true even if some operations failed.
+	Applied bool          `json:"applied"`
+	Results []BatchResult `json:"results"`
+}
+
+// validate checks an operation before the transaction starts, running task
+// payloads through ValidateAndProcessTaskRequest.
+func (op *BatchOperation) validate(now time.Time) error {
+	switch op.Op {
+	case "create", "update":
+		if op.Task == nil {
+			return errors.New("Missed task")
+		}
+		if op.Op == "update" && op.Task.ID == "" {
+			return errors.New("Missed ID")
+		}
+		req := *op.Task
+		_, err := ValidateAndProcessTaskRequest(&req, now)
+		return err
+	case "delete", "done":
+		if op.ID == "" {
+			return errors.New("Missed id")
+		}
+		return checkVersion(op.Version)
+	}
+	return fmt.Errorf("Unknown op %q", op.Op)
+}
+
+func (op *BatchOperation) apply(r *http.Request, q querier, now time.Time) (string, error) {
+	switch op.Op {
+	case "create":
+		id, err := createTask(r.Context(), q, op.Task, now)
+		return strconv.FormatInt(id, 10), err
+	case "update":
+		return op.Task.ID, updateTask(r.Context(), q, op.Task, now)
+	case "delete":
+		return op.ID, deleteTask(r.Context(), q, op.ID, op.Version)
+	case "done":
+		return op.ID, markTaskDone(r.Context(), q, op.ID, now.UTC())
+	}
+	return "", fmt.Errorf("Unknown op %q", op.Op)
+}
+
+// taskID is the existing task the operation changes, empty for create.
+func (op *BatchOperation) taskID() string {
+	switch op.Op {
+	case "update":
+		return op.Task.ID
+	case "delete", "done":
+		return op.ID
+	}
+	return ""
+}
+
+func failedResult(res BatchResult, err error) BatchResult {
+	res.OK = false
+	res.Status = storeErrorStatus(err)
+	res.Error = err.Error()
+	if res.Status == http.StatusInternalServerError {
+		log.Printf("Batch operation %d: %v", res.Index, err)
+		res.Error = "Server error"
+	}
+	return res
+}
+
+// BatchHandler applies a list of task operations in one transaction. In
+// atomic mode the first failure rolls everything back and the response is
+// sent with that failure's status. In best_effort mode each operation runs
+// in its own savepoint, failed ones are skipped and the rest is committed.
+// The X-Undo-Token of a committed batch undoes all its operations at once.
+func BatchHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+
+		var req BatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Wrong request format")
+			return
+		}
+		if req.Mode == "" {
+			req.Mode = "atomic"
+		}
+		if req.Mode != "atomic" && req.Mode != "best_effort" {
+			respondWithError(w, http.StatusBadRequest, "mode must be atomic or best_effort")
+			return
+		}
+		if len(req.Operations) == 0 {
+			respondWithError(w, http.StatusBadRequest, "No operations")
+			return
+		}
+		if len(req.Operations) > maxBatchOperations {
+			respondWithError(w, http.StatusBadRequest, "Too many operations, max "+strconv.Itoa(maxBatchOperations))
+			return
+		}
+		atomic := req.Mode == "atomic"
+
+		now := time.Now().Local().Truncate(24 * time.Hour)
+		results := make([]BatchResult, len(req.Operations))
+		failed := -1
+		for i := range req.Operations {
+			op := &req.Operations[i]
+			results[i] = BatchResult{Index: i, Op: op.Op, ID: op.ID, OK: true}
+			if err := op.validate(now); err != nil {
+				results[i] = failedResult(results[i], requestError{err})
+				if failed < 0 {
+					failed = i
+				}
+			}
+		}
+		if atomic && failed >= 0 {
+			respondWithBatch(w, results[failed].Status, false, results)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		// The tasks in the order of their first successful operation, and
+		// their states before it, for the undo token.
+		var touched []string
+		before := map[string]*undoState{}
+		for i := range req.Operations {
+			if !results[i].OK {
+				continue
+			}
+			op := &req.Operations[i]
+			if !atomic {
+				if _, err := tx.ExecContext(r.Context(), "SAVEPOINT batch_op"); err != nil {
+					respondWithError(w, http.StatusInternalServerError, "Server error")
+					return
+				}
+			}
+
+			var state *undoState
+			if id := op.taskID(); id != "" {
+				if _, seen := before[id]; !seen {
+					state, err = snapshotTask(r.Context(), tx, id, true)
+					if err != nil && !errors.Is(err, errTaskNotFound) {
+						respondWithError(w, http.StatusInternalServerError, "Server error")
+						return
+					}
+				}
+			}
+
+			id, err := op.apply(r, tx, now)
+			if err != nil {
+				results[i] = failedResult(results[i], err)
+				if atomic {
+					respondWithBatch(w, results[i].Status, false, results)
+					return
+				}
+				_, err = tx.ExecContext(r.Context(), "ROLLBACK TO batch_op")
+			} else {
+				results[i].ID = id
+				if _, seen := before[id]; !seen {
+					touched = append(touched, id)
+					before[id] = state
+				}
+			}
+			if err == nil && !atomic {
+				_, err = tx.ExecContext(r.Context(), "RELEASE batch_op")
+			}
+			if err != nil {
+				log.Printf("Batch savepoint: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+		}
+
+		if len(touched) > 0 {
+			token, err := recordBatchUndo(r.Context(), tx, touched, before)
+			if err != nil {
+				log.Printf("Undo: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			w.Header().Set(UndoHeader, token)
+		}
+		if err := tx.Commit(); err != nil {
+			w.Header().Del(UndoHeader)
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		var ids []string
+		for _, res := range results {
+			if res.OK && res.ID != "" {
+				ids = append(ids, res.ID)
+			}
+		}
+		audit.SetTaskID(r.Context(), ids...)
+		respondWithBatch(w, http.StatusOK, true, results)
+	}
+}
+
+func respondWithBatch(w http.ResponseWriter, head int, applied bool, results []BatchResult) {
+	if !applied {
+		// Nothing was committed, so the other operations did not happen.
+		for i := range results {
+			if results[i].OK {
+				results[i].OK = false
+				results[i].Error = "Rolled back"
+				if results[i].Op == "create" {
+					results[i].ID = ""
+				}
+			}
+		}
+	}
+	w.WriteHeader(head)
+	json.NewEncoder(w).Encode(BatchResponse{Applied: applied, Results: results})
+}
@@ -0,0 +1,122 @@
+package tasks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"main.go/parsedate"
+)
+
+const (
+	defCalendarDays = 31
+	maxCalendarDays = 366
+	// maxCalendarEntries caps the size of a calendar response.
+	maxCalendarEntries = 10000
+)
+
+type CalendarEntry struct {
+	JSONTask
+	// Virtual marks repetitions computed from the repeat rule; the task
+	// itself is stored with its nearest date.
+	Virtual bool `json:"virtual,omitempty"`
+}
+
+// CalendarHandler returns the tasks of every day between from and to
+// (inclusive, at most maxCalendarDays apart). Repeating tasks appear on each
+// day they repeat on. project_id and search narrow the tasks down as in
+// /api/tasks.
+func CalendarHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		params := r.URL.Query()
+		// Dates are compared as UTC midnights, like in parsedate.
+		now := today()
+		from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		if v := params.Get("from"); v != "" {
+			d, err := parseSearchDate("from", v)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			from, _ = time.Parse("20060102", d)
+		}
+		to := from.AddDate(0, 0, defCalendarDays-1)
+		if v := params.Get("to"); v != "" {
+			d, err := parseSearchDate("to", v)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			to, _ = time.Parse("20060102", d)
+		}
+		if to.Before(from) {
+			respondWithError(w, http.StatusBadRequest, "to is before from")
+			return
+		}
+		if to.Sub(from) >= maxCalendarDays*24*time.Hour {
+			respondWithError(w, http.StatusBadRequest, "Window is longer than "+strconv.Itoa(maxCalendarDays)+" days")
+			return
+		}
+
+		var filter taskFilter
+		if project := params.Get("project_id"); project != "" {
+			projectID, err := parseProjectID(project)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			filter.add("COALESCE(m.project_id, 0) = ?", projectID)
+		}
+		if search := params.Get("search"); search != "" {
+			if err := applySearch(&filter, search, false); err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		filter.add("(s.date BETWEEN ? AND ? OR (COALESCE(s.repeat, '') <> '' AND s.date <= ?))",
+			from.Format("20060102"), to.Format("20060102"), to.Format("20060102"))
+
+		tasks, err := queryTasks(r.Context(), db,
+			"SELECT "+taskColumns+", "+filter.rankColumns()+filter.from()+filter.where()+" ORDER BY s.date, s.id",
+			filter.args...)
+		if err != nil {
+			log.Printf("Error request: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+
+		days := map[string][]CalendarEntry{}
+		entries := 0
+		for _, task := range tasks {
+			dates, err := parsedate.Occurrences(task.Date, task.Repeat, from, to, maxCalendarEntries-entries)
+			if err != nil {
+				// A task with a broken rule is still shown on its own date.
+				log.Printf("Task %d: %v", task.ID, err)
+				dates, _ = parsedate.Occurrences(task.Date, "", from, to, 1)
+			}
+			for _, d := range dates {
+				days[d] = append(days[d], CalendarEntry{JSONTask: toJSONTask(task), Virtual: d != task.Date})
+			}
+			entries += len(dates)
+			if entries >= maxCalendarEntries {
+				respondWithError(w, http.StatusBadRequest, "Too many tasks in the window, narrow it down")
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			From string                     `json:"from"`
+			To   string                     `json:"to"`
+			Days map[string][]CalendarEntry `json:"days"`
+		}{
+			From: from.Format("20060102"),
+			To:   to.Format("20060102"),
+			Days: days,
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type ChecklistItemRequest struct {
+	ID     string `json:"id"`
+	TaskID string `json:"task_id"`
+	Text   string `json:"text"`
+	// Done left out keeps the current state on update.
+	Done *bool `json:"done"`
+}
+
+type ChecklistReorderRequest struct {
+	TaskID string   `json:"task_id"`
+	IDs    []string `json:"ids"`
+}
+
+type JSONChecklistItem struct {
+	ID       string `json:"id"`
+	TaskID   string `json:"task_id"`
+	Text     string `json:"text"`
+	Done     bool   `json:"done"`
+	Position int    `json:"position"`
+}
+
+const selectChecklistItem = "SELECT id, task_id, text, done, position FROM checklist_items"
+
+func scanChecklistItem(row scanner) (JSONChecklistItem, error) {
+	var (
+		item         JSONChecklistItem
+		id, parentID int64
+	)
+	err := row.Scan(&id, &parentID, &item.Text, &item.Done, &item.Position)
+	item.ID = strconv.FormatInt(id, 10)
+	item.TaskID = strconv.FormatInt(parentID, 10)
+	return item, err
+}
+
+func resetChecklist(ctx context.Context, q querier, taskID string) error {
+	_, err := q.ExecContext(ctx, "UPDATE checklist_items SET done = 0 WHERE task_id = ?", taskID)
+	return err
+}
+
+// checklistChanged bumps the version of the task taskID, as its checklist
+// progress is part of it, and records the update.
+func checklistChanged(ctx context.Context, q querier, taskID string) error {
+	if err := touchTask(ctx, q, taskID); err != nil {
+		return err
+	}
+	return recordTaskEvent(ctx, q, EventUpdated, taskID)
+}
+
+func taskExists(ctx context.Context, q querier, id string) (bool, error) {
+	var n int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM scheduler WHERE id = ?", id).Scan(&n)
+	return n > 0, err
+}
+
+// ChecklistHandler serves /api/task/checklist: GET lists the items of
+// task_id, POST appends an item, PUT edits text or done state, DELETE
+// removes an item.
+func ChecklistHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			listChecklist(db, w, r)
+		case http.MethodPost:
+			addChecklistItem(db, w, r)
+		case http.MethodPut:
+			updateChecklistItem(db, w, r)
+		case http.MethodDelete:
+			deleteChecklistItem(db, w, r)
+		default:
+			respondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	}
+}
+
+func listChecklist(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	taskID := r.URL.Query().Get("task_id")
+	if taskID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missed task_id")
+		return
+	}
+	exists, err := taskExists(r.Context(), db, taskID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "Task not found")
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		selectChecklistItem+" WHERE task_id = ? ORDER BY position, id", taskID)
+	if err != nil {
+		log.Printf("Error request: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	defer rows.Close()
+
+	items := make([]JSONChecklistItem, 0)
+	for rows.Next() {
+		item, err := scanChecklistItem(rows)
+		if err != nil {
+			log.Printf("Row scan error: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Rows error: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Items []JSONChecklistItem `json:"items"`
+	}{Items: items})
+}
+
+func addChecklistItem(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var req ChecklistItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Wrong request format")
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.TaskID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missed task_id")
+		return
+	}
+	if req.Text == "" {
+		respondWithError(w, http.StatusBadRequest, "Missed text")
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	defer tx.Rollback()
+
+	exists, err := taskExists(r.Context(), tx, req.TaskID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "Task not found")
+		return
+	}
+
+	done := req.Done != nil && *req.Done
+	res, err := tx.ExecContext(r.Context(),
+		`INSERT INTO checklist_items (task_id, text, done, position)
+		VALUES (?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM checklist_items WHERE task_id = ?))`,
+		req.TaskID, req.Text, done, req.TaskID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if err := checklistChanged(r.Context(), tx, req.TaskID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	id, _ := res.LastInsertId()
+	respondWithSuccess(w, http.StatusCreated, id)
+}
+
+func updateChecklistItem(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var req ChecklistItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if req.ID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missed ID")
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" && req.Done == nil {
+		respondWithError(w, http.StatusBadRequest, "Nothing to update")
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	defer tx.Rollback()
+
+	var taskID string
+	err = tx.QueryRowContext(r.Context(),
+		`UPDATE checklist_items SET text = COALESCE(NULLIF(?, ''), text), done = COALESCE(?, done) WHERE id = ?
+		RETURNING task_id`,
+		req.Text, req.Done, req.ID).Scan(&taskID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if err := checklistChanged(r.Context(), tx, taskID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	json.NewEncoder(w).Encode(struct{}{})
+}
+
+func deleteChecklistItem(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		respondWithError(w, http.StatusBadRequest, "Missed id")
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	defer tx.Rollback()
+
+	var taskID string
+	err = tx.QueryRowContext(r.Context(), "DELETE FROM checklist_items WHERE id = ? RETURNING task_id", id).Scan(&taskID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if err := checklistChanged(r.Context(), tx, taskID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	json.NewEncoder(w).Encode(struct{}{})
+}
+
+// ToggleChecklistItemHandler flips the done state of an item and returns the
+// updated item.
+func ToggleChecklistItemHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed id")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		item, err := scanChecklistItem(tx.QueryRowContext(r.Context(),
+			"UPDATE checklist_items SET done = 1 - done WHERE id = ? RETURNING id, task_id, text, done, position", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				respondWithError(w, http.StatusNotFound, "Item not found")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if err := checklistChanged(r.Context(), tx, item.TaskID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		json.NewEncoder(w).Encode(item)
+	}
+}
+
+// ReorderChecklistHandler sets the order of a task's checklist. ids must list
+// every item of the task exactly once.
+func ReorderChecklistHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+
+		var req ChecklistReorderRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Wrong request format")
+			return
+		}
+		if req.TaskID == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed task_id")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		var count int
+		err = tx.QueryRowContext(r.Context(),
+			"SELECT COUNT(*) FROM checklist_items WHERE task_id = ?", req.TaskID).Scan(&count)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if count != len(req.IDs) {
+			respondWithError(w, http.StatusBadRequest, "ids must list every item of the task")
+			return
+		}
+
+		seen := make(map[string]bool, len(req.IDs))
+		for i, id := range req.IDs {
+			if seen[id] {
+				respondWithError(w, http.StatusBadRequest, "Duplicate item id "+id)
+				return
+			}
+			seen[id] = true
+
+			res, err := tx.ExecContext(r.Context(),
+				"UPDATE checklist_items SET position = ? WHERE id = ? AND task_id = ?",
+				i+1, id, req.TaskID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				respondWithError(w, http.StatusBadRequest, "Item "+id+" does not belong to the task")
+				return
+			}
+		}
+		if err := checklistChanged(r.Context(), tx, req.TaskID); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		json.NewEncoder(w).Encode(struct{}{})
+	}
+}
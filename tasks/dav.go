@@ -0,0 +1,362 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/audit"
+	"main.go/caldav"
+	"main.go/ical"
+)
+
+// davDefaultName is the resource name of tasks that were not created over
+// CalDAV.
+var davDefaultName = regexp.MustCompile(`^(\d+)\.ics$`)
+
+// xRepeat carries the repeat rule in objects served over CalDAV, so rules
+// RRULE can't express survive a round trip through a client.
+const xRepeat = "X-TODO-REPEAT"
+
+// DAVBackend serves tasks as the VTODOs of a CalDAV calendar.
+type DAVBackend struct {
+	db *sql.DB
+}
+
+func NewDAVBackend(db *sql.DB) *DAVBackend {
+	return &DAVBackend{db: db}
+}
+
+type davObject struct {
+	name, uid string
+}
+
+func (b *DAVBackend) CTag(ctx context.Context) (string, error) {
+	var counter int64
+	err := b.db.QueryRowContext(ctx, "SELECT counter FROM sync_state WHERE id = 1").Scan(&counter)
+	return etag(counter), err
+}
+
+func (b *DAVBackend) List(ctx context.Context, withData bool) ([]caldav.Object, error) {
+	objects, err := davObjects(ctx, b.db)
+	if err != nil {
+		return nil, err
+	}
+	projects, err := projectNames(ctx, b.db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.db.QueryContext(ctx, selectTask+" ORDER BY s.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []caldav.Object
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		o := davTaskObject(task, objects[task.ID], projects)
+		if !withData {
+			o.Data = ""
+		}
+		list = append(list, o)
+	}
+	return list, rows.Err()
+}
+
+func davObjects(ctx context.Context, q querier) (map[int]davObject, error) {
+	rows, err := q.QueryContext(ctx, "SELECT task_id, name, uid FROM dav_objects")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := make(map[int]davObject)
+	for rows.Next() {
+		var (
+			id int
+			o  davObject
+		)
+		if err := rows.Scan(&id, &o.name, &o.uid); err != nil {
+			return nil, err
+		}
+		objects[id] = o
+	}
+	return objects, rows.Err()
+}
+
+// davTaskObject renders a task as a calendar object. o is empty for tasks
+// that were not created over CalDAV.
+func davTaskObject(task DBTask, o davObject, projects map[int64]string) caldav.Object {
+	if o.name == "" {
+		o = davObject{name: strconv.Itoa(task.ID) + ".ics", uid: taskUID(task.ID, "")}
+	}
+	rrule, _ := repeatRule(task.Date, task.Repeat)
+	todo := taskComponent("VTODO", task, projects[task.ProjectID], task.Date, rrule, o.uid)
+	if task.Repeat != "" {
+		todo.AddText(xRepeat, task.Repeat)
+	}
+
+	cal := ical.NewComponent("VCALENDAR")
+	cal.Add("VERSION", "2.0")
+	cal.Add("PRODID", "-//"+icsDomain+"//tasks//EN")
+	cal.Components = append(cal.Components, todo)
+
+	var b strings.Builder
+	enc := ical.NewEncoder(&b)
+	enc.Encode(cal)
+	enc.Flush()
+	return caldav.Object{Name: o.name, ETag: etag(task.Version), Data: b.String()}
+}
+
+// resolve finds the task of a resource name.
+func resolve(ctx context.Context, q querier, name string) (int, error) {
+	var id int
+	err := q.QueryRowContext(ctx, "SELECT task_id FROM dav_objects WHERE name = ?", name).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	m := davDefaultName.FindStringSubmatch(name)
+	if m == nil {
+		return 0, caldav.ErrNotFound
+	}
+	err = q.QueryRowContext(ctx,
+		"SELECT id FROM scheduler s WHERE id = ? AND NOT EXISTS (SELECT 1 FROM dav_objects d WHERE d.task_id = s.id)",
+		m[1]).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, caldav.ErrNotFound
+	}
+	return id, err
+}
+
+func (b *DAVBackend) Get(ctx context.Context, name string) (caldav.Object, error) {
+	id, err := resolve(ctx, b.db, name)
+	if err != nil {
+		return caldav.Object{}, err
+	}
+	task, err := getTask(ctx, b.db, strconv.Itoa(id))
+	if err == sql.ErrNoRows {
+		return caldav.Object{}, caldav.ErrNotFound
+	}
+	if err != nil {
+		return caldav.Object{}, err
+	}
+	projects, err := projectNames(ctx, b.db)
+	if err != nil {
+		return caldav.Object{}, err
+	}
+	objects, err := davObjects(ctx, b.db)
+	if err != nil {
+		return caldav.Object{}, err
+	}
+	return davTaskObject(task, objects[id], projects), nil
+}
+
+// davVersion turns an If-Match value into a task version; "" and "*" match
+// any version.
+func davVersion(ifMatch string) (string, error) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return "", nil
+	}
+	version := strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`)
+	if v, err := strconv.ParseInt(version, 10, 64); err != nil || v < 1 {
+		return "", caldav.ErrPrecondition
+	}
+	return version, nil
+}
+
+// davError maps the errors of the store functions onto caldav errors.
+func davError(err error) error {
+	var reqErr requestError
+	switch {
+	case errors.Is(err, errVersionConflict):
+		return caldav.ErrPrecondition
+	case errors.Is(err, errTaskNotFound):
+		return caldav.ErrNotFound
+	case errors.As(err, &reqErr), errors.Is(err, errProjectNotFound):
+		return caldav.BadRequestError{Err: err}
+	}
+	return err
+}
+
+// davTodo returns the VTODO of a calendar object, skipping changes of single
+// repetitions and time zone definitions.
+func davTodo(data string) (*ical.Component, error) {
+	calendars, err := ical.Decode(strings.NewReader(data))
+	if err != nil {
+		return nil, caldav.BadRequestError{Err: err}
+	}
+	var todo *ical.Component
+	for _, cal := range calendars {
+		for _, c := range cal.Components {
+			switch c.Name {
+			case "VTODO":
+				if c.Get("RECURRENCE-ID") == nil && todo == nil {
+					todo = c
+				}
+			case "VTIMEZONE":
+			default:
+				return nil, caldav.BadRequestError{Err: errors.New("Only VTODO is supported")}
+			}
+		}
+	}
+	if todo == nil {
+		return nil, caldav.BadRequestError{Err: errors.New("Missed VTODO")}
+	}
+	return todo, nil
+}
+
+// Put stores a VTODO. A new object creates a task; an existing one is
+// changed like PATCH /api/task, with only the changed fields revalidated, so
+// an overdue task keeps its date. Completing a task over CalDAV marks it
+// done, which moves a repeating task to its next date and deletes others.
+func (b *DAVBackend) Put(ctx context.Context, name, data, ifMatch, ifNoneMatch string) (string, bool, error) {
+	todo, err := davTodo(data)
+	if err != nil {
+		return "", false, err
+	}
+	version, err := davVersion(ifMatch)
+	if err != nil {
+		return "", false, err
+	}
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	id, err := resolve(ctx, tx, name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, caldav.ErrNotFound) {
+		return "", false, err
+	}
+	if exists && ifNoneMatch == "*" || !exists && ifMatch != "" {
+		return "", false, caldav.ErrPrecondition
+	}
+
+	row := icsRow(todo)
+	for _, warning := range row.Warnings {
+		log.Printf("CalDAV %s: %s", name, warning)
+	}
+	t := row.Task
+	if repeat := todo.Get(xRepeat); repeat != nil {
+		// The exact rule is kept unless the client changed the RRULE.
+		rrule, _ := repeatRule(t.Date, repeat.Text())
+		if todo.Value("RRULE") == rrule {
+			t.Repeat = repeat.Text()
+		}
+	}
+	now := time.Now().Local().Truncate(24 * time.Hour)
+	im := &importer{ctx: ctx, q: tx, now: now}
+
+	var created bool
+	switch {
+	case row.Skip && !exists:
+		// A task created as completed is not stored.
+		return "", true, tx.Commit()
+	case row.Skip:
+		err = b.complete(ctx, tx, strconv.Itoa(id), version, now)
+	case exists:
+		err = b.update(ctx, tx, im, strconv.Itoa(id), t, version, now)
+	default:
+		id, err = b.create(ctx, tx, im, name, todo.Value("UID"), t, now)
+		created = true
+	}
+	if err != nil {
+		return "", false, davError(err)
+	}
+	audit.SetTaskID(ctx, strconv.Itoa(id))
+
+	var tag string
+	if task, err := getTask(ctx, tx, strconv.Itoa(id)); err == nil {
+		tag = etag(task.Version)
+	} else if err != sql.ErrNoRows {
+		return "", false, err
+	}
+	return tag, created, tx.Commit()
+}
+
+func (b *DAVBackend) complete(ctx context.Context, q querier, id, version string, now time.Time) error {
+	if version != "" {
+		task, err := getTask(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		if strconv.FormatInt(task.Version, 10) != version {
+			return errVersionConflict
+		}
+	}
+	return markTaskDone(ctx, q, id, now.UTC())
+}
+
+func (b *DAVBackend) create(ctx context.Context, q querier, im *importer, name, uid string, t ExportTask, now time.Time) (int, error) {
+	projectID, err := im.projectID(t.Project)
+	if err != nil {
+		return 0, err
+	}
+	req := TaskRequest{
+		Date:      t.Date,
+		Title:     strings.TrimSpace(t.Title),
+		Comment:   t.Comment,
+		Repeat:    t.Repeat,
+		ProjectID: strconv.FormatInt(projectID, 10),
+		Priority:  t.Priority,
+	}
+	id, err := createTask(ctx, q, &req, now)
+	if err != nil {
+		return 0, err
+	}
+	if uid == "" {
+		uid = taskUID(int(id), "")
+	}
+	_, err = q.ExecContext(ctx, "INSERT INTO dav_objects (task_id, name, uid) VALUES (?, ?, ?)", id, name, uid)
+	return int(id), err
+}
+
+// update patches the fields that differ from the stored task. A missing due
+// date or category leaves the date or project as it is.
+func (b *DAVBackend) update(ctx context.Context, q querier, im *importer, id string, t ExportTask, version string, now time.Time) error {
+	task, err := getTask(ctx, q, id)
+	if err != nil {
+		return err
+	}
+	patch, err := im.changes(toJSONTask(task), t)
+	if err != nil {
+		return err
+	}
+	return patchTask(ctx, q, id, patch, version, now)
+}
+
+func (b *DAVBackend) Delete(ctx context.Context, name, ifMatch string) error {
+	version, err := davVersion(ifMatch)
+	if err != nil {
+		return err
+	}
+
+	// The deletion and its event are written together.
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id, err := resolve(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+	audit.SetTaskID(ctx, strconv.Itoa(id))
+	if err := deleteTask(ctx, tx, strconv.Itoa(id), version); err != nil {
+		return davError(err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,75 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Events of tasks are written to the task_events table in the transaction of
+// the change, so that they exist only if it is committed and are not lost if
+// the server stops before they are delivered.
+const (
+	EventCreated = "task.created"
+	EventUpdated = "task.updated"
+	EventDone    = "task.done"
+	EventDeleted = "task.deleted"
+)
+
+// EventTypes lists the events in the order they are documented.
+var EventTypes = []string{EventCreated, EventUpdated, EventDone, EventDeleted}
+
+// recordEvent adds event to the outbox with the state of task: the new one,
+// or the last one for a deleted task. The event gets a random uid, which
+// receivers see as its id.
+func recordEvent(ctx context.Context, q querier, event string, task DBTask) error {
+	data, err := json.Marshal(toJSONTask(task))
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx,
+		"INSERT INTO task_events (uid, type, task_id, task, created_at) VALUES (lower(hex(randomblob(16))), ?, ?, ?, ?)",
+		event, task.ID, string(data), time.Now().UnixMilli())
+	return err
+}
+
+// recordTaskEvent is recordEvent with the current state of the task id.
+func recordTaskEvent(ctx context.Context, q querier, event, id string) error {
+	task, err := getTask(ctx, q, id)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return recordEvent(ctx, q, event, task)
+}
+
+// recordDeletions records the deletion of every task, before all of them
+// are replaced by an import.
+func recordDeletions(ctx context.Context, q querier) error {
+	rows, err := q.QueryContext(ctx, selectTask+" ORDER BY s.id")
+	if err != nil {
+		return err
+	}
+	var all []DBTask
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, task)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, task := range all {
+		if err := recordEvent(ctx, q, EventDeleted, task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportPageSize is the number of tasks read per query while exporting, so
+// a slow client does not keep the database locked.
+const exportPageSize = 500
+
+// ExportTask is a task in the export and import formats. Projects are
+// referred to by name, since ids differ between databases.
+type ExportTask struct {
+	ID       string `json:"id,omitempty"`
+	Date     string `json:"date"`
+	Title    string `json:"title"`
+	Comment  string `json:"comment,omitempty"`
+	Repeat   string `json:"repeat,omitempty"`
+	Project  string `json:"project,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	// RemindBefore is the number of days before the date to be reminded.
+	RemindBefore string                `json:"remind_before,omitempty"`
+	CreatedAt    string                `json:"created_at,omitempty"`
+	UpdatedAt    string                `json:"updated_at,omitempty"`
+	Checklist    []ExportChecklistItem `json:"checklist,omitempty"`
+}
+
+type ExportChecklistItem struct {
+	Text string `json:"text"`
+	Done bool   `json:"done"`
+}
+
+// exportEncoder writes tasks in one of the export formats.
+type exportEncoder interface {
+	begin() error
+	task(ExportTask) error
+	end() error
+}
+
+type exportFormat struct {
+	contentType string
+	extension   string
+	encoder     func(w io.Writer) exportEncoder
+}
+
+var exportFormats = map[string]exportFormat{
+	"json":    {"application/json", "json", newJSONExport},
+	"csv":     {"text/csv; charset=utf-8", "csv", newCSVExport},
+	"todotxt": {"text/plain; charset=utf-8", "txt", newTodoTxtExport},
+}
+
+type jsonExport struct {
+	w     io.Writer
+	enc   *json.Encoder
+	first bool
+}
+
+func newJSONExport(w io.Writer) exportEncoder {
+	return &jsonExport{w: w, enc: json.NewEncoder(w), first: true}
+}
+
+func (e *jsonExport) begin() error {
+	_, err := io.WriteString(e.w, `{"tasks":[`+"\n")
+	return err
+}
+
+func (e *jsonExport) task(t ExportTask) error {
+	if !e.first {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.first = false
+	return e.enc.Encode(t)
+}
+
+func (e *jsonExport) end() error {
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
+
+// csvColumns are the columns of the CSV format. The checklist is one item
+// per line, each prefixed with "[ ] " or "[x] ".
+var csvColumns = []string{"id", "date", "title", "comment", "repeat", "project", "priority",
+	"remind_before", "created_at", "updated_at", "checklist"}
+
+type csvExport struct {
+	w *csv.Writer
+}
+
+func newCSVExport(w io.Writer) exportEncoder {
+	return &csvExport{w: csv.NewWriter(w)}
+}
+
+func (e *csvExport) begin() error {
+	return e.w.Write(csvColumns)
+}
+
+func (e *csvExport) task(t ExportTask) error {
+	return e.w.Write([]string{t.ID, t.Date, t.Title, t.Comment, t.Repeat, t.Project, t.Priority,
+		t.RemindBefore, t.CreatedAt, t.UpdatedAt, formatChecklist(t.Checklist)})
+}
+
+func (e *csvExport) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func formatChecklist(items []ExportChecklistItem) string {
+	lines := make([]string, len(items))
+	for i, item := range items {
+		mark := "[ ] "
+		if item.Done {
+			mark = "[x] "
+		}
+		lines[i] = mark + item.Text
+	}
+	return strings.Join(lines, "\n")
+}
+
+func parseChecklist(s string) []ExportChecklistItem {
+	var items []ExportChecklistItem
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		item := ExportChecklistItem{Text: line}
+		switch {
+		case strings.HasPrefix(line, "[x] "), strings.HasPrefix(line, "[X] "):
+			item = ExportChecklistItem{Text: strings.TrimSpace(line[4:]), Done: true}
+		case strings.HasPrefix(line, "[ ] "):
+			item.Text = strings.TrimSpace(line[4:])
+		}
+		if item.Text != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func projectNames(ctx context.Context, q querier) (map[int64]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT id, name FROM projects")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+func toExportTask(task DBTask, projects map[int64]string) ExportTask {
+	jt := toJSONTask(task)
+	return ExportTask{
+		ID:           jt.ID,
+		Date:         jt.Date,
+		Title:        jt.Title,
+		Comment:      jt.Comment,
+		Repeat:       jt.Repeat,
+		Project:      projects[task.ProjectID],
+		Priority:     jt.Priority,
+		RemindBefore: jt.RemindBefore,
+		CreatedAt:    jt.CreatedAt,
+		UpdatedAt:    jt.UpdatedAt,
+	}
+}
+
+// exportPage reads up to exportPageSize tasks with ids above after, together
+// with their checklists.
+func exportPage(ctx context.Context, q querier, after int, projects map[int64]string) ([]ExportTask, int, error) {
+	rows, err := q.QueryContext(ctx, selectTask+" WHERE s.id > ? ORDER BY s.id LIMIT ?", after, exportPageSize)
+	if err != nil {
+		return nil, after, err
+	}
+	defer rows.Close()
+
+	var (
+		page  []ExportTask
+		index = make(map[int]int)
+	)
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, after, err
+		}
+		index[task.ID] = len(page)
+		page = append(page, toExportTask(task, projects))
+		after = task.ID
+	}
+	if err := rows.Err(); err != nil || len(page) == 0 {
+		return page, after, err
+	}
+	rows.Close()
+
+	first, _ := strconv.Atoi(page[0].ID)
+	items, err := q.QueryContext(ctx,
+		"SELECT task_id, text, done FROM checklist_items WHERE task_id BETWEEN ? AND ? ORDER BY task_id, position, id",
+		first, after)
+	if err != nil {
+		return nil, after, err
+	}
+	defer items.Close()
+	for items.Next() {
+		var (
+			taskID int
+			item   ExportChecklistItem
+		)
+		if err := items.Scan(&taskID, &item.Text, &item.Done); err != nil {
+			return nil, after, err
+		}
+		if i, ok := index[taskID]; ok {
+			page[i].Checklist = append(page[i].Checklist, item)
+		}
+	}
+	return page, after, items.Err()
+}
+
+// ExportHandler streams all tasks as JSON, CSV or todo.txt, selected by the
+// format parameter. Tasks are read page by page, so the export is not a
+// snapshot if tasks change while it runs.
+func ExportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		name := r.URL.Query().Get("format")
+		if name == "" {
+			name = "json"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			respondWithError(w, http.StatusBadRequest, "format must be json, csv or todotxt")
+			return
+		}
+
+		projects, err := projectNames(r.Context(), db)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="tasks-`+time.Now().Format("20060102")+"."+format.extension+`"`)
+		enc := format.encoder(w)
+		if err := enc.begin(); err != nil {
+			return
+		}
+		// Once streaming has started the status can't change, so errors are
+		// only logged and the output is left truncated.
+		for after := 0; ; {
+			page, last, err := exportPage(r.Context(), db, after, projects)
+			if err != nil {
+				log.Printf("Export: %v", err)
+				return
+			}
+			for _, task := range page {
+				if err := enc.task(task); err != nil {
+					return
+				}
+			}
+			if len(page) < exportPageSize {
+				break
+			}
+			after = last
+		}
+		if err := enc.end(); err != nil {
+			log.Printf("Export: %v", err)
+		}
+	}
+}
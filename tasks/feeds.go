@@ -0,0 +1,274 @@
+package tasks
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/ical"
+	"main.go/parsedate"
+)
+
+const (
+	// Repetitions that RRULE can't express are listed one by one within
+	// this window around today.
+	feedPastDays   = 30
+	feedFutureDays = 366
+)
+
+type CalendarFeedRequest struct {
+	Name string `json:"name"`
+	// Component is VEVENT (the default) or VTODO.
+	Component string `json:"component"`
+	// ProjectID limits the feed to a project; empty means all tasks.
+	ProjectID string `json:"project_id"`
+}
+
+type CalendarFeed struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Component string `json:"component"`
+	ProjectID string `json:"project_id,omitempty"`
+	Token     string `json:"token"`
+	// URL is the path to subscribe to, relative to the server.
+	URL string `json:"url"`
+}
+
+// newToken returns a random secret, such as a feed or undo token.
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func scanFeed(row scanner) (CalendarFeed, error) {
+	var (
+		feed          CalendarFeed
+		id, projectID int64
+	)
+	err := row.Scan(&id, &feed.Name, &feed.Component, &projectID, &feed.Token)
+	feed.ID = strconv.FormatInt(id, 10)
+	if projectID != 0 {
+		feed.ProjectID = strconv.FormatInt(projectID, 10)
+	}
+	feed.URL = "/api/calendar.ics?token=" + url.QueryEscape(feed.Token)
+	return feed, err
+}
+
+// CalendarFeedsHandler manages .ics subscriptions: GET lists them, POST
+// creates one with a new secret token and DELETE ?id= revokes one. It hands
+// out the tokens, so it has to be behind the login.
+func CalendarFeedsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			listFeeds(db, w, r)
+		case http.MethodPost:
+			addFeed(db, w, r)
+		case http.MethodDelete:
+			deleteFeed(db, w, r)
+		default:
+			respondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	}
+}
+
+func listFeeds(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT id, name, component, project_id, token FROM calendar_feeds ORDER BY id")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	defer rows.Close()
+
+	feeds := make([]CalendarFeed, 0)
+	for rows.Next() {
+		feed, err := scanFeed(rows)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		feeds = append(feeds, feed)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Feeds []CalendarFeed `json:"feeds"`
+	}{Feeds: feeds})
+}
+
+func addFeed(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var req CalendarFeedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Wrong request format")
+		return
+	}
+	req.Component = strings.ToUpper(req.Component)
+	if req.Component == "" {
+		req.Component = "VEVENT"
+	}
+	if req.Component != "VEVENT" && req.Component != "VTODO" {
+		respondWithError(w, http.StatusBadRequest, "component must be VEVENT or VTODO")
+		return
+	}
+	projectID, err := parseProjectID(req.ProjectID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkProject(r.Context(), db, projectID); err != nil {
+		respondWithProjectError(w, err)
+		return
+	}
+	token, err := newToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	feed, err := scanFeed(db.QueryRowContext(r.Context(),
+		`INSERT INTO calendar_feeds (token, name, component, project_id, created_at)
+		VALUES (?, ?, ?, ?, unixepoch()) RETURNING id, name, component, project_id, token`,
+		token, strings.TrimSpace(req.Name), req.Component, projectID))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(feed)
+}
+
+func deleteFeed(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		respondWithError(w, http.StatusBadRequest, "Missed id")
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM calendar_feeds WHERE id = ?", id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusNotFound, "Feed not found")
+		return
+	}
+	json.NewEncoder(w).Encode(struct{}{})
+}
+
+// CalendarICSHandler serves /api/calendar.ics?token=... as an iCalendar
+// feed. Each task is one VEVENT or VTODO with its repeat rule as RRULE;
+// rules RRULE can't express are listed as separate entries from
+// feedPastDays ago to feedFutureDays ahead.
+func CalendarICSHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method denied", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "Missed token", http.StatusUnauthorized)
+			return
+		}
+		var (
+			name, kind string
+			projectID  int64
+		)
+		err := db.QueryRowContext(r.Context(),
+			"SELECT name, component, project_id FROM calendar_feeds WHERE token = ?", token).
+			Scan(&name, &kind, &projectID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		projects, err := projectNames(r.Context(), db)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		query := selectTask
+		var args []any
+		if projectID != 0 {
+			query += " WHERE COALESCE(m.project_id, 0) = ?"
+			args = append(args, projectID)
+		}
+		rows, err := db.QueryContext(r.Context(), query+" ORDER BY s.id", args...)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		var tasks []DBTask
+		for rows.Next() {
+			task, err := scanTask(rows)
+			if err != nil {
+				rows.Close()
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			tasks = append(tasks, task)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		now := today()
+		from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -feedPastDays)
+		to := from.AddDate(0, 0, feedPastDays+feedFutureDays)
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		if r.Method == http.MethodHead {
+			return
+		}
+		enc := ical.NewEncoder(w)
+		enc.Begin("VCALENDAR")
+		enc.Property(ical.Property{Name: "VERSION", Value: "2.0"})
+		enc.Property(ical.Property{Name: "PRODID", Value: "-//" + icsDomain + "//tasks//EN"})
+		enc.Property(ical.Property{Name: "CALSCALE", Value: "GREGORIAN"})
+		if name != "" {
+			enc.Property(ical.Property{Name: "X-WR-CALNAME", Value: ical.Escape(name)})
+		}
+
+		entries := 0
+		for _, task := range tasks {
+			project := projects[task.ProjectID]
+			if rrule, ok := repeatRule(task.Date, task.Repeat); ok || task.Repeat == "" {
+				enc.Encode(taskComponent(kind, task, project, task.Date, rrule, taskUID(task.ID, "")))
+				continue
+			}
+			dates, err := parsedate.Occurrences(task.Date, task.Repeat, from, to, maxCalendarEntries-entries)
+			if err != nil {
+				log.Printf("Task %d: %v", task.ID, err)
+				dates = []string{task.Date}
+			}
+			for _, date := range dates {
+				enc.Encode(taskComponent(kind, task, project, date, "", taskUID(task.ID, date)))
+			}
+			entries += len(dates)
+		}
+		enc.End("VCALENDAR")
+		if err := enc.Flush(); err != nil {
+			log.Printf("Calendar feed: %v", err)
+		}
+	}
+}
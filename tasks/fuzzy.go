@@ -0,0 +1,164 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	defFuzzyThreshold = 0.3
+	// maxFuzzyCandidates bounds the rows fetched from the trigram index for
+	// scoring.
+	maxFuzzyCandidates = 500
+)
+
+// fuzzyThreshold is the minimal similarity of a fuzzy match, configured by
+// TODO_FUZZY_THRESHOLD.
+func fuzzyThreshold() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("TODO_FUZZY_THRESHOLD"), 64); err == nil && v > 0 && v <= 1 {
+		return v
+	}
+	return defFuzzyThreshold
+}
+
+func splitWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// trigrams returns the trigrams of a lower-cased word padded the way
+// pg_trgm does it, so that the beginning of a word weighs more than its end.
+func trigrams(word string) map[string]bool {
+	runes := []rune("  " + word + " ")
+	grams := make(map[string]bool, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		grams[string(runes[i:i+3])] = true
+	}
+	return grams
+}
+
+// similarity is the share of trigrams two words have in common, from 0 to 1.
+func similarity(a, b string) float64 {
+	ga, gb := trigrams(a), trigrams(b)
+	common := 0
+	for g := range ga {
+		if gb[g] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(ga)+len(gb)-common)
+}
+
+// fuzzyScores finds tasks whose title or comment resembles every search word
+// and returns their similarity. Candidates are the rows sharing at least one
+// trigram with the words in the scheduler_trigram index; each word is scored
+// against its closest word in the task and the scores are averaged.
+func fuzzyScores(ctx context.Context, q querier, words []string) (map[int]float64, error) {
+	var (
+		queryWords []string
+		grams      []string
+	)
+	seen := map[string]bool{}
+	for _, w := range words {
+		for _, word := range splitWords(w) {
+			runes := []rune(word)
+			if len(runes) < 3 {
+				continue
+			}
+			queryWords = append(queryWords, word)
+			for i := 0; i+3 <= len(runes); i++ {
+				g := string(runes[i : i+3])
+				if !seen[g] {
+					seen[g] = true
+					grams = append(grams, `"`+strings.ReplaceAll(g, `"`, `""`)+`"`)
+				}
+			}
+		}
+	}
+	if len(grams) == 0 {
+		return nil, nil
+	}
+
+	rows, err := q.QueryContext(ctx,
+		`SELECT rowid, title, COALESCE(comment, '') FROM scheduler_trigram
+		WHERE scheduler_trigram MATCH ? ORDER BY rank LIMIT ?`,
+		strings.Join(grams, " OR "), maxFuzzyCandidates)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	threshold := fuzzyThreshold()
+	scores := map[int]float64{}
+	for rows.Next() {
+		var (
+			id             int
+			title, comment string
+		)
+		if err := rows.Scan(&id, &title, &comment); err != nil {
+			return nil, err
+		}
+		taskWords := splitWords(title + " " + comment)
+		total := 0.0
+		for _, qw := range queryWords {
+			best := 0.0
+			for _, tw := range taskWords {
+				if s := similarity(qw, tw); s > best {
+					best = s
+				}
+			}
+			total += best
+		}
+		if score := total / float64(len(queryWords)); score >= threshold {
+			scores[id] = score
+		}
+	}
+	return scores, rows.Err()
+}
+
+// fuzzySearchTasks runs a /api/tasks listing with the search words matched by
+// similarity instead of exactly. The other filters still apply. Results are
+// ordered from the closest match.
+func fuzzySearchTasks(ctx context.Context, db *sql.DB, params url.Values, limit int) ([]DBTask, error) {
+	filter, err := buildTaskFilter(params, true)
+	if err != nil || len(filter.words) == 0 {
+		return nil, err
+	}
+	scores, err := fuzzyScores(ctx, db, filter.words)
+	if err != nil || len(scores) == 0 {
+		return nil, err
+	}
+
+	ids := make([]any, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	filter.add("s.id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", ids...)
+
+	tasks, err := queryTasks(ctx, db,
+		"SELECT "+taskColumns+", "+filter.rankColumns()+filter.from()+filter.where(), filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		si, sj := scores[tasks[i].ID], scores[tasks[j].ID]
+		if si != sj {
+			return si > sj
+		}
+		if tasks[i].Date != tasks[j].Date {
+			return tasks[i].Date < tasks[j].Date
+		}
+		return tasks[i].ID < tasks[j].ID
+	})
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	return tasks, nil
+}
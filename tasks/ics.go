@@ -0,0 +1,153 @@
+package tasks
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/ical"
+	"main.go/parsedate"
+)
+
+// icsDomain makes task UIDs globally unique, as RFC 5545 asks.
+const icsDomain = "todo-scheduler"
+
+// taskUID is the stable UID of a task. Expanded repetitions add their date.
+func taskUID(id int, date string) string {
+	uid := "task-" + strconv.Itoa(id)
+	if date != "" {
+		uid += "-" + date
+	}
+	return uid + "@" + icsDomain
+}
+
+// icalPriority maps priorities 1..3 onto the iCalendar scale, where 1 is the
+// highest and 9 the lowest.
+var icalPriority = map[int]string{1: "9", 2: "5", 3: "1"}
+
+// taskComponent converts a task into a VEVENT or VTODO on the given date.
+// rrule is added as is when not empty.
+func taskComponent(kind string, task DBTask, project, date, rrule, uid string) *ical.Component {
+	c := ical.NewComponent(kind)
+	c.Add("UID", uid)
+	stamp := time.Unix(task.UpdatedAt, 0)
+	if task.UpdatedAt == 0 {
+		stamp = time.Now()
+	}
+	c.AddTime("DTSTAMP", stamp)
+	if task.CreatedAt != 0 {
+		c.AddTime("CREATED", time.Unix(task.CreatedAt, 0))
+	}
+	if task.UpdatedAt != 0 {
+		c.AddTime("LAST-MODIFIED", stamp)
+	}
+	c.Add("SEQUENCE", strconv.FormatInt(task.Version-1, 10))
+
+	// A VTODO is due on the date; DTSTART is only needed for RRULE.
+	day, _ := time.Parse("20060102", date)
+	if kind == "VEVENT" {
+		c.AddDate("DTSTART", day)
+		c.AddDate("DTEND", day.AddDate(0, 0, 1))
+	} else {
+		if rrule != "" {
+			c.AddDate("DTSTART", day)
+		}
+		c.AddDate("DUE", day)
+		c.Add("STATUS", "NEEDS-ACTION")
+	}
+	if rrule != "" {
+		c.Add("RRULE", rrule)
+	}
+
+	c.AddText("SUMMARY", task.Title)
+	if task.Comment != "" {
+		c.AddText("DESCRIPTION", task.Comment)
+	}
+	if p, ok := icalPriority[task.Priority]; ok {
+		c.Add("PRIORITY", p)
+	}
+	if project != "" {
+		c.AddText("CATEGORIES", project)
+	}
+	return c
+}
+
+// repeatRule translates a repeat rule into an RRULE for a task on date. ok is
+// false if RRULE can't describe the same dates: iCalendar counts the start
+// as the first repetition, so the date has to match the rule itself, and a
+// yearly task on February 29 moves to March 1 with NextDate.
+func repeatRule(date, repeat string) (rrule string, ok bool) {
+	day, err := time.Parse("20060102", date)
+	if err != nil || repeat == "" {
+		return "", false
+	}
+	// NextDate is the reference for what a rule means.
+	if _, err := parsedate.NextDate(day, date, repeat); err != nil {
+		return "", false
+	}
+
+	parts := strings.Fields(repeat)
+	switch parts[0] {
+	case "d":
+		if parts[1] == "1" {
+			return "FREQ=DAILY", true
+		}
+		return "FREQ=DAILY;INTERVAL=" + parts[1], true
+	case "y":
+		if day.Month() == time.February && day.Day() == 29 {
+			return "", false
+		}
+		return "FREQ=YEARLY", true
+	case "w":
+		var days []string
+		matches := false
+		for _, s := range strings.Split(parts[1], ",") {
+			n, _ := strconv.Atoi(strings.TrimSpace(s))
+			// The same numbering as parsedate uses.
+			weekday := time.Weekday(n - 1)
+			matches = matches || weekday == day.Weekday()
+			days = append(days, icalWeekdays[weekday])
+		}
+		if !matches {
+			return "", false
+		}
+		return "FREQ=WEEKLY;BYDAY=" + strings.Join(days, ","), true
+	case "m":
+		matches := false
+		last := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+		for _, s := range strings.Split(parts[1], ",") {
+			n, _ := strconv.Atoi(s)
+			matches = matches || n == day.Day() || (n < 0 && last+1+n == day.Day())
+		}
+		rrule = "FREQ=MONTHLY;BYMONTHDAY=" + trimZeros(parts[1])
+		if len(parts) > 2 {
+			months := strings.Split(parts[2], ",")
+			matches = matches && slices.ContainsFunc(months, func(s string) bool {
+				n, _ := strconv.Atoi(s)
+				return time.Month(n) == day.Month()
+			})
+			rrule += ";BYMONTH=" + trimZeros(parts[2])
+		}
+		if !matches {
+			return "", false
+		}
+		return rrule, true
+	}
+	return "", false
+}
+
+var icalWeekdays = map[time.Weekday]string{
+	time.Sunday: "SU", time.Monday: "MO", time.Tuesday: "TU", time.Wednesday: "WE",
+	time.Thursday: "TH", time.Friday: "FR", time.Saturday: "SA",
+}
+
+// trimZeros normalizes a list such as "07,19" to "7,19".
+func trimZeros(list string) string {
+	items := strings.Split(list, ",")
+	for i, s := range items {
+		n, _ := strconv.Atoi(s)
+		items[i] = strconv.Itoa(n)
+	}
+	return strings.Join(items, ",")
+}
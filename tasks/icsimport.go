@@ -0,0 +1,259 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/ical"
+)
+
+// ownUID matches the UIDs of the .ics feed, so exported tasks are updated
+// rather than duplicated when imported back with mode=merge.
+var ownUID = regexp.MustCompile(`^task-(\d+)@` + regexp.QuoteMeta(icsDomain) + `$`)
+
+// categorySeparator finds the first comma not escaped with a backslash.
+var categorySeparator = regexp.MustCompile(`(^|[^\\]),`)
+
+// decodeICSImport reads VTODO and VEVENT components of one or more calendars.
+// Rows are numbered by the line of BEGIN.
+func decodeICSImport(r io.Reader) ([]importRow, error) {
+	calendars, err := ical.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid iCalendar: %v", err)
+	}
+	var rows []importRow
+	for _, cal := range calendars {
+		if cal.Name != "VCALENDAR" {
+			return nil, errors.New("Invalid iCalendar: expected VCALENDAR")
+		}
+		for _, c := range cal.Components {
+			if c.Name != "VTODO" && c.Name != "VEVENT" {
+				continue
+			}
+			rows = append(rows, icsRow(c))
+		}
+	}
+	return rows, nil
+}
+
+func icsRow(c *ical.Component) importRow {
+	row := importRow{Row: c.Line}
+	switch status := strings.ToUpper(c.Value("STATUS")); {
+	case status == "COMPLETED" || status == "CANCELLED":
+		row.Skip = true
+		row.Warnings = append(row.Warnings, "Skipped, status is "+status)
+		return row
+	case c.Get("RECURRENCE-ID") != nil:
+		row.Skip = true
+		row.Warnings = append(row.Warnings, "Skipped, changes of single repetitions are not supported")
+		return row
+	}
+
+	t := ExportTask{Title: unescapeValue(c, "SUMMARY"), Comment: unescapeValue(c, "DESCRIPTION")}
+	if m := ownUID.FindStringSubmatch(c.Value("UID")); m != nil {
+		t.ID = m[1]
+	}
+
+	// A VTODO is due on DUE, an event happens on DTSTART.
+	dateProp := c.Get("DTSTART")
+	if due := c.Get("DUE"); c.Name == "VTODO" && due != nil {
+		dateProp = due
+	}
+	var start time.Time
+	if dateProp != nil {
+		date, err := icsDate(dateProp)
+		if err != nil {
+			row.Warnings = append(row.Warnings, err.Error()+", the date is left empty")
+		} else {
+			t.Date = date
+			start, _ = time.Parse("20060102", date)
+		}
+	}
+	if rrule := c.Value("RRULE"); rrule != "" {
+		if start.IsZero() {
+			start = today()
+		}
+		repeat, warnings := rruleToRepeat(rrule, start)
+		t.Repeat = repeat
+		row.Warnings = append(row.Warnings, warnings...)
+	}
+
+	if p, err := strconv.Atoi(c.Value("PRIORITY")); err == nil {
+		switch {
+		case p >= 1 && p <= 4:
+			t.Priority = "3"
+		case p == 5:
+			t.Priority = "2"
+		case p >= 6 && p <= 9:
+			t.Priority = "1"
+		}
+	}
+	if categories := c.Value("CATEGORIES"); categories != "" {
+		// Only the first category becomes the project.
+		if first := categorySeparator.FindStringIndex(categories); first != nil {
+			categories = categories[:first[1]-1]
+		}
+		t.Project = ical.Unescape(categories)
+	}
+	row.Task = t
+	return row
+}
+
+func unescapeValue(c *ical.Component, name string) string {
+	if p := c.Get(name); p != nil {
+		return p.Text()
+	}
+	return ""
+}
+
+// icsDate returns the task date of a DATE or DATE-TIME value. UTC times are
+// converted to the server's time zone; local and TZID times keep their date.
+func icsDate(p *ical.Property) (string, error) {
+	v := p.Value
+	if strings.HasSuffix(v, "Z") {
+		t, err := time.Parse(ical.DateTimeFormat, v)
+		if err != nil {
+			return "", fmt.Errorf("Bad %s %q", p.Name, v)
+		}
+		return t.Local().Format("20060102"), nil
+	}
+	if len(v) < 8 {
+		return "", fmt.Errorf("Bad %s %q", p.Name, v)
+	}
+	if _, err := time.Parse("20060102", v[:8]); err != nil {
+		return "", fmt.Errorf("Bad %s %q", p.Name, v)
+	}
+	return v[:8], nil
+}
+
+// rruleToRepeat translates an RRULE into the closest repeat rule for a task
+// starting on start. Parts that the repeat grammar can't express are dropped
+// and reported in warnings; an empty repeat means the task is imported as a
+// one-off.
+func rruleToRepeat(rrule string, start time.Time) (string, []string) {
+	parts := make(map[string]string)
+	for _, part := range strings.Split(strings.ToUpper(rrule), ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			parts[k] = v
+		}
+	}
+
+	var warnings []string
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	interval := 1
+	if v, ok := parts["INTERVAL"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			warn("RRULE %s: bad INTERVAL, the task does not repeat", rrule)
+			return "", warnings
+		}
+		interval = n
+	}
+	if _, ok := parts["COUNT"]; ok {
+		warn("RRULE %s: COUNT is ignored, the task repeats without end", rrule)
+	}
+	if _, ok := parts["UNTIL"]; ok {
+		warn("RRULE %s: UNTIL is ignored, the task repeats without end", rrule)
+	}
+	for _, key := range []string{"BYSETPOS", "BYWEEKNO", "BYYEARDAY", "BYHOUR", "BYMINUTE", "BYSECOND"} {
+		if _, ok := parts[key]; ok {
+			warn("RRULE %s: %s is ignored", rrule, key)
+		}
+	}
+
+	switch parts["FREQ"] {
+	case "DAILY":
+		if interval > 400 {
+			warn("RRULE %s: intervals over 400 days are not supported, the task does not repeat", rrule)
+			return "", warnings
+		}
+		return "d " + strconv.Itoa(interval), warnings
+
+	case "WEEKLY":
+		days, ok := weekdays(parts["BYDAY"])
+		if !ok {
+			warn("RRULE %s: bad BYDAY, the start day is used", rrule)
+		}
+		if len(days) == 0 {
+			days = []time.Weekday{start.Weekday()}
+		}
+		if interval > 1 {
+			if len(days) == 1 && interval*7 <= 400 {
+				return "d " + strconv.Itoa(interval*7), warnings
+			}
+			warn("RRULE %s: every %d weeks on several days is imported as every week", rrule, interval)
+		}
+		nums := make([]string, len(days))
+		for i, day := range days {
+			// The same numbering as parsedate uses.
+			nums[i] = strconv.Itoa(int(day) + 1)
+		}
+		return "w " + strings.Join(nums, ","), warnings
+
+	case "MONTHLY", "YEARLY":
+		if interval > 1 {
+			warn("RRULE %s: INTERVAL=%d is ignored", rrule, interval)
+		}
+		if _, ok := parts["BYDAY"]; ok {
+			warn("RRULE %s: weekdays in a month are not supported, the start day of the month is used", rrule)
+		}
+		days := monthDays(parts["BYMONTHDAY"])
+		if given := parts["BYMONTHDAY"]; given != "" && len(days) < len(strings.Split(given, ",")) {
+			warn("RRULE %s: only days 1..31, -1 and -2 are supported, other days are dropped", rrule)
+		}
+		months := parts["BYMONTH"]
+		if parts["FREQ"] == "YEARLY" && len(days) == 0 && months == "" {
+			return "y", warnings
+		}
+		if len(days) == 0 {
+			days = []string{strconv.Itoa(start.Day())}
+		}
+		if parts["FREQ"] == "YEARLY" && months == "" {
+			months = strconv.Itoa(int(start.Month()))
+		}
+		repeat := "m " + strings.Join(days, ",")
+		if months != "" {
+			repeat += " " + months
+		}
+		return repeat, warnings
+	}
+	warn("RRULE %s: frequency %q is not supported, the task does not repeat", rrule, parts["FREQ"])
+	return "", warnings
+}
+
+func weekdays(byday string) ([]time.Weekday, bool) {
+	if byday == "" {
+		return nil, true
+	}
+	var days []time.Weekday
+next:
+	for _, s := range strings.Split(byday, ",") {
+		for day, code := range icalWeekdays {
+			if code == s {
+				days = append(days, day)
+				continue next
+			}
+		}
+		return nil, false
+	}
+	return days, true
+}
+
+// monthDays keeps the BYMONTHDAY values the repeat grammar supports.
+func monthDays(bymonthday string) []string {
+	var days []string
+	for _, s := range strings.Split(bymonthday, ",") {
+		n, err := strconv.Atoi(s)
+		if err == nil && (n >= 1 && n <= 31 || n == -1 || n == -2) {
+			days = append(days, strconv.Itoa(n))
+		}
+	}
+	return days
+}
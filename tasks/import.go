@@ -0,0 +1,408 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportSize limits the body of /api/import.
+const maxImportSize = 32 << 20
+
+// importDecoders parse a request body into tasks. Each task keeps the line or
+// element number it came from for error reports.
+var importDecoders = map[string]func(io.Reader) ([]importRow, error){
+	"json":    decodeJSONImport,
+	"csv":     decodeCSVImport,
+	"ics":     decodeICSImport,
+	"todotxt": decodeTodoTxtImport,
+}
+
+type importRow struct {
+	Row  int
+	Task ExportTask
+	// Warnings tell what could not be imported exactly; Skip leaves the row
+	// out entirely.
+	Warnings []string
+	Skip     bool
+}
+
+type ImportError struct {
+	Row   int    `json:"row"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+type ImportResponse struct {
+	DryRun  bool          `json:"dry_run"`
+	Applied bool          `json:"applied"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Deleted int           `json:"deleted"`
+	Skipped int           `json:"skipped,omitempty"`
+	Errors  []ImportError `json:"errors"`
+	// Warnings use the error format for rows imported with changes.
+	Warnings []ImportError `json:"warnings,omitempty"`
+}
+
+// decodeJSONImport reads the export format, {"tasks": [...]}, or a bare array
+// of tasks. Rows are numbered from 1.
+func decodeJSONImport(r io.Reader) ([]importRow, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, errors.New("Invalid JSON")
+	}
+	var list []ExportTask
+	if err := json.Unmarshal(raw, &list); err != nil {
+		var doc struct {
+			Tasks []ExportTask `json:"tasks"`
+		}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, errors.New("Expected a list of tasks")
+		}
+		list = doc.Tasks
+	}
+	rows := make([]importRow, len(list))
+	for i, task := range list {
+		rows[i] = importRow{Row: i + 1, Task: task}
+	}
+	return rows, nil
+}
+
+// decodeCSVImport reads CSV with a header line naming the columns, a subset
+// of csvColumns in any order. Rows are numbered by line, the header being 1.
+func decodeCSVImport(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.New("Missed CSV header")
+	}
+	known := make(map[string]bool, len(csvColumns))
+	for _, column := range csvColumns {
+		known[column] = true
+	}
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		if !known[column] {
+			return nil, fmt.Errorf("Unknown CSV column %q", column)
+		}
+		header[i] = column
+	}
+
+	var rows []importRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV: %v", err)
+		}
+		line, _ := cr.FieldPos(0)
+		values := make(map[string]string, len(header))
+		for i, column := range header {
+			values[column] = record[i]
+		}
+		rows = append(rows, importRow{Row: line, Task: ExportTask{
+			ID:           values["id"],
+			Date:         values["date"],
+			Title:        values["title"],
+			Comment:      values["comment"],
+			Repeat:       values["repeat"],
+			Project:      values["project"],
+			Priority:     values["priority"],
+			RemindBefore: values["remind_before"],
+			CreatedAt:    values["created_at"],
+			UpdatedAt:    values["updated_at"],
+			Checklist:    parseChecklist(values["checklist"]),
+		}})
+	}
+}
+
+// importer applies imported tasks inside a transaction.
+type importer struct {
+	ctx     context.Context
+	q       querier
+	now     time.Time
+	replace bool
+	// keepDetails is set for formats without comments and checklists, so
+	// updated tasks keep theirs.
+	keepDetails bool
+}
+
+// projectID finds a project by name, ignoring case, and creates it if it
+// does not exist. Nothing is cached, since a failed row rolls back the
+// projects it created.
+func (im *importer) projectID(name string) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, nil
+	}
+	var id int64
+	err := im.q.QueryRowContext(im.ctx,
+		"SELECT id FROM projects WHERE name = ? COLLATE NOCASE ORDER BY id LIMIT 1", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = im.q.QueryRowContext(im.ctx,
+			`INSERT INTO projects (name, color, archived, sort_order)
+			VALUES (?, '', 0, (SELECT COALESCE(MAX(sort_order), 0) + 1 FROM projects)) RETURNING id`,
+			name).Scan(&id)
+	}
+	return id, err
+}
+
+// apply stores one task and tells whether it was created. In merge mode a
+// task whose id exists is updated and others are created with new ids; in
+// replace mode the table is empty and ids are kept.
+func (im *importer) apply(t ExportTask) (created bool, err error) {
+	projectID, err := im.projectID(t.Project)
+	if err != nil {
+		return false, err
+	}
+	req := TaskRequest{
+		Date:         t.Date,
+		Title:        strings.TrimSpace(t.Title),
+		Comment:      t.Comment,
+		Repeat:       t.Repeat,
+		ProjectID:    strconv.FormatInt(projectID, 10),
+		Priority:     t.Priority,
+		RemindBefore: t.RemindBefore,
+	}
+	if req.Priority == "" {
+		req.Priority = "0"
+	}
+
+	var id int64
+	if t.ID != "" {
+		id, err = strconv.ParseInt(t.ID, 10, 64)
+		if err != nil || id < 1 {
+			return false, requestError{errors.New("Invalid id")}
+		}
+	}
+	if id != 0 {
+		exists, err := taskExists(im.ctx, im.q, t.ID)
+		if err != nil {
+			return false, err
+		}
+		if exists && im.replace {
+			return false, requestError{errors.New("Duplicate id")}
+		}
+		if exists {
+			req.ID = t.ID
+			if im.keepDetails {
+				task, err := getTask(im.ctx, im.q, t.ID)
+				if err != nil {
+					return false, err
+				}
+				req.Comment = task.Comment
+			}
+			if err := updateTask(im.ctx, im.q, &req, im.now); err != nil {
+				return false, err
+			}
+			if im.keepDetails {
+				return false, nil
+			}
+			return false, im.checklist(id, t.Checklist)
+		}
+		if !im.replace {
+			id = 0
+		}
+	}
+
+	id, err = insertTask(im.ctx, im.q, id, &req, im.now)
+	if err != nil {
+		return false, err
+	}
+	if t.CreatedAt != "" {
+		createdAt, err := time.Parse(time.RFC3339, t.CreatedAt)
+		if err != nil {
+			return false, requestError{errors.New("Invalid created_at")}
+		}
+		if _, err := im.q.ExecContext(im.ctx,
+			"UPDATE task_meta SET created_at = ? WHERE task_id = ?", createdAt.Unix(), id); err != nil {
+			return false, err
+		}
+	}
+	return true, im.checklist(id, t.Checklist)
+}
+
+// changes returns a patch of the fields of t that differ from the current
+// task. An empty date, project or remind_before leaves that field as it is.
+func (im *importer) changes(current JSONTask, t ExportTask) (taskPatch, error) {
+	patch := taskPatch{}
+	set := func(field, value, old string) {
+		if value != old {
+			patch[field], _ = json.Marshal(value)
+		}
+	}
+	set("title", strings.TrimSpace(t.Title), current.Title)
+	set("comment", t.Comment, current.Comment)
+	set("repeat", t.Repeat, current.Repeat)
+	if t.Date != "" {
+		set("date", t.Date, current.Date)
+	}
+	set("priority", t.Priority, current.Priority)
+	if t.RemindBefore != "" {
+		old := current.RemindBefore
+		if old == "" {
+			old = "0"
+		}
+		set("remind_before", t.RemindBefore, old)
+	}
+	if t.Project != "" {
+		projectID, err := im.projectID(t.Project)
+		if err != nil {
+			return nil, err
+		}
+		set("project_id", strconv.FormatInt(projectID, 10), current.ProjectID)
+	}
+	return patch, nil
+}
+
+// checklist replaces the checklist of a task with the imported items.
+func (im *importer) checklist(taskID int64, items []ExportChecklistItem) error {
+	if _, err := im.q.ExecContext(im.ctx, "DELETE FROM checklist_items WHERE task_id = ?", taskID); err != nil {
+		return err
+	}
+	for i, item := range items {
+		text := strings.TrimSpace(item.Text)
+		if text == "" {
+			return requestError{errors.New("Empty checklist item")}
+		}
+		if _, err := im.q.ExecContext(im.ctx,
+			"INSERT INTO checklist_items (task_id, text, done, position) VALUES (?, ?, ?, ?)",
+			taskID, text, item.Done, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportHandler serves POST /api/import?format=json|csv|ics|todotxt&mode=merge|replace.
+// Every row is validated like a task sent to /api/task, and the import is
+// applied only if all rows are valid. With dry_run=1 it is always rolled
+// back, which reports the errors and counts without changing anything.
+// mode=replace deletes all tasks first.
+func ImportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+
+		params := r.URL.Query()
+		format := params.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		decode, ok := importDecoders[format]
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, "Unknown format "+strconv.Quote(format))
+			return
+		}
+		mode := params.Get("mode")
+		if mode == "" {
+			mode = "merge"
+		}
+		if mode != "merge" && mode != "replace" {
+			respondWithError(w, http.StatusBadRequest, "mode must be merge or replace")
+			return
+		}
+		dryRun, _ := strconv.ParseBool(params.Get("dry_run"))
+
+		rows, err := decode(http.MaxBytesReader(w, r.Body, maxImportSize))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		resp := ImportResponse{DryRun: dryRun, Errors: []ImportError{}}
+		im := &importer{
+			ctx:         r.Context(),
+			q:           tx,
+			now:         time.Now().Local().Truncate(24 * time.Hour),
+			replace:     mode == "replace",
+			keepDetails: format == "todotxt",
+		}
+		if im.replace {
+			if err := recordDeletions(r.Context(), tx); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			res, err := tx.ExecContext(r.Context(), "DELETE FROM scheduler")
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			n, _ := res.RowsAffected()
+			resp.Deleted = int(n)
+		}
+
+		for _, row := range rows {
+			for _, warning := range row.Warnings {
+				resp.Warnings = append(resp.Warnings, ImportError{Row: row.Row, ID: row.Task.ID, Error: warning})
+			}
+			if row.Skip {
+				resp.Skipped++
+				continue
+			}
+			// Each row runs in a savepoint, so a failed row leaves nothing
+			// behind and the remaining rows are still checked.
+			if _, err := tx.ExecContext(r.Context(), "SAVEPOINT import_row"); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			created, err := im.apply(row.Task)
+			if err != nil {
+				if storeErrorStatus(err) == http.StatusInternalServerError {
+					log.Printf("Import row %d: %v", row.Row, err)
+					respondWithError(w, http.StatusInternalServerError, "Server error")
+					return
+				}
+				resp.Errors = append(resp.Errors, ImportError{Row: row.Row, ID: row.Task.ID, Error: err.Error()})
+				_, err = tx.ExecContext(r.Context(), "ROLLBACK TO import_row")
+			} else if created {
+				resp.Created++
+			} else {
+				resp.Updated++
+			}
+			if err == nil {
+				_, err = tx.ExecContext(r.Context(), "RELEASE import_row")
+			}
+			if err != nil {
+				log.Printf("Import savepoint: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+		}
+
+		status := http.StatusOK
+		if len(resp.Errors) > 0 {
+			status = http.StatusBadRequest
+		} else if !dryRun {
+			if err := tx.Commit(); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			resp.Applied = true
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,281 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"main.go/parsedate"
+)
+
+// taskPatch is a JSON Merge Patch (RFC 7396) of a task: fields left out stay
+// unchanged and null clears a field.
+type taskPatch map[string]json.RawMessage
+
+var patchFields = map[string]bool{
+	"id": true, "date": true, "title": true, "comment": true, "repeat": true,
+	"project_id": true, "priority": true, "version": true, "remind_before": true,
+}
+
+// text returns a string field of the patch. ok is false if the field is
+// missing; null gives an empty string. Numbers are accepted too, since ids
+// and priorities are numeric.
+func (p taskPatch) text(field string) (value string, ok bool, err error) {
+	raw, ok := p[field]
+	if !ok {
+		return "", false, nil
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", true, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", true, nil
+	case string:
+		return v, true, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true, nil
+	}
+	return "", true, requestError{fmt.Errorf("%s must be a string", field)}
+}
+
+func (p taskPatch) isNull(field string) bool {
+	return string(p[field]) == "null"
+}
+
+// patchTask applies a merge patch to the task id. Only the supplied fields are
+// validated, so a task with a date in the past keeps it unless the patch
+// changes the date or the repeat rule. The state before the patch is kept as
+// a revision.
+func patchTask(ctx context.Context, q querier, id string, patch taskPatch, version string, now time.Time) error {
+	for field := range patch {
+		if !patchFields[field] {
+			return requestError{fmt.Errorf("Unknown field %q", field)}
+		}
+	}
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	task, err := getTask(ctx, q, id)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{}
+	for field := range patch {
+		v, _, err := patch.text(field)
+		if err != nil {
+			return requestError{fmt.Errorf("Invalid %s", field)}
+		}
+		values[field] = v
+	}
+	if v, ok := values["id"]; ok && v != id {
+		return requestError{errors.New("id does not match the task")}
+	}
+
+	req := TaskRequest{
+		ID:      id,
+		Date:    task.Date,
+		Title:   task.Title,
+		Comment: task.Comment,
+		Repeat:  task.Repeat,
+	}
+	if title, ok := values["title"]; ok {
+		if title == "" {
+			return requestError{errors.New("Missed header")}
+		}
+		req.Title = title
+	}
+	if comment, ok := values["comment"]; ok {
+		req.Comment = comment
+	}
+	_, dateSet := values["date"]
+	_, repeatSet := values["repeat"]
+	if dateSet {
+		if patch.isNull("date") {
+			return requestError{errors.New("date can't be null")}
+		}
+		req.Date = values["date"]
+	}
+	if repeatSet {
+		req.Repeat = values["repeat"]
+	}
+	switch {
+	case dateSet:
+		date, err := ValidateAndProcessTaskRequest(&req, now)
+		if err != nil {
+			return requestError{err}
+		}
+		req.Date = date.Format("20060102")
+	case repeatSet && req.Repeat != "":
+		if _, err := parsedate.NextDate(now, req.Date, req.Repeat); err != nil {
+			return requestError{err}
+		}
+	}
+
+	// Fields set to their current values are left out below.
+	projectID, projectSet := values["project_id"]
+	if projectSet {
+		pid, err := parseProjectID(projectID)
+		if err != nil {
+			return requestError{err}
+		}
+		if err := checkProject(ctx, q, pid); err != nil {
+			return err
+		}
+		projectSet = pid != task.ProjectID
+	}
+	priority, prioritySet := values["priority"]
+	if prioritySet {
+		p, err := parsePriority(priority)
+		if err != nil {
+			return requestError{err}
+		}
+		prioritySet = p != task.Priority
+	}
+	remind, remindSet := values["remind_before"]
+	if remindSet {
+		days, err := parseRemindBefore(remind)
+		if err != nil {
+			return requestError{err}
+		}
+		remindSet = days != task.RemindBefore
+	}
+
+	taskID := int64(task.ID)
+	updated := req.Date != task.Date || req.Title != task.Title || req.Comment != task.Comment ||
+		req.Repeat != task.Repeat
+	// A patch that changes nothing leaves the version, events and revisions
+	// as they are, but is still checked against the version.
+	if !updated && !projectSet && !prioritySet && !remindSet {
+		if v, _ := strconv.ParseInt(version, 10, 64); version != "" && v != task.Version {
+			return errVersionConflict
+		}
+		return nil
+	}
+
+	// The version is checked by the first statement; later ones run in the
+	// same transaction.
+	updated = updated || version != ""
+	if updated {
+		res, err := q.ExecContext(ctx,
+			"UPDATE scheduler SET date = ?, title = ?, comment = ?, repeat = ? WHERE id = ?"+versionCond,
+			req.Date, req.Title, req.Comment, req.Repeat, id, version, version)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return missedTask(ctx, q, id)
+		}
+	}
+	if projectSet {
+		pid, _ := parseProjectID(projectID)
+		if err := setTaskProject(ctx, q, taskID, pid); err != nil {
+			return err
+		}
+	}
+	if prioritySet {
+		p, _ := parsePriority(priority)
+		if err := setTaskPriority(ctx, q, taskID, p); err != nil {
+			return err
+		}
+	}
+	if remindSet {
+		days, _ := parseRemindBefore(remind)
+		if err := setTaskRemindBefore(ctx, q, taskID, days); err != nil {
+			return err
+		}
+	}
+	// Updating the scheduler row has bumped the version already.
+	if !updated && (projectSet || prioritySet || remindSet) {
+		if err := touchTask(ctx, q, id); err != nil {
+			return err
+		}
+	}
+	if err := recordTaskEvent(ctx, q, EventUpdated, id); err != nil {
+		return err
+	}
+	return saveRevision(ctx, q, task)
+}
+
+// PatchTaskHandler serves PATCH /api/task?id=... with a JSON Merge Patch
+// body and responds with the updated task. The version to check can be given
+// with If-Match or in the version field, as for PUT.
+func PatchTaskHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var patch taskPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+			respondWithError(w, http.StatusBadRequest, "Body must be a JSON object")
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			id, _, _ = patch.text("id")
+		}
+		if id == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed id")
+			return
+		}
+
+		field, _, _ := patch.text("version")
+		delete(patch, "version")
+		version, conflict, err := expectedVersion(r, field)
+		if errors.Is(err, errVersionConflict) {
+			respondWithConflict(r.Context(), w, db, conflict, id)
+			return
+		}
+		if err != nil {
+			respondWithError(w, conflict, err.Error())
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := snapshotTask(r.Context(), tx, id, false)
+		if err != nil && !errors.Is(err, errTaskNotFound) {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		now := time.Now().Local().Truncate(24 * time.Hour)
+		if err := patchTask(r.Context(), tx, id, patch, version, now); err != nil {
+			if errors.Is(err, errVersionConflict) {
+				respondWithConflict(r.Context(), w, tx, conflict, id)
+				return
+			}
+			respondWithStoreError(w, err)
+			return
+		}
+		task, err := getTask(r.Context(), tx, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		// A patch that changed nothing has nothing to undo.
+		if task.Version != before.Version && !respondWithUndo(w, r, tx, "update", id, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		w.Header().Set("ETag", etag(task.Version))
+		json.NewEncoder(w).Encode(toJSONTask(task))
+	}
+}
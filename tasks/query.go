@@ -0,0 +1,211 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defListLimit = 50
+	maxListLimit = 500
+)
+
+// taskFilter collects the WHERE conditions of a task listing.
+type taskFilter struct {
+	conds []string
+	args  []any
+	// ranked is set when the listing is joined with the full-text index.
+	ranked bool
+	// words collects the search words left for fuzzy matching.
+	words []string
+}
+
+// buildTaskFilter turns the project_id, from, to, view and search parameters
+// of /api/tasks into a filter. With fuzzy set, search words are collected for
+// fuzzySearchTasks instead of being matched exactly.
+func buildTaskFilter(params url.Values, fuzzy bool) (taskFilter, error) {
+	var filter taskFilter
+
+	if project := params.Get("project_id"); project != "" {
+		projectID, err := parseProjectID(project)
+		if err != nil {
+			return filter, err
+		}
+		filter.add("COALESCE(m.project_id, 0) = ?", projectID)
+	}
+
+	if from := params.Get("from"); from != "" {
+		date, err := parseSearchDate("from", from)
+		if err != nil {
+			return filter, err
+		}
+		filter.add("s.date >= ?", date)
+	}
+	if to := params.Get("to"); to != "" {
+		date, err := parseSearchDate("to", to)
+		if err != nil {
+			return filter, err
+		}
+		filter.add("s.date <= ?", date)
+	}
+
+	if view := params.Get("view"); view != "" {
+		for _, v := range strings.Split(view, ",") {
+			cond, args, err := viewCondition(strings.TrimSpace(v), today())
+			if err != nil {
+				return filter, err
+			}
+			filter.add(cond, args...)
+		}
+	}
+
+	if search := params.Get("search"); search != "" {
+		if err := applySearch(&filter, search, fuzzy); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// today is the server's current date in its local time zone.
+func today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// viewCondition returns the condition of a named view of /api/tasks. Views
+// are evaluated against now; week is Monday to Sunday of the current week.
+func viewCondition(view string, now time.Time) (string, []any, error) {
+	day := now.Format("20060102")
+	switch view {
+	case "today":
+		return "s.date = ?", []any{day}, nil
+	case "overdue":
+		return "s.date < ?", []any{day}, nil
+	case "upcoming":
+		return "s.date > ?", []any{day}, nil
+	case "week":
+		monday := now.AddDate(0, 0, -(int(now.Weekday())+6)%7)
+		return "s.date BETWEEN ? AND ?", []any{monday.Format("20060102"), monday.AddDate(0, 0, 6).Format("20060102")}, nil
+	case "no-repeat":
+		return "COALESCE(s.repeat, '') = ''", nil, nil
+	case "repeating":
+		return "COALESCE(s.repeat, '') <> ''", nil, nil
+	}
+	return "", nil, errors.New("Unknown view: " + view)
+}
+
+func (f *taskFilter) add(cond string, args ...any) {
+	f.conds = append(f.conds, cond)
+	f.args = append(f.args, args...)
+}
+
+// match restricts the listing to tasks matching a full-text query and makes
+// the rank and snippet of the match available.
+func (f *taskFilter) match(query string) {
+	f.ranked = true
+	f.add("scheduler_fts MATCH ?", query)
+}
+
+func (f *taskFilter) from() string {
+	if f.ranked {
+		return taskFrom + " JOIN scheduler_fts ON scheduler_fts.rowid = s.id"
+	}
+	return taskFrom
+}
+
+// rankColumns selects the rank and snippet scanned by scanListedTask.
+func (f *taskFilter) rankColumns() string {
+	if f.ranked {
+		return "bm25(scheduler_fts), snippet(scheduler_fts, -1, '<mark>', '</mark>', '…', 12)"
+	}
+	return "0.0, ''"
+}
+
+func (f *taskFilter) where() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conds, " AND ")
+}
+
+// cursor is the opaque position handed out as next_cursor. It remembers the
+// sort key of the last returned row, so inserts made between two requests
+// neither repeat nor skip already listed rows.
+type cursor struct {
+	// Query fingerprints the filter and sort the cursor was issued for.
+	Query  string `json:"q"`
+	Values []any  `json:"v"`
+}
+
+var errBadCursor = errors.New("Invalid cursor")
+
+// listFingerprint identifies the listing parameters that a cursor depends on.
+func listFingerprint(values url.Values) string {
+	v := url.Values{}
+	for key, val := range values {
+		if key != "cursor" && key != "limit" && key != "total" {
+			v[key] = val
+		}
+	}
+	sum := sha256.Sum256([]byte(v.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string, fingerprint string, order sortOrder) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errBadCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, errBadCursor
+	}
+	if c.Query != fingerprint {
+		return c, errors.New("Cursor does not match search or sort parameters")
+	}
+	if len(c.Values) != len(order) {
+		return c, errBadCursor
+	}
+	// The values go to the query as they are, so each must be of the kind
+	// of its field.
+	for i, v := range c.Values {
+		_, text := sortFields[order[i].field].value(DBTask{}).(string)
+		switch v.(type) {
+		case string:
+			if !text {
+				return c, errBadCursor
+			}
+		case float64:
+			if text {
+				return c, errBadCursor
+			}
+		default:
+			return c, errBadCursor
+		}
+	}
+	return c, nil
+}
+
+func parseLimit(s string) (int, error) {
+	if s == "" {
+		return defListLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > maxListLimit {
+		return 0, errors.New("limit must be 1.." + strconv.Itoa(maxListLimit))
+	}
+	return limit, nil
+}
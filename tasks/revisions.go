@@ -0,0 +1,268 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRevisions is how many revisions are kept per task; older ones are
+// removed as new ones are saved.
+const maxRevisions = 50
+
+var errRevisionNotFound = errors.New("Revision not found")
+
+// Revision is the state of a task before one of its updates. Changes lists
+// the fields that update changed, from this state to the next revision or,
+// for the newest one, to the current task.
+type Revision struct {
+	Version string        `json:"version"`
+	SavedAt string        `json:"saved_at"`
+	Task    JSONTask      `json:"task"`
+	Changes []FieldChange `json:"changes"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type RevisionsResponse struct {
+	Revisions []Revision `json:"revisions"`
+}
+
+// diffTasks compares the fields of a task kept in revisions.
+func diffTasks(from, to JSONTask) []FieldChange {
+	changes := []FieldChange{}
+	for _, f := range []struct{ name, from, to string }{
+		{"date", from.Date, to.Date},
+		{"title", from.Title, to.Title},
+		{"comment", from.Comment, to.Comment},
+		{"repeat", from.Repeat, to.Repeat},
+		{"project_id", from.ProjectID, to.ProjectID},
+		{"priority", from.Priority, to.Priority},
+	} {
+		if f.from != f.to {
+			changes = append(changes, FieldChange{Field: f.name, From: f.from, To: f.to})
+		}
+	}
+	return changes
+}
+
+// saveRevision stores before, the state of a task read before it was
+// updated, unless the update left the fields of revisions unchanged.
+func saveRevision(ctx context.Context, q querier, before DBTask) error {
+	after, err := getTask(ctx, q, strconv.Itoa(before.ID))
+	if err != nil {
+		return err
+	}
+	if len(diffTasks(toJSONTask(before), toJSONTask(after))) == 0 {
+		return nil
+	}
+	_, err = q.ExecContext(ctx,
+		`INSERT INTO task_revisions (task_id, version, saved_at, date, title, comment, repeat, project_id, priority)
+		VALUES (?, ?, unixepoch(), ?, ?, ?, ?, ?, ?)`,
+		before.ID, before.Version, before.Date, before.Title, before.Comment, before.Repeat,
+		before.ProjectID, before.Priority)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx,
+		`DELETE FROM task_revisions WHERE task_id = ? AND id NOT IN
+			(SELECT id FROM task_revisions WHERE task_id = ? ORDER BY id DESC LIMIT ?)`,
+		before.ID, before.ID, maxRevisions)
+	return err
+}
+
+// taskRevisions returns the revisions of a task, oldest first, with Changes
+// left empty. saved_at is kept in UpdatedAt of the tasks.
+func taskRevisions(ctx context.Context, q querier, id string, version string) ([]DBTask, error) {
+	query := `SELECT task_id, version, saved_at, date, title, comment, repeat, project_id, priority
+		FROM task_revisions WHERE task_id = ?`
+	args := []any{id}
+	if version != "" {
+		query += " AND version = ?"
+		args = append(args, version)
+	}
+	rows, err := q.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revisions []DBTask
+	for rows.Next() {
+		var t DBTask
+		if err := rows.Scan(&t.ID, &t.Version, &t.UpdatedAt, &t.Date, &t.Title, &t.Comment, &t.Repeat,
+			&t.ProjectID, &t.Priority); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, t)
+	}
+	return revisions, rows.Err()
+}
+
+// revisionTask is the part of a revision shown to clients.
+func revisionTask(t DBTask) JSONTask {
+	jt := toJSONTask(t)
+	jt.UpdatedAt = ""
+	jt.Version = ""
+	return jt
+}
+
+// RevisionsHandler serves GET /api/task/revisions?id=... with the revisions
+// of the task, newest first.
+func RevisionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed id")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+		current, err := getTask(r.Context(), tx, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, errTaskNotFound.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		saved, err := taskRevisions(r.Context(), tx, id, "")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+
+		next := toJSONTask(current)
+		revisions := make([]Revision, 0, len(saved))
+		for i := len(saved) - 1; i >= 0; i-- {
+			task := revisionTask(saved[i])
+			revisions = append(revisions, Revision{
+				Version: strconv.FormatInt(saved[i].Version, 10),
+				SavedAt: time.Unix(saved[i].UpdatedAt, 0).Format(time.RFC3339),
+				Task:    task,
+				Changes: diffTasks(task, next),
+			})
+			next = task
+		}
+		w.Header().Set("ETag", etag(current.Version))
+		json.NewEncoder(w).Encode(RevisionsResponse{Revisions: revisions})
+	}
+}
+
+// restoreRevision updates the task id to its revision with the given
+// version. It goes through updateTask, so the revision is validated as a
+// PUT would be, and the state it replaces becomes a revision of its own.
+func restoreRevision(ctx context.Context, q querier, id, revision, version string, now time.Time) error {
+	if _, err := strconv.ParseInt(revision, 10, 64); err != nil {
+		return requestError{errors.New("Invalid revision")}
+	}
+	saved, err := taskRevisions(ctx, q, id, revision)
+	if err != nil {
+		return err
+	}
+	if len(saved) == 0 {
+		if exists, err := taskExists(ctx, q, id); err != nil {
+			return err
+		} else if !exists {
+			return errTaskNotFound
+		}
+		return errRevisionNotFound
+	}
+	t := saved[len(saved)-1]
+	return updateTask(ctx, q, &TaskRequest{
+		ID:        id,
+		Date:      t.Date,
+		Title:     t.Title,
+		Comment:   t.Comment,
+		Repeat:    t.Repeat,
+		ProjectID: strconv.FormatInt(t.ProjectID, 10),
+		Priority:  strconv.Itoa(t.Priority),
+		Version:   version,
+	}, now)
+}
+
+// RestoreRevisionHandler serves POST /api/task/revisions/restore?id=...&version=...
+// and responds with the updated task. The current version can be checked
+// with If-Match.
+func RestoreRevisionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		id := r.URL.Query().Get("id")
+		revision := r.URL.Query().Get("version")
+		if id == "" || revision == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed id or version")
+			return
+		}
+		version, conflict, err := expectedVersion(r, "")
+		if errors.Is(err, errVersionConflict) {
+			respondWithConflict(r.Context(), w, db, conflict, id)
+			return
+		}
+		if err != nil {
+			respondWithError(w, conflict, err.Error())
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := snapshotTask(r.Context(), tx, id, false)
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		now := time.Now().Local().Truncate(24 * time.Hour)
+		err = restoreRevision(r.Context(), tx, id, revision, version, now)
+		switch {
+		case errors.Is(err, errVersionConflict):
+			respondWithConflict(r.Context(), w, tx, conflict, id)
+			return
+		case errors.Is(err, errRevisionNotFound):
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		case err != nil:
+			respondWithStoreError(w, err)
+			return
+		}
+		task, err := getTask(r.Context(), tx, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if !respondWithUndo(w, r, tx, "restore", id, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		w.Header().Set("ETag", etag(task.Version))
+		json.NewEncoder(w).Encode(toJSONTask(task))
+	}
+}
@@ -0,0 +1,297 @@
+package tasks
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"modernc.org/sqlite"
+)
+
+// searchTerm is one element of a search query. Bare words and quoted phrases
+// have an empty field.
+type searchTerm struct {
+	field  string
+	value  string
+	negate bool
+	phrase bool
+}
+
+// parseSearch parses the search parameter of /api/tasks. The query is a list
+// of terms separated by spaces, all of which must match:
+//
+//	report "exact phrase"   words and phrases in the title or comment,
+//	rep*                    a trailing * matches word prefixes
+//	title:report            substring of the title
+//	comment:draft           substring of the comment
+//	date:20261115           tasks on a date (02.01.2006 is accepted too)
+//	before:20261201         tasks before a date
+//	after:20261101          tasks after a date
+//	repeat:yes              repeating tasks; no, d, w, m or y narrow it down
+//	tag:work                tasks with #work in the title or comment
+//	project:name            tasks of a project, project:inbox for none
+//	priority:3              tasks with the given priority
+//
+// A leading "-" negates a term, values with spaces are quoted: title:"a b".
+func parseSearch(s string) ([]searchTerm, error) {
+	var terms []searchTerm
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var term searchTerm
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			term.negate = true
+			i++
+		}
+
+		if runes[i] != '"' {
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != ':' && runes[i] != '"' {
+				i++
+			}
+			// Only letters form a field name, so "18:00" stays a plain word.
+			if i < len(runes) && runes[i] == ':' && i > start && isWord(runes[start:i]) {
+				term.field = strings.ToLower(string(runes[start:i]))
+				i++
+			} else {
+				i = start
+			}
+		}
+
+		if i < len(runes) && runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("Unterminated quote in search")
+			}
+			term.value = string(runes[i+1 : end])
+			term.phrase = true
+			i = end + 1
+		} else {
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				i++
+			}
+			term.value = string(runes[start:i])
+		}
+
+		if term.value == "" {
+			if term.field != "" {
+				return nil, fmt.Errorf("Missed value for %s:", term.field)
+			}
+			continue
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+func isWord(runes []rune) bool {
+	for _, r := range runes {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSearchDate accepts both the storage format and the 02.01.2006 format
+// used by the web UI.
+func parseSearchDate(field, value string) (string, error) {
+	if d, err := time.Parse("20060102", value); err == nil {
+		return d.Format("20060102"), nil
+	}
+	if d, err := time.Parse("02.01.2006", value); err == nil {
+		return d.Format("20060102"), nil
+	}
+	return "", fmt.Errorf("Bad date in %s:%s", field, value)
+}
+
+func likePattern(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "%", "\\%")
+	s = strings.ReplaceAll(s, "_", "\\_")
+	return "%" + s + "%"
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
+
+func validTag(tag string) bool {
+	for _, r := range tag {
+		if !isTagRune(r) {
+			return false
+		}
+	}
+	return tag != ""
+}
+
+// hasTag reports whether text contains #tag as a whole tag, not as the
+// start of a longer one.
+func hasTag(text, tag string) bool {
+	for {
+		i := strings.Index(text, "#"+tag)
+		if i < 0 {
+			return false
+		}
+		text = text[i+1+len(tag):]
+		if r, _ := utf8.DecodeRuneInString(text); text == "" || !isTagRune(r) {
+			return true
+		}
+	}
+}
+
+// has_tag(text, tag) is hasTag for the tag: search field; GLOB can't tell
+// letters of other alphabets from separators.
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("has_tag", 2,
+		func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			text, _ := args[0].(string)
+			tag, _ := args[1].(string)
+			if hasTag(text, tag) {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		})
+}
+
+// condition translates a term into an SQL condition over selectTask. Values
+// are always passed as arguments.
+func (t searchTerm) condition() (string, []any, error) {
+	var (
+		cond string
+		args []any
+	)
+	switch t.field {
+	case "":
+		if date, err := time.Parse("02.01.2006", t.value); err == nil && !t.phrase {
+			cond, args = "s.date = ?", []any{date.Format("20060102")}
+			break
+		}
+		p := likePattern(t.value)
+		cond = "(s.title LIKE ? ESCAPE '\\' OR COALESCE(s.comment, '') LIKE ? ESCAPE '\\')"
+		args = []any{p, p}
+	case "title":
+		cond, args = "s.title LIKE ? ESCAPE '\\'", []any{likePattern(t.value)}
+	case "comment":
+		cond, args = "COALESCE(s.comment, '') LIKE ? ESCAPE '\\'", []any{likePattern(t.value)}
+	case "date", "before", "after":
+		date, err := parseSearchDate(t.field, t.value)
+		if err != nil {
+			return "", nil, err
+		}
+		op := map[string]string{"date": "=", "before": "<", "after": ">"}[t.field]
+		cond, args = "s.date "+op+" ?", []any{date}
+	case "repeat":
+		switch strings.ToLower(t.value) {
+		case "yes":
+			cond = "COALESCE(s.repeat, '') <> ''"
+		case "no":
+			cond = "COALESCE(s.repeat, '') = ''"
+		case "d", "w", "m":
+			cond, args = "s.repeat LIKE ?", []any{strings.ToLower(t.value) + " %"}
+		case "y":
+			cond = "s.repeat = 'y'"
+		default:
+			return "", nil, fmt.Errorf("repeat: expects yes, no, d, w, m or y, got %q", t.value)
+		}
+	case "tag":
+		tag := strings.TrimPrefix(t.value, "#")
+		if !validTag(tag) {
+			return "", nil, fmt.Errorf("Bad tag %q", t.value)
+		}
+		cond = "has_tag(s.title || ' ' || COALESCE(s.comment, ''), ?)"
+		args = []any{tag}
+	case "project":
+		if t.value == "inbox" {
+			cond = "COALESCE(m.project_id, 0) = 0"
+			break
+		}
+		cond = "COALESCE(m.project_id, 0) IN (SELECT id FROM projects WHERE name = ? COLLATE NOCASE)"
+		args = []any{t.value}
+	case "priority":
+		p, err := strconv.Atoi(t.value)
+		if err != nil || p < 0 || p > 3 {
+			return "", nil, fmt.Errorf("priority: expects 0..3, got %q", t.value)
+		}
+		cond, args = "COALESCE(m.priority, 0) = ?", []any{p}
+	default:
+		return "", nil, fmt.Errorf("Unknown search field %q", t.field)
+	}
+
+	if t.negate {
+		cond = "NOT (" + cond + ")"
+	}
+	return cond, args, nil
+}
+
+// ftsQuery returns the full-text query for a bare word or phrase, or an
+// empty string if the term has to be matched with LIKE: dates and words
+// without letters or digits produce no tokens.
+func (t searchTerm) ftsQuery() string {
+	if t.field != "" {
+		return ""
+	}
+	if _, err := time.Parse("02.01.2006", t.value); err == nil && !t.phrase {
+		return ""
+	}
+	text := t.value
+	prefix := !t.phrase && strings.HasSuffix(text, "*")
+	if prefix {
+		text = strings.TrimRight(text, "*")
+	}
+	if !strings.ContainsFunc(text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		return ""
+	}
+	query := `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+	if prefix {
+		query += "*"
+	}
+	return query
+}
+
+// applySearch parses a search query and adds its conditions to the filter.
+// Words and phrases are looked up in the full-text index, which matches
+// whole words (or prefixes with a trailing *) and ranks the results. With
+// fuzzy set bare words are left in filter.words for trigram matching, while
+// quoted phrases stay exact.
+func applySearch(filter *taskFilter, search string, fuzzy bool) error {
+	terms, err := parseSearch(search)
+	if err != nil {
+		return err
+	}
+	var match []string
+	for _, term := range terms {
+		if q := term.ftsQuery(); q != "" {
+			if term.negate {
+				filter.add("s.id NOT IN (SELECT rowid FROM scheduler_fts WHERE scheduler_fts MATCH ?)", q)
+			} else if fuzzy && !term.phrase {
+				filter.words = append(filter.words, strings.Fields(strings.TrimRight(term.value, "*"))...)
+			} else {
+				match = append(match, q)
+			}
+			continue
+		}
+		cond, args, err := term.condition()
+		if err != nil {
+			return err
+		}
+		filter.add(cond, args...)
+	}
+	if len(match) > 0 {
+		filter.match(strings.Join(match, " AND "))
+	}
+	return nil
+}
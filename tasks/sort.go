@@ -0,0 +1,129 @@
+package tasks
+
+import (
+	"errors"
+	"strings"
+)
+
+type sortField struct {
+	expr string
+	// id is the task id from the table of expr, so that an index of that
+	// table orders the ties by id as well.
+	id string
+	// value extracts the field from a scanned task; it is stored in
+	// pagination cursors.
+	value func(DBTask) any
+}
+
+// sortFields maps the names accepted by the sort parameter of /api/tasks to
+// SQL expressions over selectTask. Every task has a task_meta row, so its
+// columns are sorted on as they are and their indexes can be used.
+var sortFields = map[string]sortField{
+	"date":     {"s.date", "s.id", func(t DBTask) any { return t.Date }},
+	"priority": {"m.priority", "m.task_id", func(t DBTask) any { return t.Priority }},
+	"title":    {"s.title COLLATE NOCASE", "s.id", func(t DBTask) any { return t.Title }},
+	"created":  {"m.created_at", "m.task_id", func(t DBTask) any { return t.CreatedAt }},
+	"updated":  {"m.updated_at", "m.task_id", func(t DBTask) any { return t.UpdatedAt }},
+	"id":       {"s.id", "s.id", func(t DBTask) any { return t.ID }},
+	// rank is the bm25 relevance of a full-text match, lower is better.
+	"rank": {"bm25(scheduler_fts)", "s.id", func(t DBTask) any { return t.Rank }},
+}
+
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+type sortOrder []sortKey
+
+// parseSort parses a comma separated list of fields, each optionally
+// prefixed with "-" for descending order, e.g. "-priority,date". The task id
+// is always appended as the final tie-breaker so the order is total; it
+// goes in the direction of the key before it, as the indexes do.
+// Full-text searches are ordered by relevance unless asked otherwise.
+func parseSort(s string, ranked bool) (sortOrder, error) {
+	if s == "" {
+		s = "date"
+		if ranked {
+			s = "rank,date"
+		}
+	}
+	var order sortOrder
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		key := sortKey{field: part}
+		if strings.HasPrefix(part, "-") {
+			key = sortKey{field: part[1:], desc: true}
+		}
+		if _, ok := sortFields[key.field]; !ok {
+			return nil, errors.New("Unknown sort field: " + part)
+		}
+		if key.field == "rank" && !ranked {
+			return nil, errors.New("Sort by rank needs words to search for")
+		}
+		if seen[key.field] {
+			return nil, errors.New("Duplicate sort field: " + key.field)
+		}
+		seen[key.field] = true
+		order = append(order, key)
+	}
+	if !seen["id"] {
+		order = append(order, sortKey{field: "id", desc: order[len(order)-1].desc})
+	}
+	return order, nil
+}
+
+func (o sortOrder) String() string {
+	parts := make([]string, 0, len(o))
+	for i, key := range o {
+		expr := o.expr(i)
+		if key.desc {
+			expr += " DESC"
+		}
+		parts = append(parts, expr)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// expr is the SQL expression of the i-th key. The id after another key is
+// taken from the table of that key.
+func (o sortOrder) expr(i int) string {
+	if o[i].field == "id" && i > 0 {
+		return sortFields[o[i-1].field].id
+	}
+	return sortFields[o[i].field].expr
+}
+
+// values returns the sort key of a task, in the same order as o.
+func (o sortOrder) values(t DBTask) []any {
+	values := make([]any, 0, len(o))
+	for _, key := range o {
+		values = append(values, sortFields[key.field].value(t))
+	}
+	return values
+}
+
+// after builds the keyset condition selecting rows that follow the given sort
+// key: (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+func (o sortOrder) after(values []any) (string, []any) {
+	var (
+		alts []string
+		args []any
+	)
+	for i, key := range o {
+		var conds []string
+		for j := 0; j < i; j++ {
+			conds = append(conds, o.expr(j)+" = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if key.desc {
+			op = " < ?"
+		}
+		conds = append(conds, o.expr(i)+op)
+		args = append(args, values[i])
+		alts = append(alts, "("+strings.Join(conds, " AND ")+")")
+	}
+	return "(" + strings.Join(alts, " OR ") + ")", args
+}
@@ -0,0 +1,474 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"main.go/parsedate"
+)
+
+// querier is satisfied by both *sql.DB and *sql.Tx, so the helpers below
+// can run inside or outside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+var errProjectNotFound = errors.New("Project not found")
+
+const taskColumns = `s.id, s.date, s.title, COALESCE(s.comment, ''), COALESCE(s.repeat, ''),
+	COALESCE(m.project_id, 0), COALESCE(m.priority, 0), COALESCE(m.created_at, 0), COALESCE(m.updated_at, 0), COALESCE(m.version, 1),
+	COALESCE(m.remind_before, 0),
+	(SELECT COUNT(*) FROM checklist_items c WHERE c.task_id = s.id AND c.done = 1),
+	(SELECT COUNT(*) FROM checklist_items c WHERE c.task_id = s.id)`
+
+// taskFrom joins the task_meta row that a trigger adds for every task.
+const taskFrom = ` FROM scheduler s JOIN task_meta m ON m.task_id = s.id`
+
+const selectTask = "SELECT " + taskColumns + taskFrom
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTask(row scanner) (DBTask, error) {
+	var task DBTask
+	err := row.Scan(&task.ID, &task.Date, &task.Title, &task.Comment, &task.Repeat,
+		&task.ProjectID, &task.Priority, &task.CreatedAt, &task.UpdatedAt, &task.Version, &task.RemindBefore,
+		&task.ChecklistDone, &task.ChecklistTotal)
+	return task, err
+}
+
+// scanListedTask scans a row of a task listing, which carries the search
+// rank and snippet after the task columns.
+func scanListedTask(row scanner) (DBTask, error) {
+	var task DBTask
+	err := row.Scan(&task.ID, &task.Date, &task.Title, &task.Comment, &task.Repeat,
+		&task.ProjectID, &task.Priority, &task.CreatedAt, &task.UpdatedAt, &task.Version, &task.RemindBefore,
+		&task.ChecklistDone, &task.ChecklistTotal, &task.Rank, &task.Snippet)
+	return task, err
+}
+
+func queryTasks(ctx context.Context, q querier, query string, args ...any) ([]DBTask, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []DBTask
+	for rows.Next() {
+		task, err := scanListedTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func getTask(ctx context.Context, q querier, id string) (DBTask, error) {
+	return scanTask(q.QueryRowContext(ctx, selectTask+" WHERE s.id = ?", id))
+}
+
+func toJSONTask(task DBTask) JSONTask {
+	jt := JSONTask{
+		ID:      strconv.Itoa(task.ID),
+		Date:    task.Date,
+		Title:   task.Title,
+		Comment: task.Comment,
+		Repeat:  task.Repeat,
+	}
+	if task.ProjectID != 0 {
+		jt.ProjectID = strconv.FormatInt(task.ProjectID, 10)
+	}
+	if task.Priority != 0 {
+		jt.Priority = strconv.Itoa(task.Priority)
+	}
+	if task.CreatedAt != 0 {
+		jt.CreatedAt = time.Unix(task.CreatedAt, 0).Format(time.RFC3339)
+	}
+	if task.UpdatedAt != 0 {
+		jt.UpdatedAt = time.Unix(task.UpdatedAt, 0).Format(time.RFC3339)
+	}
+	jt.Version = strconv.FormatInt(task.Version, 10)
+	if task.RemindBefore != 0 {
+		jt.RemindBefore = strconv.Itoa(task.RemindBefore)
+	}
+	jt.Snippet = task.Snippet
+	if task.ChecklistTotal != 0 {
+		jt.ChecklistDone = strconv.Itoa(task.ChecklistDone)
+		jt.ChecklistTotal = strconv.Itoa(task.ChecklistTotal)
+	}
+	return jt
+}
+
+// parseProjectID accepts an empty string, "0" or "inbox" for tasks without a
+// project.
+func parseProjectID(s string) (int64, error) {
+	if s == "" || s == "inbox" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("Invalid project id")
+	}
+	return id, nil
+}
+
+// parsePriority accepts an empty string (no priority) or 0..3, where 3 is the
+// most urgent.
+func parsePriority(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 || p > 3 {
+		return 0, errors.New("Priority must be 0..3")
+	}
+	return p, nil
+}
+
+// maxRemindBefore limits how many days in advance a task can be reminded of.
+const maxRemindBefore = 365
+
+// parseRemindBefore accepts an empty string (no advance reminder) or a
+// number of days.
+func parseRemindBefore(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > maxRemindBefore {
+		return 0, fmt.Errorf("remind_before must be 0..%d", maxRemindBefore)
+	}
+	return n, nil
+}
+
+func checkProject(ctx context.Context, q querier, projectID int64) error {
+	if projectID == 0 {
+		return nil
+	}
+	var exists int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM projects WHERE id = ?", projectID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errProjectNotFound
+	}
+	return nil
+}
+
+// setTaskProject, setTaskPriority and setTaskRemindBefore don't bump the
+// version: the operation that calls them does so once, by updating the
+// scheduler row or with touchTask.
+func setTaskProject(ctx context.Context, q querier, taskID int64, projectID int64) error {
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO task_meta (task_id, project_id, created_at, updated_at) VALUES (?, ?, unixepoch(), unixepoch())
+		ON CONFLICT (task_id) DO UPDATE SET project_id = excluded.project_id, updated_at = unixepoch()`,
+		taskID, projectID)
+	return err
+}
+
+func setTaskPriority(ctx context.Context, q querier, taskID int64, priority int) error {
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO task_meta (task_id, priority, created_at, updated_at) VALUES (?, ?, unixepoch(), unixepoch())
+		ON CONFLICT (task_id) DO UPDATE SET priority = excluded.priority, updated_at = unixepoch()`,
+		taskID, priority)
+	return err
+}
+
+func setTaskRemindBefore(ctx context.Context, q querier, taskID int64, days int) error {
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO task_meta (task_id, remind_before, created_at, updated_at) VALUES (?, ?, unixepoch(), unixepoch())
+		ON CONFLICT (task_id) DO UPDATE SET remind_before = excluded.remind_before, updated_at = unixepoch()`,
+		taskID, days)
+	return err
+}
+
+// touchTask bumps the version of the task id for a change that doesn't
+// update its scheduler row.
+func touchTask(ctx context.Context, q querier, id string) error {
+	_, err := q.ExecContext(ctx,
+		"UPDATE task_meta SET updated_at = unixepoch(), version = version + 1 WHERE task_id = ?", id)
+	return err
+}
+
+// ReleaseProjectTasks deals with the tasks of the project id as it is
+// deleted: with cascade they are deleted, otherwise moved to the inbox.
+// Either way each task gets the version and event it would get if changed
+// through /api/task.
+func ReleaseProjectTasks(ctx context.Context, tx *sql.Tx, projectID string, cascade bool) error {
+	rows, err := tx.QueryContext(ctx, "SELECT task_id FROM task_meta WHERE project_id = ? ORDER BY task_id", projectID)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, taskID := range ids {
+		id := strconv.FormatInt(taskID, 10)
+		if cascade {
+			if err := deleteTask(ctx, tx, id, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := setTaskProject(ctx, tx, taskID, 0); err != nil {
+			return err
+		}
+		if err := touchTask(ctx, tx, id); err != nil {
+			return err
+		}
+		if err := recordTaskEvent(ctx, tx, EventUpdated, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	errTaskNotFound    = errors.New("Task not found")
+	errVersionConflict = errors.New("Task was changed since it was read")
+)
+
+// requestError is an error caused by the request rather than the server;
+// handlers report it with status 400.
+type requestError struct {
+	error
+}
+
+// storeErrorStatus maps an error of the store functions below to an HTTP
+// status.
+func storeErrorStatus(err error) int {
+	var reqErr requestError
+	switch {
+	case errors.As(err, &reqErr), errors.Is(err, errProjectNotFound):
+		return http.StatusBadRequest
+	case errors.Is(err, errTaskNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errVersionConflict):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// createTask validates req with ValidateAndProcessTaskRequest and stores it
+// as a new task.
+func createTask(ctx context.Context, q querier, req *TaskRequest, now time.Time) (int64, error) {
+	return insertTask(ctx, q, 0, req, now)
+}
+
+// insertTask is createTask with an explicit id; 0 lets the database choose
+// one.
+func insertTask(ctx context.Context, q querier, id int64, req *TaskRequest, now time.Time) (int64, error) {
+	finalDate, err := ValidateAndProcessTaskRequest(req, now)
+	if err != nil {
+		return 0, requestError{err}
+	}
+	projectID, _ := parseProjectID(req.ProjectID)
+	if err := checkProject(ctx, q, projectID); err != nil {
+		return 0, err
+	}
+
+	res, err := q.ExecContext(ctx,
+		`INSERT INTO scheduler (id, date, title, comment, repeat) VALUES (NULLIF(?, 0), ?, ?, ?, ?)`,
+		id,
+		finalDate.Format("20060102"),
+		req.Title,
+		req.Comment,
+		req.Repeat,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, _ = res.LastInsertId()
+	if projectID != 0 {
+		if err := setTaskProject(ctx, q, id, projectID); err != nil {
+			return 0, err
+		}
+	}
+	if priority, _ := parsePriority(req.Priority); priority != 0 {
+		if err := setTaskPriority(ctx, q, id, priority); err != nil {
+			return 0, err
+		}
+	}
+	if days, _ := parseRemindBefore(req.RemindBefore); days != 0 {
+		if err := setTaskRemindBefore(ctx, q, id, days); err != nil {
+			return 0, err
+		}
+	}
+	return id, recordTaskEvent(ctx, q, EventCreated, strconv.FormatInt(id, 10))
+}
+
+// updateTask validates req with ValidateAndProcessTaskRequest and overwrites
+// the task req.ID with it. Empty project_id and priority keep the current
+// values, as does an empty remind_before. A non-empty req.Version must match
+// the stored version. The state before the update is kept as a revision.
+func updateTask(ctx context.Context, q querier, req *TaskRequest, now time.Time) error {
+	if req.ID == "" {
+		return requestError{errors.New("Missed ID")}
+	}
+	if err := checkVersion(req.Version); err != nil {
+		return err
+	}
+	finalDate, err := ValidateAndProcessTaskRequest(req, now)
+	if err != nil {
+		return requestError{err}
+	}
+	before, err := getTask(ctx, q, req.ID)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := q.ExecContext(ctx,
+		"UPDATE scheduler SET date = ?, title = ?, comment = ?, repeat = ? WHERE id = ?"+versionCond,
+		finalDate.Format("20060102"),
+		req.Title,
+		req.Comment,
+		req.Repeat,
+		req.ID,
+		req.Version, req.Version)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return missedTask(ctx, q, req.ID)
+	}
+
+	taskID, _ := strconv.ParseInt(req.ID, 10, 64)
+	if req.ProjectID != "" {
+		projectID, _ := parseProjectID(req.ProjectID)
+		if err := checkProject(ctx, q, projectID); err != nil {
+			return err
+		}
+		if err := setTaskProject(ctx, q, taskID, projectID); err != nil {
+			return err
+		}
+	}
+	if req.Priority != "" {
+		priority, _ := parsePriority(req.Priority)
+		if err := setTaskPriority(ctx, q, taskID, priority); err != nil {
+			return err
+		}
+	}
+	if req.RemindBefore != "" {
+		days, _ := parseRemindBefore(req.RemindBefore)
+		if err := setTaskRemindBefore(ctx, q, taskID, days); err != nil {
+			return err
+		}
+	}
+	if err := recordTaskEvent(ctx, q, EventUpdated, req.ID); err != nil {
+		return err
+	}
+	return saveRevision(ctx, q, before)
+}
+
+// versionCond restricts a statement over scheduler to the expected version,
+// given twice as an argument; an empty version matches any.
+const versionCond = ` AND (? = '' OR
+	COALESCE((SELECT version FROM task_meta WHERE task_id = scheduler.id), 1) = CAST(? AS INTEGER))`
+
+func checkVersion(version string) error {
+	if version == "" {
+		return nil
+	}
+	if v, err := strconv.ParseInt(version, 10, 64); err != nil || v < 1 {
+		return requestError{errors.New("Invalid version")}
+	}
+	return nil
+}
+
+// missedTask tells why a statement restricted by versionCond changed nothing.
+func missedTask(ctx context.Context, q querier, id string) error {
+	exists, err := taskExists(ctx, q, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errTaskNotFound
+	}
+	return errVersionConflict
+}
+
+// deleteTask deletes the task id. A non-empty version must match the stored
+// version.
+func deleteTask(ctx context.Context, q querier, id, version string) error {
+	return removeTask(ctx, q, id, version, EventDeleted)
+}
+
+// removeTask is deleteTask recording event, as done one-off tasks are
+// deleted too.
+func removeTask(ctx context.Context, q querier, id, version, event string) error {
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+	before, err := getTask(ctx, q, id)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return err
+	}
+	res, err := q.ExecContext(ctx, "DELETE FROM scheduler WHERE id = ?"+versionCond, id, version, version)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return missedTask(ctx, q, id)
+	}
+	return recordEvent(ctx, q, event, before)
+}
+
+// markTaskDone moves a repeating task to its next date and resets its
+// checklist, which belongs to a single occurrence. Other tasks are deleted.
+func markTaskDone(ctx context.Context, q querier, id string, now time.Time) error {
+	var date, repeat string
+	err := q.QueryRowContext(ctx,
+		"SELECT date, COALESCE(repeat, '') FROM scheduler WHERE id = ?", id).
+		Scan(&date, &repeat)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if repeat == "" {
+		return removeTask(ctx, q, id, "", EventDone)
+	}
+
+	next, err := parsedate.NextDate(now, date, repeat)
+	if err != nil {
+		return requestError{err}
+	}
+	if _, err := q.ExecContext(ctx, "UPDATE scheduler SET date = ? WHERE id = ?", next, id); err != nil {
+		return err
+	}
+	if err := resetChecklist(ctx, q, id); err != nil {
+		return err
+	}
+	return recordTaskEvent(ctx, q, EventDone, id)
+}
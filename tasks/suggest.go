@@ -0,0 +1,163 @@
+package tasks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defSuggestLimit = 10
+	maxSuggestLimit = 50
+)
+
+type suggestion struct {
+	title string
+	uses  int
+	score float64
+}
+
+// SuggestHandler completes a task title for the add-task form. Titles whose
+// words start with the typed prefix come first, the ones starting with the
+// whole prefix and the most used ones ahead. If that gives too few results,
+// titles resembling the prefix are added.
+func SuggestHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		prefix := strings.TrimSpace(r.URL.Query().Get("prefix"))
+		if prefix == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed prefix")
+			return
+		}
+		limit := defSuggestLimit
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 || n > maxSuggestLimit {
+				respondWithError(w, http.StatusBadRequest, "limit must be 1.."+strconv.Itoa(maxSuggestLimit))
+				return
+			}
+			limit = n
+		}
+
+		words := splitWords(prefix)
+		suggestions := []suggestion{}
+		if len(words) > 0 {
+			var parts []string
+			for i, word := range words {
+				part := `title : "` + strings.ReplaceAll(word, `"`, `""`) + `"`
+				if i == len(words)-1 {
+					part += "*"
+				}
+				parts = append(parts, part)
+			}
+
+			rows, err := db.QueryContext(r.Context(),
+				`SELECT s.title, COUNT(*) FROM scheduler_fts JOIN scheduler s ON s.id = scheduler_fts.rowid
+				WHERE scheduler_fts MATCH ? GROUP BY s.title LIMIT ?`,
+				strings.Join(parts, " AND "), maxFuzzyCandidates)
+			if err != nil {
+				log.Printf("Error request: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Internal server error")
+				return
+			}
+			defer rows.Close()
+			lower := strings.ToLower(prefix)
+			for rows.Next() {
+				var s suggestion
+				if err := rows.Scan(&s.title, &s.uses); err != nil {
+					log.Printf("Row scan error: %v", err)
+					respondWithError(w, http.StatusInternalServerError, "Internal server error")
+					return
+				}
+				if strings.HasPrefix(strings.ToLower(s.title), lower) {
+					s.score = 1
+				}
+				suggestions = append(suggestions, s)
+			}
+			if err := rows.Err(); err != nil {
+				log.Printf("Rows error: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Internal server error")
+				return
+			}
+			sort.Slice(suggestions, func(i, j int) bool {
+				a, b := suggestions[i], suggestions[j]
+				if a.score != b.score {
+					return a.score > b.score
+				}
+				if a.uses != b.uses {
+					return a.uses > b.uses
+				}
+				return a.title < b.title
+			})
+		}
+
+		if len(suggestions) < limit {
+			more, err := fuzzyTitles(r, db, words)
+			if err != nil {
+				log.Printf("Error request: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Internal server error")
+				return
+			}
+			suggestions = append(suggestions, more...)
+		}
+
+		titles := make([]string, 0, limit)
+		seen := map[string]bool{}
+		for _, s := range suggestions {
+			if len(titles) == limit {
+				break
+			}
+			if !seen[s.title] {
+				seen[s.title] = true
+				titles = append(titles, s.title)
+			}
+		}
+		json.NewEncoder(w).Encode(struct {
+			Suggestions []string `json:"suggestions"`
+		}{Suggestions: titles})
+	}
+}
+
+// fuzzyTitles returns the titles of tasks resembling the words, closest
+// first.
+func fuzzyTitles(r *http.Request, db *sql.DB, words []string) ([]suggestion, error) {
+	scores, err := fuzzyScores(r.Context(), db, words)
+	if err != nil || len(scores) == 0 {
+		return nil, err
+	}
+	ids := make([]any, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT id, title FROM scheduler WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suggestions []suggestion
+	for rows.Next() {
+		var (
+			id int
+			s  suggestion
+		)
+		if err := rows.Scan(&id, &s.title); err != nil {
+			return nil, err
+		}
+		s.score = scores[id]
+		suggestions = append(suggestions, s)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].score != suggestions[j].score {
+			return suggestions[i].score > suggestions[j].score
+		}
+		return suggestions[i].title < suggestions[j].title
+	})
+	return suggestions, rows.Err()
+}
@@ -7,9 +7,9 @@ import (
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
+	"main.go/audit"
 	"main.go/parsedate"
 )
 
@@ -19,21 +19,58 @@ type TaskRequest struct {
 	Title   string `json:"title"`
 	Comment string `json:"comment"`
 	Repeat  string `json:"repeat"`
+	// ProjectID left empty keeps the current project on update; "0" moves
+	// the task to the inbox.
+	ProjectID string `json:"project_id"`
+	// Priority is 0..3; left empty it keeps the current priority on update.
+	Priority string `json:"priority"`
+	// Version, if set, must match the stored version on update.
+	Version string `json:"version"`
+	// RemindBefore is the number of days before the date to send a reminder
+	// in advance; left empty it keeps the current value on update and "0"
+	// turns it off.
+	RemindBefore string `json:"remind_before"`
 }
 type DBTask struct {
-	ID      int    `db:"id"`
-	Date    string `db:"date"`
-	Title   string `db:"title"`
-	Comment string `db:"comment"`
-	Repeat  string `db:"repeat"`
+	ID        int    `db:"id"`
+	Date      string `db:"date"`
+	Title     string `db:"title"`
+	Comment   string `db:"comment"`
+	Repeat    string `db:"repeat"`
+	ProjectID int64  `db:"project_id"`
+	Priority  int    `db:"priority"`
+	CreatedAt int64  `db:"created_at"`
+	UpdatedAt int64  `db:"updated_at"`
+	Version   int64  `db:"version"`
+
+	RemindBefore int `db:"remind_before"`
+
+	ChecklistDone  int `db:"checklist_done"`
+	ChecklistTotal int `db:"checklist_total"`
+
+	// Rank and Snippet are only filled by full-text search.
+	Rank    float64 `db:"rank"`
+	Snippet string  `db:"snippet"`
 }
 
 type JSONTask struct {
-	ID      string `json:"id"`
-	Date    string `json:"date"`
-	Title   string `json:"title"`
-	Comment string `json:"comment"`
-	Repeat  string `json:"repeat"`
+	ID        string `json:"id"`
+	Date      string `json:"date"`
+	Title     string `json:"title"`
+	Comment   string `json:"comment"`
+	Repeat    string `json:"repeat"`
+	ProjectID string `json:"project_id,omitempty"`
+	Priority  string `json:"priority,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+	Version   string `json:"version,omitempty"`
+	// RemindBefore is set for tasks reminded of in advance.
+	RemindBefore string `json:"remind_before,omitempty"`
+	// Checklist progress, present only for tasks that have checklist items.
+	ChecklistDone  string `json:"checklist_done,omitempty"`
+	ChecklistTotal string `json:"checklist_total,omitempty"`
+	// Snippet highlights the matched words with <mark> in search results.
+	Snippet string `json:"snippet,omitempty"`
 }
 
 type ErrorResponse struct {
@@ -49,6 +86,26 @@ func respondWithError(w http.ResponseWriter, head int, message string) {
 	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: message})
 }
 
+func respondWithProjectError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errProjectNotFound) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Server error")
+}
+
+// respondWithStoreError reports an error of a store function, hiding the
+// details of server errors.
+func respondWithStoreError(w http.ResponseWriter, err error) {
+	status := storeErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Store error: %v", err)
+		respondWithError(w, status, "Server error")
+		return
+	}
+	respondWithError(w, status, err.Error())
+}
+
 func respondWithSuccess(w http.ResponseWriter, head int, id int64) {
 	w.WriteHeader(head)
 	_ = json.NewEncoder(w).Encode(SuccessResponse{ID: id})
@@ -58,6 +115,15 @@ func ValidateAndProcessTaskRequest(req *TaskRequest, now time.Time) (time.Time,
 	if req.Title == "" {
 		return time.Time{}, errors.New("Missed header")
 	}
+	if _, err := parseProjectID(req.ProjectID); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := parsePriority(req.Priority); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := parseRemindBefore(req.RemindBefore); err != nil {
+		return time.Time{}, err
+	}
 
 	var finalDate time.Time
 
@@ -104,115 +170,142 @@ func AddTaskHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		now := time.Now().Local().Truncate(24 * time.Hour)
-		finalDate, err := ValidateAndProcessTaskRequest(&req, now)
+		tx, err := db.BeginTx(r.Context(), nil)
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		defer tx.Rollback()
 
-		res, err := db.Exec(
-			`INSERT INTO scheduler (date, title, comment, repeat) VALUES (?, ?, ?, ?)`,
-			finalDate.Format("20060102"),
-			req.Title,
-			req.Comment,
-			req.Repeat,
-		)
+		now := time.Now().Local().Truncate(24 * time.Hour)
+		id, err := createTask(r.Context(), tx, &req, now)
 		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		audit.SetTaskID(r.Context(), strconv.FormatInt(id, 10))
+		if !respondWithUndo(w, r, tx, "create", strconv.FormatInt(id, 10), nil) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-
-		id, _ := res.LastInsertId()
 		respondWithSuccess(w, http.StatusCreated, id)
 
 	}
 }
 
+// GetTasksHandler lists tasks page by page. The page size is set by limit;
+// next_cursor is returned while more tasks follow and is passed back as
+// cursor. total=1 adds the number of matching tasks to the response.
+// fuzzy=1 matches the search words by trigram similarity; such results come
+// as a single page ordered by similarity and are marked with "fuzzy": true.
 func GetTasksHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		search := r.URL.Query().Get("search")
+		params := r.URL.Query()
 
 		var tasks []DBTask
 		var err error
 
-		query := "SELECT id, date, title, comment, repeat FROM scheduler"
-		args := []interface{}{}
-		whereAdded := false
-		limit := 50
-
-		if search != "" {
-
-			if date, err := time.Parse("02.01.2006", search); err == nil {
-				if whereAdded {
-					query += " AND date = ?"
-				} else {
-					query += " WHERE date = ?"
-					whereAdded = true
-				}
-				args = append(args, date.Format("20060102"))
-			} else {
-
-				search = strings.ReplaceAll(search, "%", "\\%")
-				search = strings.ReplaceAll(search, "_", "\\_")
-				searchTerm := "%" + search + "%"
-				if whereAdded {
-					query += " AND (title LIKE ? OR comment LIKE ?)"
-				} else {
-					query += " WHERE (title LIKE ? OR comment LIKE ?)"
-					whereAdded = true
-				}
-				args = append(args, searchTerm, searchTerm)
-			}
+		limit, err := parseLimit(params.Get("limit"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
 		}
 
-		query += " ORDER BY date LIMIT ?"
-		args = append(args, limit)
+		fuzzy := params.Get("fuzzy") == "1" || params.Get("fuzzy") == "true"
+		filter, err := buildTaskFilter(params, fuzzy)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(filter.words) == 0 {
+			fuzzy = false
+		}
 
-		rows, err := db.QueryContext(r.Context(), query, args...)
+		order, err := parseSort(params.Get("sort"), filter.ranked)
 		if err != nil {
-			log.Printf("Error request: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: "Internal server error"})
+			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		defer rows.Close()
-		for rows.Next() {
-			var task DBTask
-			if err := rows.Scan(&task.ID, &task.Date, &task.Title, &task.Comment, &task.Repeat); err != nil {
-				log.Printf("Row scan error: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(ErrorResponse{Error: "Internal server error"})
+
+		var total *int
+		if params.Get("total") == "1" || params.Get("total") == "true" {
+			var n int
+			err := db.QueryRowContext(r.Context(),
+				"SELECT COUNT(*)"+filter.from()+filter.where(),
+				filter.args...).Scan(&n)
+			if err != nil {
+				log.Printf("Error request: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Internal server error")
 				return
 			}
+			total = &n
+		}
 
-			tasks = append(tasks, task)
+		fingerprint := listFingerprint(params)
+		if c := params.Get("cursor"); c != "" {
+			cur, err := decodeCursor(c, fingerprint, order)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			cond, args := order.after(cur.Values)
+			filter.add(cond, args...)
 		}
 
-		if err := rows.Err(); err != nil {
-			log.Printf("Rows error: %v", err)
+		query := "SELECT " + taskColumns + ", " + filter.rankColumns() + filter.from() + filter.where() +
+			" ORDER BY " + order.String() + " LIMIT ?"
+		args := append(filter.args, limit+1)
+
+		if !fuzzy {
+			tasks, err = queryTasks(r.Context(), db, query, args...)
+		}
+		// A full-text search that finds nothing falls back to typo-tolerant
+		// matching, unless fuzzy=0 is given.
+		if err == nil && len(tasks) == 0 && params.Get("cursor") == "" && params.Get("fuzzy") != "0" &&
+			(fuzzy || filter.ranked) {
+			fuzzy = true
+			tasks, err = fuzzySearchTasks(r.Context(), db, params, limit)
+			if total != nil {
+				n := len(tasks)
+				total = &n
+			}
+		}
+		if err != nil {
+			log.Printf("Error request: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(ErrorResponse{Error: "Internal server error"})
 			return
 		}
 
+		var nextCursor string
+		if len(tasks) > limit && !fuzzy {
+			tasks = tasks[:limit]
+			nextCursor = encodeCursor(cursor{
+				Query:  fingerprint,
+				Values: order.values(tasks[len(tasks)-1]),
+			})
+		}
+
 		jsonTasks := make([]JSONTask, 0, len(tasks))
 		for _, task := range tasks {
-			jsonTasks = append(jsonTasks, JSONTask{
-				ID:      strconv.Itoa(task.ID),
-				Date:    task.Date,
-				Title:   task.Title,
-				Comment: task.Comment,
-				Repeat:  task.Repeat,
-			})
+			jsonTasks = append(jsonTasks, toJSONTask(task))
 		}
 
 		response := struct {
-			Tasks []JSONTask `json:"tasks"`
+			Tasks      []JSONTask `json:"tasks"`
+			NextCursor string     `json:"next_cursor,omitempty"`
+			Total      *int       `json:"total,omitempty"`
+			Fuzzy      bool       `json:"fuzzy,omitempty"`
 		}{
-			Tasks: jsonTasks,
+			Tasks:      jsonTasks,
+			NextCursor: nextCursor,
+			Total:      total,
+			Fuzzy:      fuzzy,
 		}
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			log.Printf("JSON encode error: %v", err)
@@ -233,12 +326,7 @@ func GetTaskHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var task DBTask
-
-		err := db.QueryRowContext(r.Context(),
-			"SELECT id, date, title, comment, repeat FROM scheduler WHERE id = ?", id).
-			Scan(&task.ID, &task.Date, &task.Title, &task.Comment, &task.Repeat)
-
+		task, err := getTask(r.Context(), db, id)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				w.WriteHeader(http.StatusNotFound)
@@ -249,13 +337,8 @@ func GetTaskHandler(db *sql.DB) http.HandlerFunc {
 			json.NewEncoder(w).Encode(ErrorResponse{Error: "Internal server error"})
 			return
 		}
-		json.NewEncoder(w).Encode(JSONTask{
-			ID:      strconv.Itoa(task.ID),
-			Date:    task.Date,
-			Title:   task.Title,
-			Comment: task.Comment,
-			Repeat:  task.Repeat,
-		})
+		w.Header().Set("ETag", etag(task.Version))
+		json.NewEncoder(w).Encode(toJSONTask(task))
 
 	}
 }
@@ -270,36 +353,55 @@ func UpdateTaskHandler(db *sql.DB) http.HandlerFunc {
 			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid JSON"})
 			return
 		}
-		if req.ID == "" {
-			respondWithError(w, http.StatusBadRequest, "Missed ID")
+		audit.SetTaskID(r.Context(), req.ID)
+
+		version, conflict, err := expectedVersion(r, req.Version)
+		if errors.Is(err, errVersionConflict) {
+			respondWithConflict(r.Context(), w, db, conflict, req.ID)
+			return
+		}
+		if err != nil {
+			respondWithError(w, conflict, err.Error())
 			return
 		}
+		req.Version = version
 
-		now := time.Now().Local().Truncate(24 * time.Hour)
-		finalDate, err := ValidateAndProcessTaskRequest(&req, now)
+		tx, err := db.BeginTx(r.Context(), nil)
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		res, err := db.ExecContext(r.Context(),
-			"UPDATE scheduler SET date = ?, title = ?, comment = ?, repeat = ? WHERE id = ?",
-			finalDate.Format("20060102"),
-			req.Title,
-			req.Comment,
-			req.Repeat,
-			req.ID)
+		defer tx.Rollback()
 
+		// A missing task is reported by updateTask after the request is
+		// validated.
+		before, err := snapshotTask(r.Context(), tx, req.ID, false)
+		if err != nil && !errors.Is(err, errTaskNotFound) {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		now := time.Now().Local().Truncate(24 * time.Hour)
+		if err := updateTask(r.Context(), tx, &req, now); err != nil {
+			if errors.Is(err, errVersionConflict) {
+				respondWithConflict(r.Context(), w, tx, conflict, req.ID)
+				return
+			}
+			respondWithStoreError(w, err)
+			return
+		}
+		task, err := getTask(r.Context(), tx, req.ID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+			respondWithError(w, http.StatusInternalServerError, "Server error")
 			return
 		}
-
-		rowsAffected, _ := res.RowsAffected()
-		if rowsAffected == 0 {
-			respondWithError(w, http.StatusNotFound, "Task not found")
+		if !respondWithUndo(w, r, tx, "update", req.ID, before) {
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		w.Header().Set("ETag", etag(task.Version))
 		json.NewEncoder(w).Encode(struct{}{})
 	}
 }
@@ -314,59 +416,32 @@ func DoneMarkHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var task struct {
-			Date   string
-			Repeat string
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
 		}
-		err := db.QueryRowContext(r.Context(),
-			"SELECT date, repeat FROM scheduler WHERE id = ?", id).
-			Scan(&task.Date, &task.Repeat)
+		defer tx.Rollback()
+
+		before, err := snapshotTask(r.Context(), tx, id, true)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				w.WriteHeader(http.StatusNotFound)
-				json.NewEncoder(w).Encode(ErrorResponse{Error: "Task not found"})
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: "Server error"})
+			respondWithStoreError(w, err)
 			return
 		}
 		now := time.Now().UTC()
-
-		if task.Repeat != "" {
-			parsedDate, _ := time.Parse("20060102", task.Date)
-			next, err := parsedate.NextDate(now, parsedDate.Format("20060102"), task.Repeat)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
-				return
-			}
-
-			_, err = db.ExecContext(r.Context(),
-				"UPDATE scheduler SET date = ? WHERE id = ?",
-				next,
-				id)
-
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(ErrorResponse{Error: "Server error"})
-				return
-			}
-
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(struct{}{})
-		} else {
-			_, err := db.ExecContext(r.Context(),
-				"DELETE FROM scheduler WHERE id = ?", id)
-
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(ErrorResponse{Error: "Server error"})
-				return
-			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(struct{}{})
+		if err := markTaskDone(r.Context(), tx, id, now); err != nil {
+			respondWithStoreError(w, err)
+			return
 		}
+		if !respondWithUndo(w, r, tx, "done", id, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct{}{})
 	}
 }
 
@@ -380,17 +455,104 @@ func DeleteTaskHandler(db *sql.DB) http.HandlerFunc {
 			json.NewEncoder(w).Encode(ErrorResponse{Error: "Missed id"})
 			return
 		}
-		result, err := db.ExecContext(r.Context(),
-			"DELETE FROM scheduler WHERE id = ?", id)
+		version, conflict, err := expectedVersion(r, r.URL.Query().Get("version"))
+		if err != nil && !errors.Is(err, errVersionConflict) {
+			respondWithError(w, conflict, err.Error())
+			return
+		}
+		if errors.Is(err, errVersionConflict) {
+			respondWithConflict(r.Context(), w, db, conflict, id)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := snapshotTask(r.Context(), tx, id, true)
+		if err == nil {
+			err = deleteTask(r.Context(), tx, id, version)
+		}
+		if errors.Is(err, errVersionConflict) {
+			respondWithConflict(r.Context(), w, tx, conflict, id)
+			return
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: "Server error"})
+			respondWithStoreError(w, err)
+			return
+		}
+		if !respondWithUndo(w, r, tx, "delete", id, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		json.NewEncoder(w).Encode(struct{}{})
+	}
+}
+
+// MoveTaskHandler moves a task to another project. project_id=0 (or inbox)
+// moves it back to the inbox.
+func MoveTaskHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Missed id")
+			return
+		}
+		projectID, err := parseProjectID(r.URL.Query().Get("project_id"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := snapshotTask(r.Context(), tx, strconv.FormatInt(id, 10), false)
+		if err != nil {
+			if errors.Is(err, errTaskNotFound) {
+				respondWithError(w, http.StatusNotFound, "Task not found")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if err := checkProject(r.Context(), tx, projectID); err != nil {
+			respondWithProjectError(w, err)
+			return
+		}
+		if err := setTaskProject(r.Context(), tx, id, projectID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if err := touchTask(r.Context(), tx, strconv.FormatInt(id, 10)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if err := recordTaskEvent(r.Context(), tx, EventUpdated, strconv.FormatInt(id, 10)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		if !respondWithUndo(w, r, tx, "move", strconv.FormatInt(id, 10), before) {
 			return
 		}
-		rows, _ := result.RowsAffected()
-		if rows == 0 {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: "Task not found"})
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
 			return
 		}
 		json.NewEncoder(w).Encode(struct{}{})
@@ -0,0 +1,224 @@
+package tasks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/todotxt"
+)
+
+// todoTxtPriority maps priorities onto todo.txt letters, where (A) is the
+// most urgent.
+var todoTxtPriority = map[string]byte{"3": 'A', "2": 'B', "1": 'C'}
+
+// todoTxtTags are the tags this format uses. repeat: carries the rules that
+// rec: can't express, with underscores for spaces.
+var todoTxtTags = []string{"due", "rec", "repeat", "id"}
+
+// todoTxtRec translates a repeat rule into a rec: value for a task on date.
+// Repetitions are counted from the due date, which is the strict "+" form.
+func todoTxtRec(date, repeat string) (string, bool) {
+	day, err := time.Parse("20060102", date)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Fields(repeat)
+	switch {
+	case len(parts) == 2 && parts[0] == "d":
+		return "+" + parts[1] + "d", true
+	case len(parts) == 1 && parts[0] == "y":
+		return "+1y", true
+	case len(parts) == 2 && parts[0] == "w":
+		// The same numbering as parsedate uses.
+		n, err := strconv.Atoi(parts[1])
+		if err == nil && time.Weekday(n-1) == day.Weekday() {
+			return "+1w", true
+		}
+	case len(parts) == 2 && parts[0] == "m":
+		n, err := strconv.Atoi(parts[1])
+		if err == nil && n == day.Day() {
+			return "+1m", true
+		}
+	}
+	return "", false
+}
+
+// todoTxtLine formats a task as a todo.txt line. The project is appended as
+// a +project word with underscores for spaces; comments and checklists are
+// left out.
+func todoTxtLine(t ExportTask) string {
+	line := todotxt.Task{Priority: todoTxtPriority[t.Priority], Description: t.Title}
+	if created, err := time.Parse(time.RFC3339, t.CreatedAt); err == nil {
+		line.Created = created.Local().Format(todotxt.DateFormat)
+	}
+	if t.Project != "" {
+		line.Description += " +" + strings.Join(strings.Fields(t.Project), "_")
+	}
+	// Tags typed in the title would be read back as the task's own.
+	for _, key := range todoTxtTags {
+		line.SetTag(key, "")
+	}
+	if day, err := time.Parse("20060102", t.Date); err == nil {
+		line.SetTag("due", day.Format(todotxt.DateFormat))
+	}
+	if t.Repeat != "" {
+		if rec, ok := todoTxtRec(t.Date, t.Repeat); ok {
+			line.SetTag("rec", rec)
+		} else {
+			line.SetTag("repeat", strings.ReplaceAll(t.Repeat, " ", "_"))
+		}
+	}
+	line.SetTag("id", t.ID)
+	return line.String()
+}
+
+// recToRepeat translates a rec: value into a repeat rule for a task starting
+// on start. Both rec:1w and rec:+1w repeat from the due date.
+func recToRepeat(rec string, start time.Time) (string, []string) {
+	value := strings.TrimPrefix(rec, "+")
+	if value == "" {
+		return "", []string{"Bad rec:" + rec + ", the task does not repeat"}
+	}
+	unit := value[len(value)-1]
+	n := 1
+	if len(value) > 1 {
+		var err error
+		n, err = strconv.Atoi(value[:len(value)-1])
+		if err != nil || n < 1 {
+			return "", []string{"Bad rec:" + rec + ", the task does not repeat"}
+		}
+	}
+	switch unit {
+	case 'd', 'w':
+		days := n
+		if unit == 'w' {
+			if n == 1 {
+				return "w " + strconv.Itoa(int(start.Weekday())+1), nil
+			}
+			days = n * 7
+		}
+		if days > 400 {
+			return "", []string{"rec:" + rec + ": intervals over 400 days are not supported, the task does not repeat"}
+		}
+		return "d " + strconv.Itoa(days), nil
+	case 'm':
+		repeat := "m " + strconv.Itoa(start.Day())
+		if n > 1 {
+			return repeat, []string{"rec:" + rec + ": the interval is ignored, the task repeats every month"}
+		}
+		return repeat, nil
+	case 'y':
+		if n > 1 {
+			return "y", []string{"rec:" + rec + ": the interval is ignored, the task repeats every year"}
+		}
+		return "y", nil
+	}
+	return "", []string{"rec:" + rec + ": only d, w, m and y are supported, the task does not repeat"}
+}
+
+// todoTxtRow reads a line. The last +project word becomes the project and
+// the tags of this format are taken out of the title; other projects,
+// contexts and tags stay in it.
+func todoTxtRow(n int, text string) importRow {
+	row := importRow{Row: n}
+	line := todotxt.Parse(text)
+	t := ExportTask{ID: line.Tag("id")}
+	var start time.Time
+	if due := line.Tag("due"); due != "" {
+		day, err := time.Parse(todotxt.DateFormat, due)
+		if err != nil {
+			row.Warnings = append(row.Warnings, fmt.Sprintf("Bad due:%s, the date is left empty", due))
+		} else {
+			t.Date = day.Format("20060102")
+			start = day
+		}
+	}
+	if start.IsZero() {
+		start = today()
+	}
+	if repeat := line.Tag("repeat"); repeat != "" {
+		t.Repeat = strings.ReplaceAll(repeat, "_", " ")
+	} else if rec := line.Tag("rec"); rec != "" {
+		repeat, warnings := recToRepeat(rec, start)
+		t.Repeat = repeat
+		row.Warnings = append(row.Warnings, warnings...)
+	}
+	// A done line still tells which task is done, which the sync needs to
+	// move a repeating one to its next date.
+	if line.Done {
+		row.Skip = true
+		row.Warnings = append(row.Warnings, "Skipped, the task is done")
+		row.Task = t
+		return row
+	}
+
+	switch p := line.Priority; p {
+	case 0:
+	case 'A':
+		t.Priority = "3"
+	case 'B':
+		t.Priority = "2"
+	default:
+		t.Priority = "1"
+		if p != 'C' {
+			row.Warnings = append(row.Warnings, fmt.Sprintf("Priority (%c) is imported as (C)", p))
+		}
+	}
+	if line.Created != "" {
+		if created, err := time.ParseInLocation(todotxt.DateFormat, line.Created, time.Local); err == nil {
+			t.CreatedAt = created.Format(time.RFC3339)
+		}
+	}
+
+	if projects := line.Projects(); len(projects) > 0 {
+		project := projects[len(projects)-1]
+		line.Remove(project)
+		t.Project = strings.ReplaceAll(project[1:], "_", " ")
+	}
+	for _, key := range todoTxtTags {
+		line.SetTag(key, "")
+	}
+	t.Title = line.Description
+	row.Task = t
+	return row
+}
+
+// decodeTodoTxtImport reads a todo.txt file. Rows are numbered by line and
+// blank lines are ignored.
+func decodeTodoTxtImport(r io.Reader) ([]importRow, error) {
+	var rows []importRow
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportSize)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		rows = append(rows, todoTxtRow(n, scanner.Text()))
+	}
+	return rows, scanner.Err()
+}
+
+type todoTxtExport struct {
+	w io.Writer
+}
+
+func newTodoTxtExport(w io.Writer) exportEncoder {
+	return &todoTxtExport{w: w}
+}
+
+func (e *todoTxtExport) begin() error {
+	return nil
+}
+
+func (e *todoTxtExport) task(t ExportTask) error {
+	_, err := io.WriteString(e.w, todoTxtLine(t)+"\n")
+	return err
+}
+
+func (e *todoTxtExport) end() error {
+	return nil
+}
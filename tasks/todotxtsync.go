@@ -0,0 +1,384 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TodoTxtSync keeps a todo.txt file and the tasks in sync in both
+// directions. The file is polled; after every change on either side it is
+// rewritten with all tasks, each line tagged with the task id.
+//
+// The lines last written are kept in todotxt_lines with the task versions,
+// which tells which side changed a task. When both did, the database wins
+// and the line from the file is appended to <file>.rejected, so no edit is
+// lost silently. On the first sync of a file, lines that differ from the
+// database are rejected the same way.
+type TodoTxtSync struct {
+	db   *sql.DB
+	path string
+}
+
+func NewTodoTxtSync(db *sql.DB, path string) *TodoTxtSync {
+	return &TodoTxtSync{db: db, path: path}
+}
+
+// Run syncs every interval until ctx is done. Errors are logged and the
+// sync is tried again on the next tick.
+func (s *TodoTxtSync) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sync(ctx); err != nil {
+			log.Printf("todo.txt sync: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// todoTxtEntry is the line of a task and the version it was made from.
+type todoTxtEntry struct {
+	version int64
+	line    string
+}
+
+// readTodoTxt reads the file; a missing file is not an error.
+func readTodoTxt(path string) ([]byte, bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	return data, err == nil, err
+}
+
+func fileHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func syncCounter(ctx context.Context, q querier) (int64, error) {
+	var counter int64
+	err := q.QueryRowContext(ctx, "SELECT counter FROM sync_state WHERE id = 1").Scan(&counter)
+	return counter, err
+}
+
+// renderTodoTxt formats all tasks, ordered by date as in the task list.
+func renderTodoTxt(ctx context.Context, q querier) ([]int, map[int]todoTxtEntry, error) {
+	projects, err := projectNames(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := q.QueryContext(ctx, selectTask+" ORDER BY s.date, s.id")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var order []int
+	entries := make(map[int]todoTxtEntry)
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		order = append(order, task.ID)
+		entries[task.ID] = todoTxtEntry{task.Version, todoTxtLine(toExportTask(task, projects))}
+	}
+	return order, entries, rows.Err()
+}
+
+func loadTodoTxtLines(ctx context.Context, q querier) (map[int]todoTxtEntry, error) {
+	rows, err := q.QueryContext(ctx, "SELECT task_id, version, line FROM todotxt_lines")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[int]todoTxtEntry)
+	for rows.Next() {
+		var (
+			id int
+			e  todoTxtEntry
+		)
+		if err := rows.Scan(&id, &e.version, &e.line); err != nil {
+			return nil, err
+		}
+		entries[id] = e
+	}
+	return entries, rows.Err()
+}
+
+// Sync runs one round: changes in the file are applied to the database, and
+// then the file is rewritten if anything changed.
+func (s *TodoTxtSync) Sync(ctx context.Context) error {
+	data, exists, err := readTodoTxt(s.path)
+	if err != nil {
+		return err
+	}
+	hash := fileHash(data)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		path, lastHash string
+		lastCounter    int64
+	)
+	err = tx.QueryRowContext(ctx, "SELECT path, hash, counter FROM todotxt_sync WHERE id = 1").
+		Scan(&path, &lastHash, &lastCounter)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	// The lines of another file tell nothing about this one.
+	known := err == nil && path == s.path
+	counter, err := syncCounter(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if known && exists && hash == lastHash && counter == lastCounter {
+		return nil
+	}
+
+	baseline := make(map[int]todoTxtEntry)
+	if known {
+		if baseline, err = loadTodoTxtLines(ctx, tx); err != nil {
+			return err
+		}
+	}
+	var rejected []string
+	if exists && (!known || hash != lastHash) {
+		if rejected, err = s.apply(ctx, tx, string(data), baseline); err != nil {
+			return err
+		}
+	}
+
+	order, entries, err := renderTodoTxt(ctx, tx)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, id := range order {
+		b.WriteString(entries[id].line + "\n")
+	}
+	content := b.String()
+	write := !exists || content != string(data)
+	if write {
+		// The file may have changed while this round ran; its changes are
+		// picked up by the next one.
+		current, stillExists, err := readTodoTxt(s.path)
+		if err != nil {
+			return err
+		}
+		if stillExists != exists || !bytes.Equal(current, data) {
+			return nil
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM todotxt_lines"); err != nil {
+		return err
+	}
+	for id, e := range entries {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO todotxt_lines (task_id, version, line) VALUES (?, ?, ?)", id, e.version, e.line); err != nil {
+			return err
+		}
+	}
+	if counter, err = syncCounter(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO todotxt_sync (id, path, hash, counter) VALUES (1, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET path = excluded.path, hash = excluded.hash, counter = excluded.counter`,
+		s.path, fileHash([]byte(content)), counter); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// The file is written only once the database has what it holds.
+	if write {
+		if err := writeFileAtomic(s.path, content); err != nil {
+			// The file as it is has been applied, but not rewritten: the
+			// next round takes it as known and writes it again.
+			_, resetErr := s.db.ExecContext(ctx, "UPDATE todotxt_sync SET hash = ?, counter = -1 WHERE id = 1", hash)
+			return errors.Join(err, resetErr)
+		}
+	}
+	if len(rejected) > 0 {
+		return appendLines(s.path+".rejected", rejected)
+	}
+	return nil
+}
+
+// apply applies the lines of the file to the database and returns the
+// rejected ones.
+func (s *TodoTxtSync) apply(ctx context.Context, tx *sql.Tx, data string, baseline map[int]todoTxtEntry) ([]string, error) {
+	_, current, err := renderTodoTxt(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Local().Truncate(24 * time.Hour)
+	im := &importer{ctx: ctx, q: tx, now: now, keepDetails: true}
+
+	var rejected []string
+	reject := func(text, reason string) {
+		log.Printf("todo.txt sync: %s, the line is rejected: %s", reason, text)
+		rejected = append(rejected, text)
+	}
+	seen := make(map[int]bool)
+	for n, text := range strings.Split(data, "\n") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		row := todoTxtRow(n+1, text)
+		id, _ := strconv.Atoi(row.Task.ID)
+		cur, exists := current[id]
+		base, based := baseline[id]
+		if exists {
+			seen[id] = true
+		}
+
+		var change func() error
+		switch {
+		case exists && (text == cur.line || based && text == base.line):
+			// Unchanged in the file; changes in the database are written
+			// back below.
+			continue
+		case exists && (!based || cur.version != base.version):
+			reject(text, "the task was changed in the database")
+			continue
+		case exists && row.Skip:
+			change = func() error { return markTaskDone(ctx, tx, row.Task.ID, now.UTC()) }
+		case exists:
+			change = func() error { return s.update(ctx, im, row.Task) }
+		case based:
+			if text != base.line {
+				reject(text, "the task was deleted in the database")
+			}
+			continue
+		case row.Skip:
+			// A new line that is already done.
+			continue
+		default:
+			row.Task.ID = ""
+			change = func() error {
+				_, err := im.apply(row.Task)
+				return err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT todotxt_line"); err != nil {
+			return nil, err
+		}
+		err := change()
+		if err != nil {
+			if storeErrorStatus(err) == http.StatusInternalServerError {
+				return nil, err
+			}
+			reject(text, err.Error())
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO todotxt_line")
+		}
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "RELEASE todotxt_line")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Lines removed from the file delete their tasks, unless the tasks were
+	// changed in the database since.
+	for id, base := range baseline {
+		cur, exists := current[id]
+		if !exists || seen[id] {
+			continue
+		}
+		if cur.version != base.version {
+			log.Printf("todo.txt sync: task %d was removed from the file but changed in the database, it is kept", id)
+			continue
+		}
+		if err := deleteTask(ctx, tx, strconv.Itoa(id), ""); err != nil {
+			return nil, err
+		}
+	}
+	return rejected, nil
+}
+
+// update applies a changed line. The comment is kept, and a line without a
+// project moves the task out of its project.
+func (s *TodoTxtSync) update(ctx context.Context, im *importer, t ExportTask) error {
+	task, err := getTask(ctx, im.q, t.ID)
+	if err != nil {
+		return err
+	}
+	current := toJSONTask(task)
+	t.Comment = current.Comment
+	patch, err := im.changes(current, t)
+	if err != nil {
+		return err
+	}
+	if t.Project == "" && current.ProjectID != "" {
+		patch["project_id"] = json.RawMessage(`""`)
+	}
+	return patchTask(ctx, im.q, t.ID, patch, "", im.now)
+}
+
+// writeFileAtomic replaces the file by renaming a temporary one, so editors
+// and readers never see it half written. The mode of the file is kept.
+func writeFileAtomic(path, content string) error {
+	mode := fs.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func appendLines(path string, lines []string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,427 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"main.go/audit"
+)
+
+// UndoHeader carries the token that undoes the operation of a response.
+const UndoHeader = "X-Undo-Token"
+
+const defUndoWindow = 5 * time.Minute
+
+var errUndoExpired = errors.New("Nothing to undo: the token is unknown or expired")
+
+type UndoRequest struct {
+	Token string `json:"token"`
+}
+
+// UndoResponse tells what was undone. Task is the restored task and is left
+// out when the undo deleted a created task. Undoing a batch gives the
+// restored tasks in Tasks instead.
+type UndoResponse struct {
+	Op    string     `json:"op"`
+	Task  *JSONTask  `json:"task,omitempty"`
+	Tasks []JSONTask `json:"tasks,omitempty"`
+}
+
+// UndoWindow is how long undo tokens stay valid, set by TODO_UNDO_WINDOW.
+func UndoWindow() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("TODO_UNDO_WINDOW"))
+	if err != nil || d <= 0 {
+		return defUndoWindow
+	}
+	return d
+}
+
+// undoState is a task as it was before an operation. Checklist is kept only
+// for operations that change it, deleting and marking done, so undoing an
+// edit doesn't touch the checklist. Revisions are kept with it, as deleting
+// the task deletes them.
+type undoState struct {
+	Date         string         `json:"date"`
+	Title        string         `json:"title"`
+	Comment      string         `json:"comment"`
+	Repeat       string         `json:"repeat"`
+	ProjectID    int64          `json:"project_id"`
+	Priority     int            `json:"priority"`
+	RemindBefore int            `json:"remind_before"`
+	CreatedAt    int64          `json:"created_at"`
+	Version      int64          `json:"version"`
+	Checklist    []undoItem     `json:"checklist,omitempty"`
+	Revisions    []undoRevision `json:"revisions,omitempty"`
+	DAVName      string         `json:"dav_name,omitempty"`
+	DAVUID       string         `json:"dav_uid,omitempty"`
+}
+
+type undoItem struct {
+	ID       int64  `json:"id"`
+	Position int    `json:"position"`
+	Text     string `json:"text"`
+	Done     bool   `json:"done"`
+}
+
+type undoRevision struct {
+	ID        int64  `json:"id"`
+	Version   int64  `json:"version"`
+	SavedAt   int64  `json:"saved_at"`
+	Date      string `json:"date"`
+	Title     string `json:"title"`
+	Comment   string `json:"comment"`
+	Repeat    string `json:"repeat"`
+	ProjectID int64  `json:"project_id"`
+	Priority  int    `json:"priority"`
+}
+
+// snapshotTask reads the state of the task id before an operation.
+func snapshotTask(ctx context.Context, q querier, id string, checklist bool) (*undoState, error) {
+	task, err := getTask(ctx, q, id)
+	if err == sql.ErrNoRows {
+		return nil, errTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &undoState{
+		Date: task.Date, Title: task.Title, Comment: task.Comment, Repeat: task.Repeat,
+		ProjectID: task.ProjectID, Priority: task.Priority, CreatedAt: task.CreatedAt, Version: task.Version,
+		RemindBefore: task.RemindBefore,
+	}
+	if !checklist {
+		return s, nil
+	}
+
+	rows, err := q.QueryContext(ctx,
+		"SELECT id, position, text, done FROM checklist_items WHERE task_id = ? ORDER BY position, id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item undoItem
+		if err := rows.Scan(&item.ID, &item.Position, &item.Text, &item.Done); err != nil {
+			return nil, err
+		}
+		s.Checklist = append(s.Checklist, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if s.Revisions, err = snapshotRevisions(ctx, q, id); err != nil {
+		return nil, err
+	}
+	err = q.QueryRowContext(ctx, "SELECT name, uid FROM dav_objects WHERE task_id = ?", id).Scan(&s.DAVName, &s.DAVUID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return s, nil
+}
+
+// undoStep is one task changed by a batch: its state before the first
+// operation on it and its version after the last one.
+type undoStep struct {
+	ID      string     `json:"id"`
+	Version int64      `json:"version"`
+	Before  *undoState `json:"before"`
+}
+
+func snapshotRevisions(ctx context.Context, q querier, id string) ([]undoRevision, error) {
+	rows, err := q.QueryContext(ctx,
+		`SELECT id, version, saved_at, date, title, comment, repeat, project_id, priority
+		FROM task_revisions WHERE task_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revisions []undoRevision
+	for rows.Next() {
+		var r undoRevision
+		if err := rows.Scan(&r.ID, &r.Version, &r.SavedAt, &r.Date, &r.Title, &r.Comment, &r.Repeat,
+			&r.ProjectID, &r.Priority); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+// currentVersion is the version of the task id, or 0 if there is none.
+func currentVersion(ctx context.Context, q querier, id string) (int64, error) {
+	task, err := getTask(ctx, q, id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return task.Version, err
+}
+
+// recordUndo stores how to undo op, which changed the task id from before
+// (nil for a created task), and returns the undo token. It runs in the
+// transaction of the operation, after it.
+func recordUndo(ctx context.Context, q querier, op, id string, before *undoState) (string, error) {
+	version, err := currentVersion(ctx, q, id)
+	if err != nil {
+		return "", err
+	}
+	return insertUndo(ctx, q, op, id, version, before)
+}
+
+// recordBatchUndo stores how to undo a batch that changed the tasks ids,
+// given in the order of their first operation, from the states in before,
+// and returns the one token for all of them.
+func recordBatchUndo(ctx context.Context, q querier, ids []string, before map[string]*undoState) (string, error) {
+	steps := make([]undoStep, 0, len(ids))
+	for _, id := range ids {
+		version, err := currentVersion(ctx, q, id)
+		if err != nil {
+			return "", err
+		}
+		steps = append(steps, undoStep{ID: id, Version: version, Before: before[id]})
+	}
+	return insertUndo(ctx, q, "batch", "0", 0, steps)
+}
+
+func insertUndo(ctx context.Context, q querier, op, id string, version int64, state any) (string, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if _, err := q.ExecContext(ctx, "DELETE FROM undo_log WHERE expires_at < ?", now.Unix()); err != nil {
+		return "", err
+	}
+	_, err = q.ExecContext(ctx,
+		"INSERT INTO undo_log (token, task_id, op, version, state, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		token, id, op, version, string(data), now.Add(UndoWindow()).Unix())
+	return token, err
+}
+
+// undo reverts the operation of token, provided the tasks are as the
+// operation left them, and returns the operation and the task ids. On a
+// conflict the ids hold just the changed task.
+func undo(ctx context.Context, q querier, token string) (string, []string, error) {
+	var (
+		id, op, state string
+		version       int64
+	)
+	err := q.QueryRowContext(ctx,
+		"SELECT task_id, op, version, state FROM undo_log WHERE token = ? AND expires_at >= ?",
+		token, time.Now().Unix()).Scan(&id, &op, &version, &state)
+	if err == sql.ErrNoRows {
+		return "", nil, errUndoExpired
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var steps []undoStep
+	if op == "batch" {
+		err = json.Unmarshal([]byte(state), &steps)
+	} else {
+		steps = []undoStep{{ID: id, Version: version}}
+		err = json.Unmarshal([]byte(state), &steps[0].Before)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	// All tasks are checked before any is reverted.
+	exists := make([]bool, len(steps))
+	for i, step := range steps {
+		current, err := currentVersion(ctx, q, step.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		if current != step.Version {
+			if current == 0 {
+				return op, []string{step.ID}, errTaskNotFound
+			}
+			return op, []string{step.ID}, errVersionConflict
+		}
+		exists[i] = current != 0
+	}
+	ids := make([]string, 0, len(steps))
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		switch {
+		case step.Before == nil && !exists[i]:
+			// Created and deleted again by the same batch.
+			continue
+		case step.Before == nil:
+			err = deleteTask(ctx, q, step.ID, "")
+		default:
+			err = restoreTask(ctx, q, step.ID, step.Before, exists[i])
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		ids = append(ids, step.ID)
+	}
+	_, err = q.ExecContext(ctx, "DELETE FROM undo_log WHERE token = ?", token)
+	return op, ids, err
+}
+
+// restoreTask puts the task id back into state s, inserting it again if it
+// was deleted. The stored state was valid when taken, so it is not validated
+// again; a task due in the past stays there. A project deleted since is
+// replaced with the inbox.
+func restoreTask(ctx context.Context, q querier, id string, s *undoState, exists bool) error {
+	if err := checkProject(ctx, q, s.ProjectID); errors.Is(err, errProjectNotFound) {
+		s.ProjectID = 0
+	} else if err != nil {
+		return err
+	}
+	if exists {
+		current, err := getTask(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, "UPDATE scheduler SET date = ?, title = ?, comment = ?, repeat = ? WHERE id = ?",
+			s.Date, s.Title, s.Comment, s.Repeat, id)
+		if err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, "UPDATE task_meta SET project_id = ?, priority = ?, remind_before = ? WHERE task_id = ?",
+			s.ProjectID, s.Priority, s.RemindBefore, id)
+		if err != nil {
+			return err
+		}
+		for _, item := range s.Checklist {
+			_, err := q.ExecContext(ctx, "UPDATE checklist_items SET done = ? WHERE id = ? AND task_id = ?",
+				item.Done, item.ID, id)
+			if err != nil {
+				return err
+			}
+		}
+		if err := recordTaskEvent(ctx, q, EventUpdated, id); err != nil {
+			return err
+		}
+		return saveRevision(ctx, q, current)
+	}
+
+	_, err := q.ExecContext(ctx, "INSERT INTO scheduler (id, date, title, comment, repeat) VALUES (?, ?, ?, ?, ?)",
+		id, s.Date, s.Title, s.Comment, s.Repeat)
+	if err != nil {
+		return err
+	}
+	// The version goes on from the deleted one, so tags of the old task
+	// don't match the restored one by chance.
+	_, err = q.ExecContext(ctx,
+		"UPDATE task_meta SET project_id = ?, priority = ?, remind_before = ?, created_at = ?, version = ? WHERE task_id = ?",
+		s.ProjectID, s.Priority, s.RemindBefore, s.CreatedAt, s.Version+1, id)
+	if err != nil {
+		return err
+	}
+	for _, item := range s.Checklist {
+		_, err := q.ExecContext(ctx,
+			"INSERT INTO checklist_items (id, task_id, position, text, done) VALUES (?, ?, ?, ?, ?)",
+			item.ID, id, item.Position, item.Text, item.Done)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range s.Revisions {
+		_, err := q.ExecContext(ctx,
+			`INSERT INTO task_revisions (id, task_id, version, saved_at, date, title, comment, repeat, project_id, priority)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			r.ID, id, r.Version, r.SavedAt, r.Date, r.Title, r.Comment, r.Repeat, r.ProjectID, r.Priority)
+		if err != nil {
+			return err
+		}
+	}
+	if s.DAVName != "" {
+		_, err = q.ExecContext(ctx, "INSERT OR IGNORE INTO dav_objects (task_id, name, uid) VALUES (?, ?, ?)",
+			id, s.DAVName, s.DAVUID)
+		if err != nil {
+			return err
+		}
+	}
+	return recordTaskEvent(ctx, q, EventCreated, id)
+}
+
+// respondWithUndo records how to undo op and sends the token in the
+// X-Undo-Token header. It reports false after responding with an error.
+func respondWithUndo(w http.ResponseWriter, r *http.Request, q querier, op, id string, before *undoState) bool {
+	token, err := recordUndo(r.Context(), q, op, id, before)
+	if err != nil {
+		log.Printf("Undo: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return false
+	}
+	w.Header().Set(UndoHeader, token)
+	return true
+}
+
+// UndoHandler serves POST /api/undo with the token of the X-Undo-Token
+// header of an earlier response. The operation is reverted only if the task
+// wasn't changed since; otherwise the response is 409 with the current task.
+// A batch is reverted as a whole, or not at all if any of its tasks changed.
+func UndoHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		var req UndoRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			respondWithError(w, http.StatusBadRequest, "Missed token")
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer tx.Rollback()
+
+		op, ids, err := undo(r.Context(), tx, req.Token)
+		switch {
+		case errors.Is(err, errUndoExpired):
+			respondWithError(w, http.StatusGone, err.Error())
+			return
+		case errors.Is(err, errVersionConflict):
+			respondWithConflict(r.Context(), w, tx, http.StatusConflict, ids[0])
+			return
+		case err != nil:
+			respondWithStoreError(w, err)
+			return
+		}
+		audit.SetTaskID(r.Context(), ids...)
+
+		resp := UndoResponse{Op: op}
+		for _, id := range ids {
+			task, err := getTask(r.Context(), tx, id)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			if op == "batch" {
+				resp.Tasks = append(resp.Tasks, toJSONTask(task))
+				continue
+			}
+			jt := toJSONTask(task)
+			resp.Task = &jt
+			w.Header().Set("ETag", etag(task.Version))
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
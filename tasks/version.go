@@ -0,0 +1,71 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ConflictResponse is sent when a task was changed since the client read it.
+// Task holds the current state, so the client can merge and retry.
+type ConflictResponse struct {
+	Error string   `json:"error"`
+	Task  JSONTask `json:"task"`
+}
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// requireIfMatch reports whether PUT and DELETE must name the version they
+// change. It is off by default so that existing clients keep working.
+func requireIfMatch() bool {
+	v, _ := strconv.ParseBool(os.Getenv("TODO_REQUIRE_IF_MATCH"))
+	return v
+}
+
+// expectedVersion returns the version a PUT or DELETE is based on, taken
+// from the If-Match header or else from the version field of the body, and
+// the status to report a conflict with: 412 for the header and 409 for the
+// field. An empty version means any, which is allowed for If-Match: * and,
+// unless TODO_REQUIRE_IF_MATCH is set, when neither is given.
+func expectedVersion(r *http.Request, field string) (string, int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		if field == "" && requireIfMatch() {
+			return "", http.StatusPreconditionRequired, errors.New("If-Match header or version is required")
+		}
+		return field, http.StatusConflict, nil
+	}
+	if header == "*" {
+		return "", http.StatusPreconditionFailed, nil
+	}
+	version := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	if v, err := strconv.ParseInt(version, 10, 64); err != nil || v < 1 {
+		// A tag this server never issued cannot match.
+		return "", http.StatusPreconditionFailed, errVersionConflict
+	}
+	return version, http.StatusPreconditionFailed, nil
+}
+
+// respondWithConflict reports errVersionConflict with the given status and
+// the current state of the task.
+func respondWithConflict(ctx context.Context, w http.ResponseWriter, q querier, status int, id string) {
+	task, err := getTask(ctx, q, id)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, errTaskNotFound.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("ETag", etag(task.Version))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ConflictResponse{Error: errVersionConflict.Error(), Task: toJSONTask(task)})
+}
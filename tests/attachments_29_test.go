@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+type attachment struct {
+	ID          string `json:"id"`
+	TaskID      string `json:"task_id"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Error       string `json:"error"`
+}
+
+func uploadAttachment(t *testing.T, taskID, name string, data []byte) (int, attachment) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", name)
+	assert.NoError(t, err)
+	fw.Write(data)
+	assert.NoError(t, mw.Close())
+
+	req, err := http.NewRequest(http.MethodPost, getURL("api/task/attachments?task_id="+taskID), &body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	signIn(t, req)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var a attachment
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&a))
+	return resp.StatusCode, a
+}
+
+func listAttachments(t *testing.T, taskID string) []attachment {
+	status, body := adminRequest(t, http.MethodGet, "api/task/attachments?task_id="+taskID)
+	assert.Equal(t, http.StatusOK, status)
+	var resp struct {
+		Attachments []attachment `json:"attachments"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &resp))
+	return resp.Attachments
+}
+
+func TestAttachments(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	id := addTask(t, task{date: "20300101", title: "Оплатить счёт"})
+	pdf := []byte("%PDF-1.4\n1 0 obj\n<< >>\nendobj\ntrailer\n<< >>\n%%EOF\n")
+	status, a := uploadAttachment(t, id, `C:\docs\счёт №5.pdf`, pdf)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "счёт №5.pdf", a.Name)
+	assert.Equal(t, "application/pdf", a.ContentType)
+	assert.Equal(t, int64(len(pdf)), a.Size)
+	assert.Len(t, listAttachments(t, id), 1)
+
+	req, err := http.NewRequest(http.MethodGet, getURL("api/task/attachments/file?id="+a.ID), nil)
+	assert.NoError(t, err)
+	signIn(t, req)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, pdf, data)
+	assert.Equal(t, "application/pdf", resp.Header.Get("Content-Type"))
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), "attachment")
+
+	if env, _ := godotenv.Read("../.env"); env["TODO_PASSWORD"] != "" {
+		resp, err := http.Get(getURL("api/task/attachments/file?id=" + a.ID))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// The type is taken from the contents, not from the name.
+	status, _ = uploadAttachment(t, id, "photo.png", []byte("<html><script>alert(1)</script></html>"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, status)
+	status, _ = uploadAttachment(t, "999999999", "note.txt", []byte("text"))
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, note := uploadAttachment(t, id, "note.txt", []byte("Номер договора 42"))
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "text/plain", note.ContentType)
+	status, _ = adminRequest(t, http.MethodDelete, "api/task/attachments?id="+note.ID)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, listAttachments(t, id), 1)
+
+	// Attachments of a deleted task wait until the deletion can't be undone.
+	token := undoToken(t, http.MethodDelete, "api/task?id="+id, nil)
+	var orphaned int64
+	assert.NoError(t, db.Get(&orphaned, "SELECT orphaned_at FROM attachments WHERE id = ?", a.ID))
+	assert.NotZero(t, orphaned)
+	status, _ = adminRequest(t, http.MethodGet, "api/task/attachments/file?id="+a.ID)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = undo(t, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, listAttachments(t, id), 1)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
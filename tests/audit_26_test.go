@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+type auditEntry struct {
+	ID       int64  `json:"id"`
+	At       string `json:"at"`
+	IP       string `json:"ip"`
+	Session  string `json:"session"`
+	Method   string `json:"method"`
+	Endpoint string `json:"endpoint"`
+	TaskID   string `json:"task_id"`
+	Status   int    `json:"status"`
+	Outcome  string `json:"outcome"`
+}
+
+// auditEntries returns the entries newer than after. Task ids can come
+// again after a backup is restored, so older entries are left out.
+func auditEntries(t *testing.T, after int64, query string) []auditEntry {
+	status, body := adminRequest(t, http.MethodGet, "api/audit?"+query)
+	assert.Equal(t, http.StatusOK, status)
+	var resp struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &resp))
+	var entries []auditEntry
+	for _, e := range resp.Entries {
+		if e.ID > after {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+	var last int64
+	assert.NoError(t, db.Get(&last, "SELECT COALESCE(MAX(id), 0) FROM audit_log"))
+
+	id := addTask(t, task{date: "20300101", title: "Проверить журнал", repeat: "d 1"})
+	_, err = postJSON("api/task", map[string]any{
+		"id": id, "date": "20300102", "title": "Проверить журнал", "repeat": "d 5",
+	}, http.MethodPut)
+	assert.NoError(t, err)
+	_, err = postJSON("api/task/done?id="+id, nil, http.MethodPost)
+	assert.NoError(t, err)
+	_, err = postJSON("api/task?id="+id, nil, http.MethodDelete)
+	assert.NoError(t, err)
+
+	entries := auditEntries(t, last, "task_id="+id)
+	assert.Len(t, entries, 4)
+	// Newest first.
+	want := []struct{ method, endpoint string }{
+		{http.MethodDelete, "/api/task"},
+		{http.MethodPost, "/api/task/done"},
+		{http.MethodPut, "/api/task"},
+		{http.MethodPost, "/api/task"},
+	}
+	for i, e := range entries {
+		if i >= len(want) {
+			break
+		}
+		assert.Equal(t, want[i].method, e.Method)
+		assert.Equal(t, want[i].endpoint, e.Endpoint)
+		assert.Equal(t, "success", e.Outcome)
+		assert.NotEmpty(t, e.IP)
+		assert.NotEmpty(t, e.At)
+	}
+	// A failed change is recorded too.
+	_, err = postJSON("api/task?id="+id, nil, http.MethodDelete)
+	assert.NoError(t, err)
+	entries = auditEntries(t, last, "task_id="+id+"&outcome=failure")
+	assert.Len(t, entries, 1)
+
+	// Reading is not recorded.
+	getTasks(t, "")
+	entries = auditEntries(t, last, "endpoint=/api/tasks&method=GET")
+	assert.Empty(t, entries)
+
+	if env, _ := godotenv.Read("../.env"); env["TODO_PASSWORD"] != "" {
+		body, _ := json.Marshal(map[string]string{"password": "wrong"})
+		resp, err := http.Post(getURL("api/signin"), "application/json", bytes.NewReader(body))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		entries = auditEntries(t, last, "endpoint=/api/signin&limit=2")
+		// The newest sign-in is the one of auditEntries.
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, "success", entries[0].Outcome)
+			assert.Regexp(t, `^token:[0-9a-f]{12}$`, entries[0].Session)
+			assert.Equal(t, "denied", entries[1].Outcome)
+			assert.Equal(t, http.StatusUnauthorized, entries[1].Status)
+		}
+
+		// The log itself needs the token.
+		resp, err = http.Get(getURL("api/audit"))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	status, body := adminRequest(t, http.MethodGet, "api/audit?format=jsonl&task_id="+id+"&from="+time.Now().Format("20060102"))
+	assert.Equal(t, http.StatusOK, status)
+	var lines int
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var e auditEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		assert.Equal(t, id, e.TaskID)
+		if e.ID > last {
+			lines++
+		}
+	}
+	assert.Equal(t, 5, lines)
+
+	status, _ = adminRequest(t, http.MethodGet, "api/audit?from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
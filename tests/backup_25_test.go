@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+
+	"main.go/database"
+)
+
+type backupSnapshot struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// signIn adds the token of /api/signin to req, if the server has a
+// password.
+func signIn(t *testing.T, req *http.Request) {
+	env, _ := godotenv.Read("../.env")
+	if env["TODO_PASSWORD"] == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"password": env["TODO_PASSWORD"]})
+	resp, err := http.Post(getURL("api/signin"), "application/json", bytes.NewReader(body))
+	assert.NoError(t, err)
+	var signin struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&signin))
+	resp.Body.Close()
+	req.AddCookie(&http.Cookie{Name: "token", Value: signin.Token})
+}
+
+// adminRequest sends a request signed in with signIn.
+func adminRequest(t *testing.T, method, path string) (int, []byte) {
+	req, err := http.NewRequest(method, getURL(path), nil)
+	assert.NoError(t, err)
+	signIn(t, req)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, data
+}
+
+func backupDir() string {
+	if envDir := os.Getenv("TODO_BACKUP_DIR"); envDir != "" {
+		return envDir
+	}
+	return BackupDir
+}
+
+func listBackups(t *testing.T) map[string]bool {
+	status, body := adminRequest(t, http.MethodGet, "api/backups")
+	assert.Equal(t, http.StatusOK, status)
+	var list struct {
+		Backups []backupSnapshot `json:"backups"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &list))
+	names := make(map[string]bool)
+	for _, s := range list.Backups {
+		names[s.Name] = true
+	}
+	return names
+}
+
+func TestBackupRestore(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	if env, _ := godotenv.Read("../.env"); env["TODO_PASSWORD"] != "" {
+		resp, err := http.Post(getURL("api/backups"), "application/json", nil)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	kept := addTask(t, task{date: "20300101", title: "До снимка"})
+	status, body := adminRequest(t, http.MethodPost, "api/backups")
+	assert.Equal(t, http.StatusCreated, status)
+	var snap backupSnapshot
+	assert.NoError(t, json.Unmarshal(body, &snap))
+	assert.Regexp(t, `^scheduler-\d{8}-\d{6}(-\d+)?\.db$`, snap.Name)
+	assert.Greater(t, snap.Size, int64(0))
+	assert.True(t, listBackups(t)[snap.Name])
+
+	added := addTask(t, task{date: "20300101", title: "После снимка"})
+	var counter int64
+	assert.NoError(t, db.Get(&counter, "SELECT counter FROM sync_state"))
+
+	status, body = adminRequest(t, http.MethodPost, "api/backups/restore?name="+snap.Name)
+	assert.Equal(t, http.StatusOK, status)
+	var restored struct {
+		Restored string         `json:"restored"`
+		Before   backupSnapshot `json:"before"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &restored))
+	assert.Equal(t, snap.Name, restored.Restored)
+	assert.NotEmpty(t, restored.Before.Name)
+
+	var ids []string
+	assert.NoError(t, db.Select(&ids, "SELECT id FROM scheduler"))
+	assert.Equal(t, []string{kept}, ids)
+	// Sync clients must not see the counter go back.
+	var after int64
+	assert.NoError(t, db.Get(&after, "SELECT counter FROM sync_state"))
+	assert.Greater(t, after, counter)
+
+	// The state before the restore is a snapshot of its own.
+	status, _ = adminRequest(t, http.MethodPost, "api/backups/restore?name="+restored.Before.Name)
+	assert.Equal(t, http.StatusOK, status)
+	ids = nil
+	assert.NoError(t, db.Select(&ids, "SELECT id FROM scheduler ORDER BY id"))
+	assert.Equal(t, []string{kept, added}, ids)
+
+	// A broken snapshot is refused and the database stays as it is.
+	broken := "scheduler-20000101-000000.db"
+	assert.NoError(t, os.WriteFile(filepath.Join(backupDir(), broken), []byte("not a database"), 0o644))
+	status, _ = adminRequest(t, http.MethodPost, "api/backups/restore?name="+broken)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	ids = nil
+	assert.NoError(t, db.Select(&ids, "SELECT id FROM scheduler ORDER BY id"))
+	assert.Equal(t, []string{kept, added}, ids)
+
+	status, _ = adminRequest(t, http.MethodPost, "api/backups/restore?name=../scheduler.db")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	for name := range listBackups(t) {
+		status, _ = adminRequest(t, http.MethodDelete, "api/backups?name="+name)
+		assert.Equal(t, http.StatusOK, status)
+	}
+	assert.Empty(t, listBackups(t))
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
+
+// tempDB creates a database of the current schema in a temporary directory,
+// for tests that call the packages directly instead of the server.
+func tempDB(t *testing.T) *sql.DB {
+	t.Setenv("TODO_DBFILE", filepath.Join(t.TempDir(), "scheduler.db"))
+	db, err := database.InitDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestRestoreEscapedPath(t *testing.T) {
+	db := tempDB(t)
+	ctx := context.Background()
+
+	_, err := db.Exec("INSERT INTO scheduler (date, title) VALUES ('20300101', 'До снимка')")
+	assert.NoError(t, err)
+	// The path of a snapshot is put into a URI, where ? and # have a meaning.
+	dir := filepath.Join(t.TempDir(), "снимки?раз#два")
+	assert.NoError(t, os.Mkdir(dir, 0o755))
+	path := filepath.Join(dir, "scheduler.db")
+	assert.NoError(t, database.Snapshot(ctx, db, path))
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+	assert.NoError(t, database.Restore(ctx, db, path))
+	var title string
+	assert.NoError(t, db.QueryRow("SELECT title FROM scheduler").Scan(&title))
+	assert.Equal(t, "До снимка", title)
+}
+
+func TestRestoreKeepsDeliveries(t *testing.T) {
+	db := tempDB(t)
+	ctx := context.Background()
+
+	_, err := db.Exec("INSERT INTO scheduler (id, date, title) VALUES (1, '20300101', 'Позвонить')")
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO reminder_deliveries (key, notifier, task_id, date, payload, created_at)
+		VALUES ('1:20300101:due', 'webhook', 1, '20300101', '{}', 1)`)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "scheduler.db")
+	assert.NoError(t, database.Snapshot(ctx, db, path))
+
+	// Sent after the snapshot: restoring it must not queue the reminder again.
+	_, err = db.Exec("UPDATE reminder_deliveries SET status = 'sent', attempts = 1, sent_at = 2")
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO reminder_deliveries (key, notifier, task_id, date, payload, status, created_at)
+		VALUES ('1:20300101:before', 'webhook', 1, '20300101', '{}', 'sent', 2)`)
+	assert.NoError(t, err)
+
+	assert.NoError(t, database.Restore(ctx, db, path))
+	var pending, sent int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM reminder_deliveries WHERE status = 'pending'").Scan(&pending))
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM reminder_deliveries WHERE status = 'sent'").Scan(&sent))
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, 2, sent)
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type batchResponse struct {
+	Applied bool `json:"applied"`
+	Results []struct {
+		ID    string `json:"id"`
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	} `json:"results"`
+}
+
+func postBatch(t *testing.T, batch map[string]any) batchResponse {
+	body, err := requestJSON("api/tasks/batch", batch, http.MethodPost)
+	assert.NoError(t, err)
+	var ret batchResponse
+	assert.NoError(t, json.Unmarshal(body, &ret))
+	return ret
+}
+
+func TestBatch(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	keep := addTask(t, task{title: "Останется", repeat: "d 2"})
+	gone := addTask(t, task{title: "Удалится"})
+
+	ret := postBatch(t, map[string]any{
+		"operations": []map[string]any{
+			{"op": "create", "task": map[string]any{"title": "Новая"}},
+			{"op": "delete", "id": gone},
+			{"op": "update", "task": map[string]any{"id": keep, "title": ""}},
+		},
+	})
+	assert.False(t, ret.Applied)
+	assert.Equal(t, 3, len(ret.Results))
+	assert.NotEmpty(t, ret.Results[2].Error)
+	cnt, err := count(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cnt)
+
+	ret = postBatch(t, map[string]any{
+		"operations": []map[string]any{
+			{"op": "create", "task": map[string]any{"title": "Новая"}},
+			{"op": "delete", "id": gone},
+			{"op": "delete", "id": "99999999"},
+		},
+	})
+	assert.False(t, ret.Applied)
+	cnt, err = count(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cnt)
+
+	ret = postBatch(t, map[string]any{
+		"mode": "best_effort",
+		"operations": []map[string]any{
+			{"op": "create", "task": map[string]any{"title": "Новая"}},
+			{"op": "delete", "id": gone},
+			{"op": "delete", "id": "99999999"},
+			{"op": "done", "id": keep},
+			{"op": "jump"},
+		},
+	})
+	assert.True(t, ret.Applied)
+	if assert.Equal(t, 5, len(ret.Results)) {
+		assert.True(t, ret.Results[0].OK)
+		assert.NotEmpty(t, ret.Results[0].ID)
+		assert.True(t, ret.Results[1].OK)
+		assert.False(t, ret.Results[2].OK)
+		assert.True(t, ret.Results[3].OK)
+		assert.False(t, ret.Results[4].OK)
+	}
+	cnt, err = count(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cnt)
+	notFoundTask(t, gone)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,260 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+func davRequest(t *testing.T, method, path, body string, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, getURL(path), strings.NewReader(body))
+	assert.NoError(t, err)
+	env, _ := godotenv.Read("../.env")
+	req.SetBasicAuth("tasks", env["TODO_PASSWORD"])
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp, strings.ReplaceAll(string(data), "\r\n ", "")
+}
+
+var ctagRe = regexp.MustCompile(`<cs:getctag>([^<]*)</cs:getctag>`)
+
+func davCTag(t *testing.T) string {
+	resp, body := davRequest(t, "PROPFIND", "dav/tasks/",
+		`<d:propfind xmlns:d="DAV:" xmlns:cs="http://calendarserver.org/ns/"><d:prop><cs:getctag/></d:prop></d:propfind>`,
+		map[string]string{"Depth": "0"})
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	m := ctagRe.FindStringSubmatch(body)
+	if assert.NotNil(t, m) {
+		return m[1]
+	}
+	return ""
+}
+
+func TestCalDAV(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest("PROPFIND", getURL("dav/tasks/"), nil)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	if env, _ := godotenv.Read("../.env"); env["TODO_PASSWORD"] != "" {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	date := time.Now().AddDate(0, 0, 3).Format("20060102")
+	id := addTask(t, task{date: date, title: "Купить хлеб"})
+
+	resp, body := davRequest(t, "PROPFIND", "dav/tasks/",
+		`<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/><d:resourcetype/></d:prop></d:propfind>`,
+		map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	assert.Contains(t, body, "<d:href>/dav/tasks/"+id+".ics</d:href>")
+	assert.Contains(t, body, "calendar")
+	ctag := davCTag(t)
+
+	resp, body = davRequest(t, http.MethodGet, "dav/tasks/"+id+".ics", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "BEGIN:VTODO\r\n")
+	assert.Contains(t, body, "DUE;VALUE=DATE:"+date+"\r\n")
+	assert.Contains(t, body, "SUMMARY:Купить хлеб\r\n")
+
+	// A new task from a client keeps the client's name and UID.
+	todo := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\nBEGIN:VTODO\r\n" +
+		"UID:0b7c5f0e-client@example.com\r\nSUMMARY:Позвонить\r\nDUE;VALUE=DATE:" + date + "\r\n" +
+		"PRIORITY:1\r\nCATEGORIES:Дом\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"
+	resp, _ = davRequest(t, http.MethodPut, "dav/tasks/client-1.ics", todo,
+		map[string]string{"If-None-Match": "*", "Content-Type": "text/calendar"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEqual(t, ctag, davCTag(t))
+
+	resp, _ = davRequest(t, http.MethodPut, "dav/tasks/client-1.ics", todo,
+		map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, body = davRequest(t, http.MethodGet, "dav/tasks/client-1.ics", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	assert.Contains(t, body, "UID:0b7c5f0e-client@example.com\r\n")
+	assert.Contains(t, body, "CATEGORIES:Дом\r\n")
+	assert.Contains(t, body, "PRIORITY:1\r\n")
+
+	tasks := getTasks(t, "Позвонить")
+	if assert.Len(t, tasks, 1) {
+		assert.Equal(t, date, tasks[0]["date"])
+		assert.Equal(t, "3", tasks[0]["priority"])
+	}
+
+	// An update with the current ETag changes the task, a stale one fails.
+	changed := strings.Replace(todo, "SUMMARY:Позвонить", "SUMMARY:Позвонить маме", 1)
+	resp, _ = davRequest(t, http.MethodPut, "dav/tasks/client-1.ics", changed, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+	resp, _ = davRequest(t, http.MethodPut, "dav/tasks/client-1.ics", todo, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, body = davRequest(t, "REPORT", "dav/tasks/",
+		`<c:calendar-multiget xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">`+
+			`<d:prop><d:getetag/><c:calendar-data/></d:prop>`+
+			`<d:href>/dav/tasks/client-1.ics</d:href><d:href>/dav/tasks/missing.ics</d:href>`+
+			`</c:calendar-multiget>`, map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	assert.Contains(t, body, "SUMMARY:Позвонить маме")
+	assert.Contains(t, body, "404 Not Found")
+
+	resp, body = davRequest(t, "REPORT", "dav/tasks/",
+		`<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">`+
+			`<d:prop><d:getetag/></d:prop>`+
+			`<c:filter><c:comp-filter name="VCALENDAR"><c:comp-filter name="VTODO"/></c:comp-filter></c:filter>`+
+			`</c:calendar-query>`, map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	assert.Contains(t, body, "/dav/tasks/"+id+".ics")
+	assert.Contains(t, body, "/dav/tasks/client-1.ics")
+
+	// Completing a task marks it done, so a one-off task is deleted.
+	done := strings.Replace(todo, "END:VTODO", "STATUS:COMPLETED\r\nEND:VTODO", 1)
+	resp, _ = davRequest(t, http.MethodPut, "dav/tasks/"+id+".ics", done, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	notFoundTask(t, id)
+
+	resp, _ = davRequest(t, http.MethodDelete, "dav/tasks/client-1.ics", "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = davRequest(t, http.MethodGet, "dav/tasks/client-1.ics", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var n int
+	assert.NoError(t, db.Get(&n, "SELECT COUNT(*) FROM scheduler"))
+	assert.Equal(t, 0, n)
+	assert.NoError(t, db.Get(&n, "SELECT COUNT(*) FROM dav_objects"))
+	assert.Equal(t, 0, n)
+
+	_, err = db.Exec("DELETE FROM projects WHERE name = 'Дом'")
+	assert.NoError(t, err)
+}
+
+// TestCalDAVClient syncs with the server as a CalDAV client library does:
+// discovery from the principal, PUT and GET of objects and both REPORTs.
+func TestCalDAVClient(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	env, _ := godotenv.Read("../.env")
+	client, err := caldav.NewClient(
+		webdav.HTTPClientWithBasicAuth(http.DefaultClient, "tasks", env["TODO_PASSWORD"]), getURL("dav/"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+
+	principal, err := client.FindCurrentUserPrincipal(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dav/", principal)
+	home, err := client.FindCalendarHomeSet(ctx, principal)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dav/", home)
+	calendars, err := client.FindCalendars(ctx, home)
+	assert.NoError(t, err)
+	if !assert.Len(t, calendars, 1) {
+		return
+	}
+	assert.Equal(t, "/dav/tasks/", calendars[0].Path)
+	assert.Equal(t, []string{"VTODO"}, calendars[0].SupportedComponentSet)
+
+	due := time.Now().AddDate(0, 0, 5)
+	id := addTask(t, task{date: due.Format("20060102"), title: "Полить цветы"})
+
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//test//EN")
+	todo := ical.NewComponent(ical.CompToDo)
+	todo.Props.SetText(ical.PropUID, "client-lib@example.com")
+	todo.Props.SetDateTime(ical.PropDateTimeStamp, time.Now().UTC())
+	todo.Props.SetText(ical.PropSummary, "Забрать посылку")
+	todo.Props.SetDate(ical.PropDue, due)
+	cal.Children = append(cal.Children, todo)
+	const path = "/dav/tasks/client-lib.ics"
+	put, err := client.PutCalendarObject(ctx, path, cal)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, put.ETag)
+
+	tasks := getTasks(t, "посылку")
+	if assert.Len(t, tasks, 1) {
+		assert.Equal(t, due.Format("20060102"), tasks[0]["date"])
+	}
+
+	summary := func(o caldav.CalendarObject) string {
+		for _, c := range o.Data.Children {
+			if c.Name == ical.CompToDo {
+				s, _ := c.Props.Text(ical.PropSummary)
+				return s
+			}
+		}
+		return ""
+	}
+	obj, err := client.GetCalendarObject(ctx, path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, put.ETag, obj.ETag)
+		assert.Equal(t, "Забрать посылку", summary(*obj))
+	}
+
+	request := caldav.CalendarCompRequest{Name: ical.CompCalendar, AllProps: true, AllComps: true}
+	objects, err := client.QueryCalendar(ctx, calendars[0].Path, &caldav.CalendarQuery{
+		CompRequest: request,
+		CompFilter: caldav.CompFilter{
+			Name:  ical.CompCalendar,
+			Comps: []caldav.CompFilter{{Name: ical.CompToDo}},
+		},
+	})
+	assert.NoError(t, err)
+	found := map[string]string{}
+	for _, o := range objects {
+		found[o.Path] = summary(o)
+	}
+	assert.Equal(t, map[string]string{
+		"/dav/tasks/" + id + ".ics": "Полить цветы",
+		path:                        "Забрать посылку",
+	}, found)
+
+	objects, err = client.MultiGetCalendar(ctx, calendars[0].Path, &caldav.CalendarMultiGet{
+		CompRequest: request,
+		Paths:       []string{path},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, objects, 1) {
+		assert.Equal(t, put.ETag, objects[0].ETag)
+		assert.Equal(t, "Забрать посылку", summary(objects[0]))
+	}
+
+	assert.NoError(t, client.RemoveAll(ctx, path))
+	_, err = client.GetCalendarObject(ctx, path)
+	assert.Error(t, err)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
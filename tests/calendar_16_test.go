@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalendar(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	addTask(t, task{date: now.Format(`20060102`), title: "Каждые 7 дней", repeat: "d 7"})
+	addTask(t, task{date: now.AddDate(0, 0, 3).Format(`20060102`), title: "Разовая"})
+	addTask(t, task{date: now.AddDate(0, 0, 40).Format(`20060102`), title: "Не в окне"})
+
+	from := now.Format(`20060102`)
+	to := now.AddDate(0, 0, 20).Format(`20060102`)
+	body, err := requestJSON("api/calendar?from="+from+"&to="+to, nil, http.MethodGet)
+	assert.NoError(t, err)
+
+	var cal struct {
+		Days map[string][]struct {
+			Title   string `json:"title"`
+			Date    string `json:"date"`
+			Virtual bool   `json:"virtual"`
+		} `json:"days"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &cal))
+	assert.Equal(t, 4, len(cal.Days))
+	for _, offset := range []int{0, 7, 14} {
+		day := cal.Days[now.AddDate(0, 0, offset).Format(`20060102`)]
+		if assert.Equal(t, 1, len(day)) {
+			assert.Equal(t, "Каждые 7 дней", day[0].Title)
+			assert.Equal(t, offset != 0, day[0].Virtual)
+		}
+	}
+	assert.Equal(t, "Разовая", cal.Days[now.AddDate(0, 0, 3).Format(`20060102`)][0].Title)
+
+	for _, url := range []string{
+		"api/calendar?from=" + to + "&to=" + from,
+		"api/calendar?from=" + from + "&to=" + now.AddDate(2, 0, 0).Format(`20060102`),
+		"api/calendar?from=завтра",
+	} {
+		m, err := postJSON(url, nil, http.MethodGet)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, m["error"], url)
+	}
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type checklistItem struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	Done bool   `json:"done"`
+}
+
+func getChecklist(t *testing.T, id string) []checklistItem {
+	body, err := requestJSON("api/task/checklist?task_id="+id, nil, http.MethodGet)
+	assert.NoError(t, err)
+	var m map[string][]checklistItem
+	assert.NoError(t, json.Unmarshal(body, &m))
+	return m["items"]
+}
+
+func TestChecklist(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	id := addTask(t, task{
+		date:   now.Format(`20060102`),
+		title:  "Уборка",
+		repeat: "d 7",
+	})
+
+	var ids []string
+	for _, text := range []string{"Пропылесосить", "Помыть пол", "Вынести мусор"} {
+		m, err := postJSON("api/task/checklist", map[string]any{
+			"task_id": id,
+			"text":    text,
+		}, http.MethodPost)
+		assert.NoError(t, err)
+		ids = append(ids, fmt.Sprint(m["id"]))
+	}
+	m, err := postJSON("api/task/checklist", map[string]any{"task_id": id}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m["error"])
+
+	var version, events int
+	assert.NoError(t, db.Get(&version, "SELECT version FROM task_meta WHERE task_id = ?", id))
+	assert.NoError(t, db.Get(&events, "SELECT COUNT(*) FROM task_events WHERE task_id = ?", id))
+
+	m, err = postJSON("api/task/checklist/toggle?id="+ids[0], nil, http.MethodPost)
+	assert.NoError(t, err)
+	assert.Equal(t, true, m["done"])
+
+	// The progress is part of the task, so its version changes and an update
+	// is recorded.
+	body, err := requestJSON("api/task?id="+id, nil, http.MethodGet)
+	assert.NoError(t, err)
+	var task map[string]string
+	assert.NoError(t, json.Unmarshal(body, &task))
+	assert.Equal(t, "1", task["checklist_done"])
+	assert.Equal(t, "3", task["checklist_total"])
+	assert.Equal(t, fmt.Sprint(version+1), task["version"])
+	var last string
+	assert.NoError(t, db.Get(&last, "SELECT type FROM task_events WHERE task_id = ? ORDER BY id DESC LIMIT 1", id))
+	assert.Equal(t, "task.updated", last)
+	var after int
+	assert.NoError(t, db.Get(&after, "SELECT COUNT(*) FROM task_events WHERE task_id = ?", id))
+	assert.Equal(t, events+1, after)
+
+	m, err = postJSON("api/task/checklist/reorder", map[string]any{
+		"task_id": id,
+		"ids":     []string{ids[2], ids[0]},
+	}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m["error"])
+	m, err = postJSON("api/task/checklist/reorder", map[string]any{
+		"task_id": id,
+		"ids":     []string{ids[2], ids[0], ids[1]},
+	}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.Empty(t, m)
+	items := getChecklist(t, id)
+	assert.Equal(t, 3, len(items))
+	assert.Equal(t, "Вынести мусор", items[0].Text)
+	assert.True(t, items[1].Done)
+
+	m, err = postJSON("api/task/done?id="+id, nil, http.MethodPost)
+	assert.NoError(t, err)
+	assert.Empty(t, m)
+	for _, item := range getChecklist(t, id) {
+		assert.False(t, item.Done)
+	}
+
+	m, err = postJSON("api/task?id="+id, nil, http.MethodDelete)
+	assert.NoError(t, err)
+	assert.Empty(t, m)
+	var left int
+	assert.NoError(t, db.Get(&left, "SELECT COUNT(*) FROM checklist_items WHERE task_id = ?", id))
+	assert.Equal(t, 0, left)
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requestWithHeader(t *testing.T, method, apipath string, values map[string]any, header, value string) (*http.Response, []byte) {
+	var data []byte
+	if values != nil {
+		var err error
+		data, err = json.Marshal(values)
+		assert.NoError(t, err)
+	}
+	req, err := http.NewRequest(method, getURL(apipath), bytes.NewBuffer(data))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp, body
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	id := addTask(t, task{title: "Общая задача", comment: "версия 1"})
+
+	resp, _ := requestWithHeader(t, http.MethodGet, "api/task?id="+id, nil, "", "")
+	tag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, tag)
+
+	edit := func(comment string) map[string]any {
+		return map[string]any{"id": id, "date": "", "title": "Общая задача", "comment": comment}
+	}
+
+	resp, _ = requestWithHeader(t, http.MethodPut, "api/task", edit("первый"), "If-Match", tag)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	newTag := resp.Header.Get("ETag")
+	assert.NotEqual(t, tag, newTag)
+
+	// The second editor still holds the old tag.
+	resp, body := requestWithHeader(t, http.MethodPut, "api/task", edit("второй"), "If-Match", tag)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	var conflict struct {
+		Error string            `json:"error"`
+		Task  map[string]string `json:"task"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &conflict))
+	assert.NotEmpty(t, conflict.Error)
+	assert.Equal(t, "первый", conflict.Task["comment"])
+	assert.Equal(t, newTag, `"`+conflict.Task["version"]+`"`)
+
+	values := edit("второй")
+	values["version"] = "1"
+	resp, _ = requestWithHeader(t, http.MethodPut, "api/task", values, "", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	values["version"] = conflict.Task["version"]
+	resp, _ = requestWithHeader(t, http.MethodPut, "api/task", values, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A change is one version, however many fields it sets.
+	version, err := strconv.Atoi(conflict.Task["version"])
+	assert.NoError(t, err)
+	values = edit("третий")
+	values["priority"] = "2"
+	values["remind_before"] = "1"
+	resp, _ = requestWithHeader(t, http.MethodPut, "api/task", values, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"`+strconv.Itoa(version+2)+`"`, resp.Header.Get("ETag"))
+	resp, _ = requestWithHeader(t, http.MethodPatch, "api/task?id="+id,
+		map[string]any{"priority": "3", "remind_before": "2"}, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"`+strconv.Itoa(version+3)+`"`, resp.Header.Get("ETag"))
+
+	resp, _ = requestWithHeader(t, http.MethodDelete, "api/task?id="+id, nil, "If-Match", newTag)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = requestWithHeader(t, http.MethodGet, "api/task?id="+id, nil, "", "")
+	resp, _ = requestWithHeader(t, http.MethodDelete, "api/task?id="+id, nil, "If-Match", resp.Header.Get("ETag"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	notFoundTask(t, id)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	// Writers that read first wait for each other instead of failing with
+	// SQLITE_BUSY.
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	for i := 0; i < 8; i++ {
+		id := addTask(t, task{date: "20300101", title: fmt.Sprint("Задача ", i)})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 15; j++ {
+				resp, body := requestWithHeader(t, http.MethodPatch, "api/task?id="+id,
+					map[string]any{"comment": fmt.Sprint("правка ", j)}, "", "")
+				if resp.StatusCode >= 500 {
+					mu.Lock()
+					failed = append(failed, string(body))
+					mu.Unlock()
+				}
+				resp, body = requestWithHeader(t, http.MethodPost, "api/tasks/batch", map[string]any{
+					"operations": []map[string]any{
+						{"op": "update", "task": map[string]any{"id": id, "date": "20300101", "title": fmt.Sprint("Задача ", j)}},
+					},
+				}, "", "")
+				if resp.StatusCode >= 500 {
+					mu.Lock()
+					failed = append(failed, string(body))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, failed)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
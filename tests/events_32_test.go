@@ -0,0 +1,191 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// openEvents connects to /api/events and returns the events as they come.
+func openEvents(t *testing.T, lastEventID string) (<-chan sseEvent, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getURL("api/events"), nil)
+	assert.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	signIn(t, req)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		cancel()
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var e sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				e.ID = value
+			case "event":
+				e.Event = value
+			case "data":
+				e.Data = value
+			case "":
+				if e.Event != "" {
+					events <- e
+				}
+				e = sseEvent{}
+			}
+		}
+	}()
+	return events, cancel
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+func eventTask(t *testing.T, e sseEvent) map[string]string {
+	var payload struct {
+		ID   string            `json:"id"`
+		Type string            `json:"type"`
+		Task map[string]string `json:"task"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(e.Data), &payload))
+	// The id of the payload is the uid of the event, not the cursor.
+	assert.Len(t, payload.ID, 32)
+	assert.Equal(t, e.Event, payload.Type)
+	return payload.Task
+}
+
+func TestEvents(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	if env, _ := godotenv.Read("../.env"); env["TODO_PASSWORD"] != "" {
+		resp, err := http.Get(getURL("api/events"))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	events, cancel := openEvents(t, "")
+	id := addTask(t, task{date: "20300101", title: "Позвонить в банк", repeat: "d 7"})
+	e := nextEvent(t, events)
+	assert.Equal(t, "task.created", e.Event)
+	assert.Equal(t, id, eventTask(t, e)["id"])
+
+	_, err = postJSON("api/task?id="+id, map[string]any{"comment": "до пятницы"}, http.MethodPatch)
+	assert.NoError(t, err)
+	e = nextEvent(t, events)
+	assert.Equal(t, "task.updated", e.Event)
+	assert.Equal(t, "до пятницы", eventTask(t, e)["comment"])
+
+	_, err = postJSON("api/task/done?id="+id, nil, http.MethodPost)
+	assert.NoError(t, err)
+	e = nextEvent(t, events)
+	assert.Equal(t, "task.done", e.Event)
+	assert.Equal(t, "20300108", eventTask(t, e)["date"])
+	last := e.ID
+	cancel()
+
+	// Changes made while disconnected come after reconnecting.
+	_, err = postJSON("api/task?id="+id, nil, http.MethodDelete)
+	assert.NoError(t, err)
+	other := addTask(t, task{date: "20300102", title: "Забрать посылку"})
+
+	events, cancel = openEvents(t, last)
+	defer cancel()
+	e = nextEvent(t, events)
+	assert.Equal(t, "task.deleted", e.Event)
+	assert.Equal(t, id, eventTask(t, e)["id"])
+	e = nextEvent(t, events)
+	assert.Equal(t, "task.created", e.Event)
+	assert.Equal(t, other, eventTask(t, e)["id"])
+
+	_, err = postJSON("api/task?id="+other, nil, http.MethodDelete)
+	assert.NoError(t, err)
+	e = nextEvent(t, events)
+	assert.Equal(t, "task.deleted", e.Event)
+	assert.Equal(t, other, eventTask(t, e)["id"])
+}
+
+func TestEventsRestore(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	status, body := adminRequest(t, http.MethodPost, "api/backups")
+	assert.Equal(t, http.StatusCreated, status)
+	var snap backupSnapshot
+	assert.NoError(t, json.Unmarshal(body, &snap))
+
+	events, cancel := openEvents(t, "")
+	addTask(t, task{date: "20300101", title: "После снимка"})
+	last := nextEvent(t, events).ID
+	cancel()
+
+	// A client connected during the restore is disconnected, and so is
+	// told to start over.
+	events, cancel = openEvents(t, "")
+	defer cancel()
+	status, body = adminRequest(t, http.MethodPost, "api/backups/restore?name="+snap.Name)
+	assert.Equal(t, http.StatusOK, status, string(body))
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the stream wasn't closed by the restore")
+	}
+
+	// Ids of events after the restore don't repeat those before it, and a
+	// client that saw only those gets a reset.
+	addTask(t, task{date: "20300102", title: "После восстановления"})
+	var maxID int64
+	assert.NoError(t, db.Get(&maxID, "SELECT MAX(id) FROM task_events"))
+	lastID, err := strconv.ParseInt(last, 10, 64)
+	assert.NoError(t, err)
+	assert.Greater(t, maxID, lastID)
+	events, cancel = openEvents(t, last)
+	defer cancel()
+	assert.Equal(t, "reset", nextEvent(t, events).Event)
+
+	for name := range listBackups(t) {
+		status, _ = adminRequest(t, http.MethodDelete, "api/backups?name="+name)
+		assert.Equal(t, http.StatusOK, status)
+	}
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type importResult struct {
+	DryRun  bool `json:"dry_run"`
+	Applied bool `json:"applied"`
+	Created int  `json:"created"`
+	Updated int  `json:"updated"`
+	Deleted int  `json:"deleted"`
+	Skipped int  `json:"skipped"`
+	Errors  []struct {
+		Row   int    `json:"row"`
+		Error string `json:"error"`
+	} `json:"errors"`
+	Warnings []struct {
+		Row   int    `json:"row"`
+		Error string `json:"error"`
+	} `json:"warnings"`
+}
+
+func exportTasks(t *testing.T, format string) []byte {
+	resp, err := http.Get(getURL("api/export?format=" + format))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return body
+}
+
+func importTasks(t *testing.T, query string, data []byte) importResult {
+	resp, err := http.Post(getURL("api/import?"+query), "application/octet-stream", bytes.NewReader(data))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var ret importResult
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&ret))
+	return ret
+}
+
+func TestExportImport(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	first := addTask(t, task{title: "Купить #продукты", comment: "молоко", repeat: "d 3"})
+	_, err = postJSON("api/task/checklist", map[string]any{"task_id": first, "text": "Хлеб"}, http.MethodPost)
+	assert.NoError(t, err)
+	_, err = postJSON("api/task?id="+first, map[string]any{"remind_before": "2"}, http.MethodPatch)
+	assert.NoError(t, err)
+	addTask(t, task{title: "Позвонить, \"маме\""})
+
+	var doc struct {
+		Tasks []map[string]any `json:"tasks"`
+	}
+	assert.NoError(t, json.Unmarshal(exportTasks(t, "json"), &doc))
+	if assert.Equal(t, 2, len(doc.Tasks)) {
+		assert.Equal(t, "Купить #продукты", doc.Tasks[0]["title"])
+		assert.Equal(t, "Хлеб", doc.Tasks[0]["checklist"].([]any)[0].(map[string]any)["text"])
+		assert.Equal(t, "2", doc.Tasks[0]["remind_before"])
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(exportTasks(t, "csv"))).ReadAll()
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(records)) {
+		assert.Equal(t, "title", records[0][2])
+		assert.Equal(t, "Позвонить, \"маме\"", records[2][2])
+		assert.Equal(t, "2", records[1][7])
+		assert.Equal(t, "[ ] Хлеб", records[1][10])
+	}
+
+	data := []byte("title,comment,priority\nОтчёт,квартальный,2\n,без заголовка,1\nПланёрка,,5\n")
+	ret := importTasks(t, "format=csv&dry_run=1", data)
+	assert.False(t, ret.Applied)
+	if assert.Equal(t, 2, len(ret.Errors)) {
+		assert.Equal(t, 3, ret.Errors[0].Row)
+		assert.Equal(t, 4, ret.Errors[1].Row)
+	}
+
+	ret = importTasks(t, "format=csv&dry_run=1", []byte("title,comment\nОтчёт,квартальный\n"))
+	assert.True(t, ret.DryRun)
+	assert.False(t, ret.Applied)
+	assert.Equal(t, 1, ret.Created)
+	cnt, err := count(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cnt)
+
+	ret = importTasks(t, "format=csv", []byte("title,comment\nОтчёт,квартальный\n"))
+	assert.True(t, ret.Applied)
+	assert.Equal(t, 1, ret.Created)
+
+	doc.Tasks[1]["title"] = "Позвонить папе"
+	exported, err := json.Marshal(doc)
+	assert.NoError(t, err)
+	ret = importTasks(t, "format=json", exported)
+	assert.True(t, ret.Applied)
+	assert.Equal(t, 2, ret.Updated)
+	tasks := getTasks(t, "папе")
+	assert.Equal(t, 1, len(tasks))
+
+	ret = importTasks(t, "format=json&mode=replace", exported)
+	assert.True(t, ret.Applied)
+	assert.Equal(t, 3, ret.Deleted)
+	assert.Equal(t, 2, ret.Created)
+	cnt, err = count(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cnt)
+	assert.Equal(t, 1, len(getChecklist(t, first)))
+	var stored map[string]any
+	body, err := getBody("api/task?id=" + first)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(body, &stored))
+	assert.Equal(t, "2", stored["remind_before"])
+
+	ret = importTasks(t, "format=xml", []byte("<tasks/>"))
+	assert.False(t, ret.Applied)
+	assert.True(t, strings.Contains(string(exportTasks(t, "json")), "Позвонить папе"))
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
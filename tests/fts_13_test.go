@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFullTextSearch(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	addTask(t, task{date: now.AddDate(0, 0, 1).Format(`20060102`), title: "Позвонить маме", comment: "про отпуск"})
+	addTask(t, task{date: now.AddDate(0, 0, 2).Format(`20060102`), title: "Отпуск отпуск", comment: "забронировать отпуск в отеле"})
+	addTask(t, task{date: now.AddDate(0, 0, 3).Format(`20060102`), title: "Отпускные", comment: "проверить расчёт"})
+
+	page := getTasksPage(t, url.Values{"search": {"отпуск"}})
+	assert.Equal(t, 2, len(page.Tasks))
+	if len(page.Tasks) == 2 {
+		assert.Equal(t, "Отпуск отпуск", page.Tasks[0]["title"])
+		assert.True(t, strings.Contains(page.Tasks[0]["snippet"], "<mark>"))
+	}
+
+	assert.Equal(t, 3, len(getTasksPage(t, url.Values{"search": {"отпуск*"}}).Tasks))
+	assert.Equal(t, 1, len(getTasksPage(t, url.Values{"search": {`"забронировать отпуск"`}}).Tasks))
+	assert.Equal(t, 0, len(getTasksPage(t, url.Values{"search": {`"отпуск забронировать"`}}).Tasks))
+	assert.Equal(t, 1, len(getTasksPage(t, url.Values{"search": {"отпуск -мама -маме"}}).Tasks))
+
+	seen := 0
+	page = getTasksPage(t, url.Values{"search": {"отпуск*"}, "limit": {"1"}})
+	for {
+		assert.Empty(t, page.Error)
+		seen += len(page.Tasks)
+		if page.NextCursor == "" {
+			break
+		}
+		page = getTasksPage(t, url.Values{"search": {"отпуск*"}, "limit": {"1"}, "cursor": {page.NextCursor}})
+	}
+	assert.Equal(t, 3, seen)
+
+	_, err = db.Exec("UPDATE scheduler SET title = 'Командировка' WHERE title = 'Позвонить маме'")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(getTasksPage(t, url.Values{"search": {"командировка"}}).Tasks))
+
+	page = getTasksPage(t, url.Values{"sort": {"rank"}})
+	assert.NotEmpty(t, page.Error)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
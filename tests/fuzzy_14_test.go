@@ -0,0 +1,51 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzzySearch(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	date := time.Now().Format(`20060102`)
+	addTask(t, task{date: date, title: "Сходить в бассейн"})
+	addTask(t, task{date: date, title: "Weekly report"})
+	addTask(t, task{date: date, title: "Report to the board"})
+	addTask(t, task{date: date, title: "Купить хлеб"})
+
+	page := getTasksPage(t, url.Values{"search": {"басейн"}})
+	assert.Equal(t, 1, len(page.Tasks))
+	if len(page.Tasks) == 1 {
+		assert.Equal(t, "Сходить в бассейн", page.Tasks[0]["title"])
+	}
+
+	page = getTasksPage(t, url.Values{"search": {"repprt"}})
+	assert.Equal(t, 2, len(page.Tasks))
+	assert.Equal(t, 0, len(getTasksPage(t, url.Values{"search": {"repprt"}, "fuzzy": {"0"}}).Tasks))
+	assert.Equal(t, 0, len(getTasksPage(t, url.Values{"search": {"абракадабра"}}).Tasks))
+
+	suggest := func(prefix string) []string {
+		body, err := requestJSON("api/tasks/suggest?prefix="+url.QueryEscape(prefix), nil, http.MethodGet)
+		assert.NoError(t, err)
+		var m map[string][]string
+		assert.NoError(t, json.Unmarshal(body, &m))
+		return m["suggestions"]
+	}
+	assert.Equal(t, []string{"Report to the board", "Weekly report"}, suggest("rep"))
+	assert.Equal(t, []string{"Сходить в бассейн"}, suggest("сходить в басс"))
+	assert.Contains(t, suggest("купит"), "Купить хлеб")
+	assert.Contains(t, suggest("бассеин"), "Сходить в бассейн")
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getFeed(t *testing.T, token string) (int, string) {
+	resp, err := http.Get(getURL("api/calendar.ics?token=" + token))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	// Unfold continuation lines.
+	return resp.StatusCode, strings.ReplaceAll(string(body), "\r\n ", "")
+}
+
+func TestCalendarFeed(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+	_, err = db.Exec("INSERT INTO calendar_feeds (token, name) VALUES ('test-feed-token', 'Задачи')")
+	assert.NoError(t, err)
+	defer db.Exec("DELETE FROM calendar_feeds WHERE token = 'test-feed-token'")
+
+	resp, err := http.Get(getURL("api/calendar/feeds"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	status, _ := getFeed(t, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	now := time.Now()
+	once := addTask(t, task{date: now.Format("20060102"), title: "Встреча; итоги, план", comment: "строка 1\nстрока 2"})
+	daily := addTask(t, task{date: now.Format("20060102"), title: "Зарядка", repeat: "d 2"})
+	monthly := addTask(t, task{title: "Оплата", repeat: "m 1,15"})
+	_, err = db.Exec("UPDATE scheduler SET date = ? WHERE id = ?", now.AddDate(0, 1, 0).Format("200601")+"01", monthly)
+	assert.NoError(t, err)
+
+	status, body := getFeed(t, "test-feed-token")
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, strings.HasPrefix(body, "BEGIN:VCALENDAR\r\n"))
+	assert.Contains(t, body, "X-WR-CALNAME:Задачи\r\n")
+	assert.Contains(t, body, "UID:task-"+once+"@")
+	assert.Contains(t, body, `SUMMARY:Встреча\; итоги\, план`)
+	assert.Contains(t, body, `DESCRIPTION:строка 1\nстрока 2`)
+	assert.Contains(t, body, "UID:task-"+daily+"@")
+	assert.Contains(t, body, "RRULE:FREQ=DAILY;INTERVAL=2\r\n")
+	assert.Contains(t, body, "RRULE:FREQ=MONTHLY;BYMONTHDAY=1,15\r\n")
+	// The 3rd is not a date of "m 1,15", so the repetitions are listed
+	// one by one.
+	_, err = db.Exec("UPDATE scheduler SET date = ? WHERE id = ?", now.AddDate(0, 1, 0).Format("200601")+"03", monthly)
+	assert.NoError(t, err)
+	_, body = getFeed(t, "test-feed-token")
+	assert.NotContains(t, body, "BYMONTHDAY")
+	assert.Contains(t, body, "UID:task-"+monthly+"-"+now.AddDate(0, 1, 0).Format("200601")+"03@")
+	assert.Contains(t, body, "UID:task-"+monthly+"-"+now.AddDate(0, 1, 0).Format("200601")+"15@")
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportICS(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	next := time.Now().AddDate(0, 0, 10).Format("20060102")
+	data := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Example//EN",
+		"BEGIN:VTODO",
+		"UID:1@example.com",
+		"SUMMARY:Сдать отчёт",
+		"DESCRIPTION:Первая строка\\nвторая\\, с запятой",
+		"DUE;VALUE=DATE:" + next,
+		"PRIORITY:1",
+		"CATEGORIES:Работа,Отчёты",
+		"END:VTODO",
+		"BEGIN:VEVENT",
+		"UID:2@example.com",
+		"SUMMARY:Планёрка по очень длинному заголовку, который переносится на сл",
+		" едующую строку",
+		"DTSTART;TZID=Europe/Moscow:" + next + "T100000",
+		"RRULE:FREQ=WEEKLY;INTERVAL=2",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:3@example.com",
+		"SUMMARY:Оплата",
+		"DTSTART;VALUE=DATE:" + next,
+		"RRULE:FREQ=MONTHLY;BYDAY=2TU;COUNT=5",
+		"END:VEVENT",
+		"BEGIN:VTODO",
+		"UID:4@example.com",
+		"SUMMARY:Уже сделано",
+		"STATUS:COMPLETED",
+		"END:VTODO",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	ret := importTasks(t, "format=ics", []byte(data))
+	assert.True(t, ret.Applied)
+	assert.Empty(t, ret.Errors)
+	assert.Equal(t, 3, ret.Created)
+
+	tasks := getTasks(t, "отчёт")
+	if assert.Equal(t, 1, len(tasks)) {
+		assert.Equal(t, next, tasks[0]["date"])
+		assert.Equal(t, "Первая строка\nвторая, с запятой", tasks[0]["comment"])
+		assert.Equal(t, "3", tasks[0]["priority"])
+		assert.NotEmpty(t, tasks[0]["project_id"])
+	}
+	tasks = getTasks(t, "Планёрка")
+	if assert.Equal(t, 1, len(tasks)) {
+		assert.True(t, strings.HasSuffix(tasks[0]["title"], "на следующую строку"))
+		assert.Equal(t, "d 14", tasks[0]["repeat"])
+	}
+	tasks = getTasks(t, "Оплата")
+	if assert.Equal(t, 1, len(tasks)) {
+		assert.Equal(t, "m "+strings.TrimLeft(next[6:], "0"), tasks[0]["repeat"])
+	}
+
+	// Weekdays in a month and COUNT are reported, the completed task is
+	// skipped.
+	ret = importTasks(t, "format=ics&dry_run=1", []byte(data))
+	assert.Equal(t, 1, ret.Skipped)
+	var warnings []string
+	for _, w := range ret.Warnings {
+		warnings = append(warnings, w.Error)
+	}
+	all := strings.Join(warnings, "\n")
+	assert.Contains(t, all, "COUNT is ignored")
+	assert.Contains(t, all, "weekdays in a month")
+	assert.Contains(t, all, "COMPLETED")
+
+	ret = importTasks(t, "format=ics", []byte("BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\nSUMMARY:x\r\n"))
+	assert.False(t, ret.Applied)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+	_, err = db.Exec("DELETE FROM projects WHERE name = 'Работа'")
+	assert.NoError(t, err)
+}
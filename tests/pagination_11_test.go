@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tasksPage struct {
+	Tasks      []map[string]string `json:"tasks"`
+	NextCursor string              `json:"next_cursor"`
+	Total      *int                `json:"total"`
+	Error      string              `json:"error"`
+}
+
+func getTasksPage(t *testing.T, params url.Values) tasksPage {
+	body, err := requestJSON("api/tasks?"+params.Encode(), nil, http.MethodGet)
+	assert.NoError(t, err)
+	var page tasksPage
+	assert.NoError(t, json.Unmarshal(body, &page))
+	return page
+}
+
+func TestPagination(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		addTask(t, task{
+			date:  now.AddDate(0, 0, i).Format(`20060102`),
+			title: fmt.Sprintf("Страница %d", i),
+		})
+	}
+
+	page := getTasksPage(t, url.Values{"limit": {"2"}, "total": {"1"}})
+	assert.Equal(t, 2, len(page.Tasks))
+	assert.NotEmpty(t, page.NextCursor)
+	if assert.NotNil(t, page.Total) {
+		assert.Equal(t, 5, *page.Total)
+	}
+
+	// A task inserted before the cursor position must not shift the pages.
+	addTask(t, task{date: now.Format(`20060102`), title: "Вставка"})
+
+	seen := map[string]bool{}
+	for _, task := range page.Tasks {
+		seen[task["title"]] = true
+	}
+	for page.NextCursor != "" {
+		page = getTasksPage(t, url.Values{"limit": {"2"}, "cursor": {page.NextCursor}})
+		assert.Empty(t, page.Error)
+		for _, task := range page.Tasks {
+			assert.False(t, seen[task["title"]], "повтор %s", task["title"])
+			seen[task["title"]] = true
+		}
+	}
+	for i := 0; i < 5; i++ {
+		assert.True(t, seen[fmt.Sprintf("Страница %d", i)])
+	}
+
+	first := getTasksPage(t, url.Values{"limit": {"2"}})
+	page = getTasksPage(t, url.Values{"limit": {"2"}, "sort": {"-date"}, "cursor": {first.NextCursor}})
+	assert.NotEmpty(t, page.Error)
+
+	// A tampered cursor with values that are not scalars is rejected.
+	data, err := base64.RawURLEncoding.DecodeString(first.NextCursor)
+	assert.NoError(t, err)
+	var c map[string]any
+	assert.NoError(t, json.Unmarshal(data, &c))
+	c["v"] = []any{map[string]any{"a": 1}, []any{1}}
+	data, err = json.Marshal(c)
+	assert.NoError(t, err)
+	page = getTasksPage(t, url.Values{"limit": {"2"}, "cursor": {base64.RawURLEncoding.EncodeToString(data)}})
+	assert.Equal(t, "Invalid cursor", page.Error)
+
+	page = getTasksPage(t, url.Values{"limit": {"0"}})
+	assert.NotEmpty(t, page.Error)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchTask(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	// A repeating task left in the past keeps its date on unrelated changes.
+	past := time.Now().AddDate(0, 0, -3).Format("20060102")
+	id := addTask(t, task{title: "Полить цветы", comment: "кактус", repeat: "d 7"})
+	_, err := db.Exec("UPDATE scheduler SET date = ? WHERE id = ?", past, id)
+	assert.NoError(t, err)
+
+	resp, body := requestWithHeader(t, http.MethodPatch, "api/task?id="+id,
+		map[string]any{"comment": "фикус", "priority": "2"}, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var got map[string]string
+	assert.NoError(t, json.Unmarshal(body, &got))
+	assert.Equal(t, past, got["date"])
+	assert.Equal(t, "Полить цветы", got["title"])
+	assert.Equal(t, "фикус", got["comment"])
+	assert.Equal(t, "d 7", got["repeat"])
+	assert.Equal(t, "2", got["priority"])
+
+	resp, body = requestWithHeader(t, http.MethodPatch, "api/task?id="+id,
+		map[string]any{"comment": nil, "priority": nil}, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	got = nil
+	assert.NoError(t, json.Unmarshal(body, &got))
+	assert.Equal(t, "", got["comment"])
+	assert.Equal(t, "", got["priority"])
+
+	// A patch that changes nothing is not an update.
+	var events int
+	assert.NoError(t, db.Get(&events, "SELECT COUNT(*) FROM task_events WHERE task_id = ?", id))
+	revisions := len(getRevisions(t, id))
+	for _, same := range []map[string]any{
+		{},
+		{"title": "Полить цветы", "repeat": "d 7", "priority": "0", "project_id": ""},
+	} {
+		resp, body = requestWithHeader(t, http.MethodPatch, "api/task?id="+id, same, "", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode, same)
+		assert.Empty(t, resp.Header.Get("X-Undo-Token"), same)
+		var unchanged map[string]string
+		assert.NoError(t, json.Unmarshal(body, &unchanged))
+		assert.Equal(t, got["version"], unchanged["version"], same)
+	}
+	var after int
+	assert.NoError(t, db.Get(&after, "SELECT COUNT(*) FROM task_events WHERE task_id = ?", id))
+	assert.Equal(t, events, after)
+	assert.Len(t, getRevisions(t, id), revisions)
+	resp, _ = requestWithHeader(t, http.MethodPatch, "api/task?id="+id, map[string]any{"version": "1"}, "", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	for _, bad := range []map[string]any{
+		{"title": ""},
+		{"title": nil},
+		{"date": "32.13.2026"},
+		{"repeat": "x 1"},
+		{"colour": "red"},
+	} {
+		resp, _ = requestWithHeader(t, http.MethodPatch, "api/task?id="+id, bad, "", "")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, bad)
+	}
+
+	resp, _ = requestWithHeader(t, http.MethodPatch, "api/task?id="+id,
+		map[string]any{"title": "Полить", "version": "1"}, "", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, _ = requestWithHeader(t, http.MethodPatch, "api/task?id=99999999",
+		map[string]any{"title": "Нет"}, "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	body, err = requestJSON("api/task?id="+id, nil, http.MethodDelete)
+	assert.NoError(t, err)
+	assert.Equal(t, "{}\n", string(body))
+}
@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func addProject(t *testing.T, name string) string {
+	ret, err := postJSON("api/project", map[string]any{
+		"name":  name,
+		"color": "#336699",
+	}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.NotNil(t, ret["id"])
+	return fmt.Sprint(ret["id"])
+}
+
+func getProjectTasks(t *testing.T, projectID string) []map[string]string {
+	body, err := requestJSON("api/tasks?project_id="+projectID, nil, http.MethodGet)
+	assert.NoError(t, err)
+
+	var m map[string][]map[string]string
+	err = json.Unmarshal(body, &m)
+	assert.NoError(t, err)
+	return m["tasks"]
+}
+
+func TestProjects(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	m, err := postJSON("api/project", map[string]any{"name": ""}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m["error"])
+	m, err = postJSON("api/project", map[string]any{"name": "Цвет", "color": "red"}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m["error"])
+
+	work := addProject(t, "Работа")
+	home := addProject(t, "Дом")
+
+	m, err = postJSON("api/task", map[string]any{
+		"title":      "Отчёт",
+		"project_id": "999999",
+	}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m["error"])
+
+	m, err = postJSON("api/task", map[string]any{
+		"title":      "Отчёт",
+		"project_id": work,
+	}, http.MethodPost)
+	assert.NoError(t, err)
+	first := fmt.Sprint(m["id"])
+	m, err = postJSON("api/task", map[string]any{
+		"title":      "Презентация",
+		"project_id": work,
+	}, http.MethodPost)
+	assert.NoError(t, err)
+	second := fmt.Sprint(m["id"])
+
+	tasks := getProjectTasks(t, work)
+	assert.Equal(t, 2, len(tasks))
+	assert.Equal(t, work, tasks[0]["project_id"])
+
+	ret, err := postJSON("api/task/move?id="+second+"&project_id="+home, nil, http.MethodPost)
+	assert.NoError(t, err)
+	assert.Empty(t, ret)
+	assert.Equal(t, 1, len(getProjectTasks(t, work)))
+	assert.Equal(t, 1, len(getProjectTasks(t, home)))
+
+	body, err := requestJSON("api/task?id="+first, nil, http.MethodGet)
+	assert.NoError(t, err)
+	var before map[string]string
+	assert.NoError(t, json.Unmarshal(body, &before))
+
+	// Tasks moved to the inbox are updated like those moved one by one.
+	ret, err = postJSON("api/project?id="+work, nil, http.MethodDelete)
+	assert.NoError(t, err)
+	assert.Empty(t, ret)
+	body, err = requestJSON("api/task?id="+first, nil, http.MethodGet)
+	assert.NoError(t, err)
+	var task map[string]string
+	assert.NoError(t, json.Unmarshal(body, &task))
+	assert.Equal(t, first, task["id"])
+	assert.Empty(t, task["project_id"])
+	assert.NotEqual(t, before["version"], task["version"])
+	var event struct {
+		Type string `db:"type"`
+		Task string `db:"task"`
+	}
+	assert.NoError(t, db.Get(&event, "SELECT type, task FROM task_events WHERE task_id = ? ORDER BY id DESC LIMIT 1", first))
+	assert.Equal(t, "task.updated", event.Type)
+	assert.JSONEq(t, string(body), event.Task)
+
+	body, err = requestJSON("api/task?id="+second, nil, http.MethodGet)
+	assert.NoError(t, err)
+	ret, err = postJSON("api/project?id="+home+"&tasks=cascade", nil, http.MethodDelete)
+	assert.NoError(t, err)
+	assert.Empty(t, ret)
+	notFoundTask(t, second)
+	assert.NoError(t, db.Get(&event, "SELECT type, task FROM task_events WHERE task_id = ? ORDER BY id DESC LIMIT 1", second))
+	assert.Equal(t, "task.deleted", event.Type)
+	assert.JSONEq(t, string(body), event.Task)
+
+	_, err = db.Exec("DELETE FROM scheduler WHERE id = ?", first)
+	assert.NoError(t, err)
+}
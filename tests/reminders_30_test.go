@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"main.go/reminders"
+)
+
+type reminder struct {
+	Key        string `json:"key"`
+	Kind       string `json:"kind"`
+	TaskID     string `json:"task_id"`
+	Date       string `json:"date"`
+	Title      string `json:"title"`
+	DaysBefore int    `json:"days_before"`
+	Overdue    bool   `json:"overdue"`
+}
+
+// remindWebhook returns the webhook of the server like openDB returns the
+// database.
+func remindWebhook() string {
+	if envURL := os.Getenv("TODO_REMIND_WEBHOOK"); envURL != "" {
+		return envURL
+	}
+	return RemindWebhook
+}
+
+func TestReminders(t *testing.T) {
+	hook := remindWebhook()
+	if hook == "" {
+		t.Skip("TODO_REMIND_WEBHOOK is not set")
+	}
+	u, err := url.Parse(hook)
+	assert.NoError(t, err)
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu       sync.Mutex
+		received = map[string][]reminder{}
+	)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rem reminder
+		if err := json.NewDecoder(r.Body).Decode(&rem); err != nil || r.Header.Get("Idempotency-Key") != rem.Key {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received[rem.TaskID] = append(received[rem.TaskID], rem)
+		mu.Unlock()
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	got := func(id string) []reminder {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]reminder(nil), received[id]...)
+	}
+
+	db := openDB(t)
+	defer db.Close()
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	today := now.Format("20060102")
+	soon := now.AddDate(0, 0, 2).Format("20060102")
+	later := now.AddDate(0, 0, 5).Format("20060102")
+
+	due := addTask(t, task{date: today, title: "Оплатить счёт"})
+	m, err := postJSON("api/task", map[string]any{"date": soon, "title": "Купить билеты", "remind_before": "2"}, http.MethodPost)
+	assert.NoError(t, err)
+	before := fmt.Sprint(m["id"])
+	m, err = postJSON("api/task", map[string]any{"date": later, "title": "Поздравить маму", "remind_before": "2"}, http.MethodPost)
+	assert.NoError(t, err)
+	quiet := fmt.Sprint(m["id"])
+
+	m, err = postJSON("api/task", map[string]any{"date": later, "title": "Ошибка", "remind_before": "год"}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m["error"])
+
+	var stored struct {
+		RemindBefore string `json:"remind_before"`
+	}
+	body, err := getBody("api/task?id=" + before)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(body, &stored))
+	assert.Equal(t, "2", stored.RemindBefore)
+
+	waitFor(t, "a reminder of a task due today", func() bool { return len(got(due)) > 0 })
+	waitFor(t, "an advance reminder", func() bool { return len(got(before)) > 0 })
+
+	rem := got(due)[0]
+	assert.Equal(t, "due", rem.Kind)
+	assert.Equal(t, due+":"+today+":due", rem.Key)
+	assert.Equal(t, "Оплатить счёт", rem.Title)
+	assert.False(t, rem.Overdue)
+	rem = got(before)[0]
+	assert.Equal(t, "before", rem.Kind)
+	assert.Equal(t, 2, rem.DaysBefore)
+	assert.Equal(t, soon, rem.Date)
+
+	// The scheduler runs again, but each reminder is sent once.
+	time.Sleep(3 * time.Second)
+	assert.Len(t, got(due), 1)
+	assert.Len(t, got(before), 1)
+	assert.Empty(t, got(quiet))
+
+	var status string
+	assert.NoError(t, db.Get(&status, "SELECT status FROM reminder_deliveries WHERE key = ?", due+":"+today+":due"))
+	assert.Equal(t, "sent", status)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
+
+// fakeNotifier records the reminders it gets and fails while err is set.
+type fakeNotifier struct {
+	err   error
+	calls map[string]int
+}
+
+func (n *fakeNotifier) Name() string { return "fake" }
+
+func (n *fakeNotifier) Notify(ctx context.Context, r reminders.Reminder) error {
+	n.calls[r.TaskID]++
+	return n.err
+}
+
+func TestRemindersTick(t *testing.T) {
+	db := tempDB(t)
+	ctx := context.Background()
+
+	now := time.Date(2030, 1, 10, 9, 0, 0, 0, time.Local)
+	for _, id := range []int{1, 2, 3} {
+		_, err := db.Exec("INSERT INTO scheduler (id, date, title) VALUES (?, '20300110', ?)", id, fmt.Sprint("Задача ", id))
+		assert.NoError(t, err)
+	}
+	delivery := func(id string) (status string, attempts int, next int64) {
+		err := db.QueryRow("SELECT status, attempts, next_attempt_at FROM reminder_deliveries WHERE key = ?",
+			id+":20300110:due").Scan(&status, &attempts, &next)
+		assert.NoError(t, err)
+		return
+	}
+
+	fake := &fakeNotifier{err: errors.New("unavailable"), calls: map[string]int{}}
+	s := reminders.NewScheduler(db, fake)
+	assert.NoError(t, s.Tick(ctx, now))
+	assert.Equal(t, map[string]int{"1": 1, "2": 1, "3": 1}, fake.calls)
+	status, attempts, next := delivery("1")
+	assert.Equal(t, "pending", status)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, now.Add(time.Minute).Unix(), next)
+
+	// Nothing is tried again before the backoff is over.
+	assert.NoError(t, s.Tick(ctx, now.Add(30*time.Second)))
+	assert.Equal(t, 1, fake.calls["1"])
+
+	// A reminder of a task moved or deleted since is canceled, not sent.
+	_, err := db.Exec("UPDATE scheduler SET date = '20300120' WHERE id = 2")
+	assert.NoError(t, err)
+	_, err = db.Exec("DELETE FROM scheduler WHERE id = 3")
+	assert.NoError(t, err)
+	at := now.Add(time.Minute)
+	assert.NoError(t, s.Tick(ctx, at))
+	assert.Equal(t, map[string]int{"1": 2, "2": 1, "3": 1}, fake.calls)
+	status, _, _ = delivery("2")
+	assert.Equal(t, "canceled", status)
+	status, _, _ = delivery("3")
+	assert.Equal(t, "canceled", status)
+	_, _, next = delivery("1")
+	assert.Equal(t, at.Add(2*time.Minute).Unix(), next)
+
+	// The backoff doubles up to an hour, and after 10 attempts the reminder
+	// is given up.
+	for i := 0; i < 20 && fake.calls["1"] < 10; i++ {
+		at = at.Add(time.Hour)
+		assert.NoError(t, s.Tick(ctx, at))
+	}
+	status, attempts, _ = delivery("1")
+	assert.Equal(t, "failed", status)
+	assert.Equal(t, 10, attempts)
+	assert.NoError(t, s.Tick(ctx, at.Add(time.Hour)))
+	assert.Equal(t, 10, fake.calls["1"])
+
+	// A sent reminder isn't queued again by a scheduler started later on
+	// the same database.
+	_, err = db.Exec("INSERT INTO scheduler (id, date, title) VALUES (4, '20300110', 'Задача 4')")
+	assert.NoError(t, err)
+	fake.err = nil
+	assert.NoError(t, s.Tick(ctx, now))
+	assert.Equal(t, 1, fake.calls["4"])
+	restarted := &fakeNotifier{calls: map[string]int{}}
+	s = reminders.NewScheduler(db, restarted)
+	assert.NoError(t, s.Tick(ctx, now))
+	assert.NoError(t, s.Tick(ctx, now.Add(time.Hour)))
+	assert.Empty(t, restarted.calls)
+	status, _, _ = delivery("4")
+	assert.Equal(t, "sent", status)
+}
@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type revision struct {
+	Version string            `json:"version"`
+	SavedAt string            `json:"saved_at"`
+	Task    map[string]string `json:"task"`
+	Changes []fieldChange     `json:"changes"`
+}
+
+func getRevisions(t *testing.T, id string) []revision {
+	body, err := getBody("api/task/revisions?id=" + id)
+	assert.NoError(t, err)
+	var resp struct {
+		Revisions []revision `json:"revisions"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &resp))
+	return resp.Revisions
+}
+
+func TestRevisions(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	project := addProject(t, "Ремонт")
+	id := addTask(t, task{date: "20300101", title: "Купить краску", comment: "белую"})
+	assert.Empty(t, getRevisions(t, id))
+
+	_, err = postJSON("api/task", map[string]any{
+		"id": id, "date": "20300105", "title": "Купить краску и кисти", "comment": "белую", "repeat": "",
+		"project_id": project,
+	}, http.MethodPut)
+	assert.NoError(t, err)
+	_, err = postJSON("api/task?id="+id, map[string]any{"comment": "серую"}, http.MethodPatch)
+	assert.NoError(t, err)
+	// A PUT that changes nothing leaves no revision.
+	_, err = postJSON("api/task", map[string]any{
+		"id": id, "date": "20300105", "title": "Купить краску и кисти", "comment": "серую", "repeat": "",
+	}, http.MethodPut)
+	assert.NoError(t, err)
+
+	revisions := getRevisions(t, id)
+	if !assert.Len(t, revisions, 2) {
+		return
+	}
+	assert.Equal(t, "белую", revisions[0].Task["comment"])
+	assert.Equal(t, []fieldChange{{Field: "comment", From: "белую", To: "серую"}}, revisions[0].Changes)
+	first := revisions[1]
+	assert.Equal(t, "Купить краску", first.Task["title"])
+	assert.Equal(t, []fieldChange{
+		{Field: "date", From: "20300101", To: "20300105"},
+		{Field: "title", From: "Купить краску", To: "Купить краску и кисти"},
+		{Field: "project_id", From: "", To: project},
+	}, first.Changes)
+	assert.NotEmpty(t, first.SavedAt)
+
+	// A restore is checked against the current version.
+	resp, _ := requestWithHeader(t, http.MethodPost, "api/task/revisions/restore?id="+id+"&version="+first.Version,
+		nil, "If-Match", `"1"`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	m, err := postJSON("api/task/revisions/restore?id="+id+"&version="+first.Version, nil, http.MethodPost)
+	assert.NoError(t, err)
+	assert.Nil(t, m["error"])
+	assert.Equal(t, "Купить краску", m["title"])
+	assert.Equal(t, "белую", m["comment"])
+	assert.Equal(t, "20300101", m["date"])
+	assert.Nil(t, m["project_id"])
+
+	// The replaced state is a revision too, so the restore can be undone.
+	revisions = getRevisions(t, id)
+	assert.Len(t, revisions, 3)
+	assert.Equal(t, "серую", revisions[0].Task["comment"])
+
+	m, err = postJSON("api/task/revisions/restore?id="+id+"&version=999", nil, http.MethodPost)
+	assert.NoError(t, err)
+	assert.Equal(t, "Revision not found", m["error"])
+
+	// The revision goes through the usual validation.
+	_, err = db.Exec("DELETE FROM projects WHERE id = ?", project)
+	assert.NoError(t, err)
+	resp, _ = requestWithHeader(t, http.MethodPost, "api/task/revisions/restore?id="+id+"&version="+revisions[0].Version,
+		nil, "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	kept := getRevisions(t, id)
+	assert.NotEmpty(t, kept)
+	token := undoToken(t, http.MethodDelete, "api/task?id="+id, nil)
+	var n int
+	assert.NoError(t, db.Get(&n, "SELECT COUNT(*) FROM task_revisions WHERE task_id = ?", id))
+	assert.Zero(t, n)
+
+	// Undoing the deletion brings the history back too.
+	status, _ := undo(t, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, kept, getRevisions(t, id))
+
+	_, err = postJSON("api/task?id="+id, nil, http.MethodDelete)
+	assert.NoError(t, err)
+}
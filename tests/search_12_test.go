@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchQuery(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	later := now.AddDate(0, 0, 10)
+	addTask(t, task{date: now.Format(`20060102`), title: "Квартальный отчёт", comment: "черновик #work"})
+	addTask(t, task{date: later.Format(`20060102`), title: "Годовой отчёт", comment: "финальная версия #work", repeat: "d 30"})
+	addTask(t, task{date: later.Format(`20060102`), title: "Купить хлеб", comment: "#home"})
+
+	search := func(q string) tasksPage {
+		return getTasksPage(t, url.Values{"search": {q}})
+	}
+	assert.Equal(t, 2, len(search("title:отчёт").Tasks))
+	assert.Equal(t, 1, len(search("title:отчёт -comment:черновик").Tasks))
+	assert.Equal(t, 2, len(search("tag:work").Tasks))
+	assert.Equal(t, 0, len(search("tag:wor").Tasks))
+	assert.Equal(t, 1, len(search("repeat:yes").Tasks))
+	assert.Equal(t, 2, len(search("repeat:no").Tasks))
+	assert.Equal(t, 2, len(search("after:"+now.Format(`20060102`)).Tasks))
+	assert.Equal(t, 1, len(search("before:"+later.Format(`20060102`)+" tag:work").Tasks))
+	assert.Equal(t, 1, len(search(`"финальная версия"`).Tasks))
+	assert.Equal(t, 2, len(search(later.Format(`02.01.2006`)).Tasks))
+
+	// Tags of other alphabets end where their letters do too.
+	addTask(t, task{date: now.Format(`20060102`), title: "Созвон #работа"})
+	assert.Equal(t, 1, len(search("tag:работа").Tasks))
+	assert.Equal(t, 0, len(search("tag:раб").Tasks))
+
+	for _, bad := range []string{`"открытая кавычка`, "color:red", "before:завтра", "repeat:often", "title:"} {
+		page := search(bad)
+		assert.NotEmpty(t, page.Error, bad)
+	}
+
+	body, err := requestJSON("api/tasks?search="+url.QueryEscape("color:red"), nil, http.MethodGet)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "color")
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
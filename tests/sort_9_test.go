@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortTasks(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	m, err := postJSON("api/task", map[string]any{"title": "Ошибка", "priority": "7"}, http.MethodPost)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m["error"])
+
+	now := time.Now()
+	for i, v := range []struct {
+		title    string
+		priority string
+	}{
+		{"Б", "1"},
+		{"В", "3"},
+		{"А", ""},
+	} {
+		m, err := postJSON("api/task", map[string]any{
+			"date":     now.AddDate(0, 0, i).Format(`20060102`),
+			"title":    v.title,
+			"priority": v.priority,
+		}, http.MethodPost)
+		assert.NoError(t, err)
+		assert.NotNil(t, m["id"])
+	}
+
+	titles := func(sort string) string {
+		body, err := requestJSON("api/tasks?sort="+sort, nil, http.MethodGet)
+		assert.NoError(t, err)
+		var m map[string][]map[string]string
+		assert.NoError(t, json.Unmarshal(body, &m))
+		var ret string
+		for _, task := range m["tasks"] {
+			ret += task["title"]
+		}
+		return ret
+	}
+	assert.Equal(t, "БВА", titles(""))
+	assert.Equal(t, "АВБ", titles("-date"))
+	assert.Equal(t, "ВБА", titles("-priority,date"))
+	assert.Equal(t, "АБВ", titles("title"))
+	// Ties are ordered by id in the direction of the last field.
+	assert.Equal(t, "БВА", titles("created"))
+	assert.Equal(t, "АВБ", titles("-created"))
+
+	body, err := requestJSON("api/tasks?sort=colour", nil, http.MethodGet)
+	assert.NoError(t, err)
+	var e map[string]any
+	assert.NoError(t, json.Unmarshal(body, &e))
+	assert.NotEmpty(t, fmt.Sprint(e["error"]))
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
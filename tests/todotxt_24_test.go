@@ -0,0 +1,188 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"main.go/tasks"
+)
+
+func TestTodoTxtExportImport(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	day := time.Now().AddDate(0, 0, 2)
+	project := addProject(t, "Мой дом")
+	m, err := postJSON("api/task", map[string]any{
+		"date":       day.Format("20060102"),
+		"title":      "Купить хлеб @магазин",
+		"comment":    "чёрный",
+		"repeat":     "d 7",
+		"project_id": project,
+		"priority":   "3",
+	}, http.MethodPost)
+	assert.NoError(t, err)
+	id := fmt.Sprint(m["id"])
+
+	due := day.Format("2006-01-02")
+	line := "(A) " + time.Now().Format("2006-01-02") + " Купить хлеб @магазин +Мой_дом due:" + due + " rec:+7d id:" + id
+	assert.Equal(t, line+"\n", string(exportTasks(t, "todotxt")))
+
+	data := strings.Replace(line, "Купить хлеб", "Купить батон", 1) + "\n" +
+		"(B) Позвонить маме +Мой_дом due:" + due + " t:" + due + "\n" +
+		"\n" +
+		"Полить цветы due:" + due + " repeat:w_1,4\n" +
+		"x 2026-01-01 Старое дело\n"
+	ret := importTasks(t, "format=todotxt", []byte(data))
+	assert.True(t, ret.Applied)
+	assert.Equal(t, 1, ret.Updated)
+	assert.Equal(t, 2, ret.Created)
+	assert.Equal(t, 1, ret.Skipped)
+
+	var got struct {
+		Title   string `db:"title"`
+		Comment string `db:"comment"`
+		Repeat  string `db:"repeat"`
+	}
+	assert.NoError(t, db.Get(&got, "SELECT title, comment, repeat FROM scheduler WHERE id = ?", id))
+	assert.Equal(t, "Купить батон @магазин", got.Title)
+	// todo.txt has no comments, so updated tasks keep theirs.
+	assert.Equal(t, "чёрный", got.Comment)
+	assert.Equal(t, "d 7", got.Repeat)
+
+	tasks := getProjectTasks(t, project)
+	assert.Len(t, tasks, 2)
+	assert.NoError(t, db.Get(&got, "SELECT title, comment, repeat FROM scheduler WHERE title LIKE 'Позвонить%'"))
+	assert.Equal(t, "Позвонить маме t:"+due, got.Title)
+	assert.NoError(t, db.Get(&got, "SELECT title, comment, repeat FROM scheduler WHERE title = 'Полить цветы'"))
+	assert.Equal(t, "w 1,4", got.Repeat)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+	_, err = db.Exec("DELETE FROM projects WHERE id = ?", project)
+	assert.NoError(t, err)
+}
+
+// waitFor polls cond until it holds or the sync had enough time to run.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// todoTxtFile returns the synced file like openDB returns the database.
+func todoTxtFile() string {
+	if envFile := os.Getenv("TODO_TXT_FILE"); envFile != "" {
+		return envFile
+	}
+	return TodoTxtFile
+}
+
+func fileContains(s string) func() bool {
+	return func() bool {
+		data, _ := os.ReadFile(todoTxtFile())
+		return strings.Contains(string(data), s)
+	}
+}
+
+func TestTodoTxtSync(t *testing.T) {
+	file := todoTxtFile()
+	if file == "" {
+		t.Skip("TODO_TXT_FILE is not set")
+	}
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+	waitFor(t, "the file to be emptied", func() bool {
+		data, err := os.ReadFile(file)
+		return err == nil && len(data) == 0
+	})
+
+	due := time.Now().AddDate(0, 0, 1)
+	id := addTask(t, task{date: due.Format("20060102"), title: "Полить цветы"})
+	waitFor(t, "a new task in the file", fileContains("Полить цветы due:"+due.Format("2006-01-02")+" id:"+id))
+	repeating := addTask(t, task{date: due.Format("20060102"), title: "Полить фикус", repeat: "d 7"})
+	waitFor(t, "a repeating task in the file", fileContains("Полить фикус due:"+due.Format("2006-01-02")+" rec:"))
+
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	edited := strings.Replace(string(data), "Полить цветы", "Полить цветы на балконе", 1) +
+		"(A) Вынести мусор due:" + due.Format("2006-01-02") + "\n"
+	assert.NoError(t, os.WriteFile(file, []byte(edited), 0o644))
+
+	count := func(query string, args ...any) func() bool {
+		return func() bool {
+			var n int
+			return db.Get(&n, query, args...) == nil && n == 1
+		}
+	}
+	waitFor(t, "a changed task", count("SELECT COUNT(*) FROM scheduler WHERE id = ? AND title = 'Полить цветы на балконе'", id))
+	waitFor(t, "a task from the file", count("SELECT COUNT(*) FROM scheduler WHERE title = 'Вынести мусор'"))
+	// The new line gets the creation date and the id of its task.
+	waitFor(t, "the id of the new line",
+		fileContains("(A) "+time.Now().Format("2006-01-02")+" Вынести мусор due:"+due.Format("2006-01-02")+" id:"))
+
+	data, err = os.ReadFile(file)
+	assert.NoError(t, err)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		switch {
+		case strings.Contains(line, "Полить цветы"), strings.Contains(line, "Полить фикус"):
+			lines = append(lines, "x "+time.Now().Format("2006-01-02")+" "+line)
+		case strings.Contains(line, "Вынести мусор"):
+			// Removing a line deletes the task.
+		default:
+			lines = append(lines, line)
+		}
+	}
+	assert.NoError(t, os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o644))
+	// A done repeating task moves to its next date instead.
+	waitFor(t, "done and removed tasks", func() bool {
+		var n int
+		return db.Get(&n, "SELECT COUNT(*) FROM scheduler") == nil && n == 1
+	})
+	var date string
+	assert.NoError(t, db.Get(&date, "SELECT date FROM scheduler WHERE id = ?", repeating))
+	assert.Equal(t, due.AddDate(0, 0, 7).Format("20060102"), date)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
+
+func TestTodoTxtSyncWriteFailure(t *testing.T) {
+	db := tempDB(t)
+	ctx := context.Background()
+
+	// The file can be read, but the temporary file it is written through has
+	// a name that is too long.
+	path := filepath.Join(t.TempDir(), strings.Repeat("т", 125)+".txt")
+	assert.NoError(t, os.WriteFile(path, []byte("Купить хлеб due:2030-01-02\n"), 0o644))
+
+	sync := tasks.NewTodoTxtSync(db, path)
+	assert.Error(t, sync.Sync(ctx))
+	// The new line is applied once: the next round knows the file and only
+	// tries to write it again.
+	assert.Error(t, sync.Sync(ctx))
+	var n int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM scheduler WHERE title = 'Купить хлеб'").Scan(&n))
+	assert.Equal(t, 1, n)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "Купить хлеб due:2030-01-02\n", string(data))
+}
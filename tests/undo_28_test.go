@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type undoResponse struct {
+	Op    string              `json:"op"`
+	Task  map[string]string   `json:"task"`
+	Tasks []map[string]string `json:"tasks"`
+	Error string              `json:"error"`
+}
+
+func undoToken(t *testing.T, method, apipath string, values map[string]any) string {
+	resp, body := requestWithHeader(t, method, apipath, values, "", "")
+	assert.Less(t, resp.StatusCode, 300, string(body))
+	token := resp.Header.Get("X-Undo-Token")
+	assert.NotEmpty(t, token)
+	return token
+}
+
+func undo(t *testing.T, token string) (int, undoResponse) {
+	resp, body := requestWithHeader(t, http.MethodPost, "api/undo", map[string]any{"token": token}, "", "")
+	var ret undoResponse
+	assert.NoError(t, json.Unmarshal(body, &ret))
+	return resp.StatusCode, ret
+}
+
+func TestUndo(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	// Done on a one-off task deletes it; undo brings it back with its
+	// checklist.
+	id := addTask(t, task{date: "20300101", title: "Оплатить счёт", comment: "до обеда"})
+	_, err = postJSON("api/task/checklist", map[string]any{"task_id": id, "text": "Найти квитанцию"}, http.MethodPost)
+	assert.NoError(t, err)
+	token := undoToken(t, http.MethodPost, "api/task/done?id="+id, nil)
+	notFoundTask(t, id)
+
+	status, ret := undo(t, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "done", ret.Op)
+	assert.Equal(t, id, ret.Task["id"])
+	assert.Equal(t, "Оплатить счёт", ret.Task["title"])
+	assert.Equal(t, "до обеда", ret.Task["comment"])
+	assert.Equal(t, "20300101", ret.Task["date"])
+	assert.Len(t, getChecklist(t, id), 1)
+
+	// A token works once.
+	status, _ = undo(t, token)
+	assert.Equal(t, http.StatusGone, status)
+
+	// Done on a repeating task moves the date; undo moves it back.
+	now := time.Now()
+	date := now.AddDate(0, 0, 1).Format("20060102")
+	id = addTask(t, task{date: date, title: "Полить цветы", repeat: "d 3"})
+	token = undoToken(t, http.MethodPost, "api/task/done?id="+id, nil)
+	var moved string
+	assert.NoError(t, db.Get(&moved, "SELECT date FROM scheduler WHERE id = ?", id))
+	assert.NotEqual(t, date, moved)
+	status, ret = undo(t, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, date, ret.Task["date"])
+
+	// Deleting is undone too.
+	token = undoToken(t, http.MethodDelete, "api/task?id="+id, nil)
+	notFoundTask(t, id)
+	status, ret = undo(t, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "delete", ret.Op)
+	assert.Equal(t, "d 3", ret.Task["repeat"])
+
+	// An edit can't be undone once the task changed again.
+	token = undoToken(t, http.MethodPut, "api/task", map[string]any{
+		"id": id, "date": date, "title": "Полить все цветы", "comment": "", "repeat": "d 3",
+	})
+	_, err = postJSON("api/task?id="+id, map[string]any{"comment": "и кактус"}, http.MethodPatch)
+	assert.NoError(t, err)
+	status, ret = undo(t, token)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, "Полить все цветы", ret.Task["title"])
+
+	// Undoing the last edit works, and then the previous one.
+	token2 := undoToken(t, http.MethodPatch, "api/task?id="+id, map[string]any{"priority": "2"})
+	status, ret = undo(t, token2)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, ret.Task["priority"])
+
+	// Undoing a created task deletes it.
+	resp, body := requestWithHeader(t, http.MethodPost, "api/task", map[string]any{
+		"date": date, "title": "Лишняя задача",
+	}, "", "")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created map[string]any
+	assert.NoError(t, json.Unmarshal(body, &created))
+	status, ret = undo(t, resp.Header.Get("X-Undo-Token"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "create", ret.Op)
+	assert.Nil(t, ret.Task)
+	notFoundTask(t, fmt.Sprint(created["id"]))
+
+	status, _ = undo(t, "unknown")
+	assert.Equal(t, http.StatusGone, status)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
+
+func TestUndoBatch(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	date := time.Now().AddDate(0, 0, 1).Format("20060102")
+	keep := addTask(t, task{date: date, title: "Полить цветы", repeat: "d 3"})
+	gone := addTask(t, task{date: date, title: "Выбросить мусор"})
+
+	// One token undoes every operation of the batch, including two on the
+	// same task.
+	batch := map[string]any{
+		"mode": "best_effort",
+		"operations": []map[string]any{
+			{"op": "create", "task": map[string]any{"date": date, "title": "Новая"}},
+			{"op": "update", "task": map[string]any{"id": keep, "date": date, "title": "Полить все цветы", "repeat": "d 3"}},
+			{"op": "delete", "id": gone},
+			{"op": "done", "id": keep},
+			{"op": "delete", "id": "99999999"},
+		},
+	}
+	resp, body := requestWithHeader(t, http.MethodPost, "api/tasks/batch", batch, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	var ret batchResponse
+	assert.NoError(t, json.Unmarshal(body, &ret))
+	created := ret.Results[0].ID
+	token := resp.Header.Get("X-Undo-Token")
+	assert.NotEmpty(t, token)
+	notFoundTask(t, gone)
+
+	status, undone := undo(t, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "batch", undone.Op)
+	assert.Nil(t, undone.Task)
+	assert.Len(t, undone.Tasks, 2)
+	notFoundTask(t, created)
+	var got struct{ Title, Date string }
+	assert.NoError(t, db.Get(&got, "SELECT title, date FROM scheduler WHERE id = ?", keep))
+	assert.Equal(t, "Полить цветы", got.Title)
+	assert.Equal(t, date, got.Date)
+	assert.NoError(t, db.Get(&got, "SELECT title, date FROM scheduler WHERE id = ?", gone))
+	assert.Equal(t, "Выбросить мусор", got.Title)
+
+	// A batch is not undone in part: one changed task keeps all as they are.
+	resp, body = requestWithHeader(t, http.MethodPost, "api/tasks/batch", map[string]any{
+		"operations": []map[string]any{
+			{"op": "delete", "id": gone},
+			{"op": "update", "task": map[string]any{"id": keep, "date": date, "title": "Полить кактус", "repeat": "d 3"}},
+		},
+	}, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	token = resp.Header.Get("X-Undo-Token")
+	_, err = postJSON("api/task?id="+keep, map[string]any{"comment": "и фикус"}, http.MethodPatch)
+	assert.NoError(t, err)
+	status, undone = undo(t, token)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, keep, undone.Task["id"])
+	notFoundTask(t, gone)
+
+	// A batch that changed nothing gives no token.
+	resp, _ = requestWithHeader(t, http.MethodPost, "api/tasks/batch", map[string]any{
+		"mode":       "best_effort",
+		"operations": []map[string]any{{"op": "delete", "id": gone}},
+	}, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("X-Undo-Token"))
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViews(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	// Tasks can't be added in the past through the API.
+	_, err = db.Exec(`INSERT INTO scheduler (date, title, comment, repeat) VALUES (?, 'Просрочено', '', '')`,
+		now.AddDate(0, 0, -3).Format(`20060102`))
+	assert.NoError(t, err)
+	addTask(t, task{date: now.Format(`20060102`), title: "Сегодня", repeat: "d 7"})
+	addTask(t, task{date: now.AddDate(0, 0, 20).Format(`20060102`), title: "Потом"})
+
+	view := func(v string) int {
+		page := getTasksPage(t, url.Values{"view": {v}})
+		assert.Empty(t, page.Error)
+		return len(page.Tasks)
+	}
+	assert.Equal(t, 1, view("today"))
+	assert.Equal(t, 1, view("overdue"))
+	assert.Equal(t, 1, view("upcoming"))
+	assert.Equal(t, 1, view("repeating"))
+	assert.Equal(t, 2, view("no-repeat"))
+	assert.Equal(t, 1, view("overdue,no-repeat"))
+	assert.GreaterOrEqual(t, view("week"), 1)
+
+	page := getTasksPage(t, url.Values{
+		"from": {now.Format(`20060102`)},
+		"to":   {now.AddDate(0, 0, 30).Format(`02.01.2006`)},
+	})
+	assert.Equal(t, 2, len(page.Tasks))
+
+	assert.NotEmpty(t, getTasksPage(t, url.Values{"view": {"someday"}}).Error)
+	assert.NotEmpty(t, getTasksPage(t, url.Values{"from": {"вчера"}}).Error)
+
+	_, err = db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookEvent struct {
+	ID   string            `json:"id"`
+	Type string            `json:"type"`
+	Task map[string]string `json:"task"`
+}
+
+type webhookDelivery struct {
+	EventID        string `json:"event_id"`
+	Event          string `json:"event"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	ResponseStatus int    `json:"response_status"`
+	NextAttemptAt  string `json:"next_attempt_at"`
+}
+
+func addWebhook(t *testing.T, values map[string]any) (int, map[string]any) {
+	data, err := json.Marshal(values)
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, getURL("api/webhooks"), bytes.NewReader(data))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	signIn(t, req)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var ret map[string]any
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&ret))
+	return resp.StatusCode, ret
+}
+
+func webhookDeliveries(t *testing.T, query string) []webhookDelivery {
+	status, body := adminRequest(t, http.MethodGet, "api/webhooks/deliveries?"+query)
+	assert.Equal(t, http.StatusOK, status)
+	var resp struct {
+		Deliveries []webhookDelivery `json:"deliveries"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &resp))
+	return resp.Deliveries
+}
+
+func TestWebhooks(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+	_, err := db.Exec("DELETE FROM scheduler")
+	assert.NoError(t, err)
+
+	const secret = "не-говори-никому"
+	var (
+		mu       sync.Mutex
+		received []webhookEvent
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "."))
+		mac.Write(body)
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e webhookEvent
+		if err := json.Unmarshal(body, &e); err != nil || r.Header.Get("X-Webhook-Event") != e.Type {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, e)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	status, _ := addWebhook(t, map[string]any{"url": "ftp://example.com/"})
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = addWebhook(t, map[string]any{"url": hook.URL, "events": []string{"task.renamed"}})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, sub := addWebhook(t, map[string]any{
+		"url": hook.URL, "secret": secret, "events": []string{"task.created", "task.done", "task.deleted"},
+	})
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, secret, sub["secret"])
+	status, all := addWebhook(t, map[string]any{"url": broken.URL})
+	assert.Equal(t, http.StatusCreated, status)
+	assert.NotEmpty(t, all["secret"])
+
+	id := addTask(t, task{date: "20300101", title: "Оплатить счёт"})
+	_, err = postJSON("api/task", map[string]any{"id": id, "date": "20300101", "title": "Оплатить счета"}, http.MethodPut)
+	assert.NoError(t, err)
+	_, err = postJSON("api/task/done?id="+id, nil, http.MethodPost)
+	assert.NoError(t, err)
+	other := addTask(t, task{date: "20300102", title: "Лишняя задача"})
+	_, err = postJSON("api/task?id="+other, nil, http.MethodDelete)
+	assert.NoError(t, err)
+
+	got := func() []webhookEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookEvent(nil), received...)
+	}
+	waitFor(t, "the webhook events", func() bool { return len(got()) >= 4 })
+	events := got()
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	// The update is filtered out.
+	assert.Equal(t, []string{"task.created", "task.done", "task.created", "task.deleted"}, types)
+	assert.Equal(t, id, events[1].Task["id"])
+	assert.Equal(t, "Оплатить счета", events[1].Task["title"])
+	assert.Equal(t, other, events[3].Task["id"])
+
+	// A delivery is marked delivered once the receiver has responded.
+	var delivered []webhookDelivery
+	waitFor(t, "the delivered deliveries", func() bool {
+		delivered = webhookDeliveries(t, "status=delivered&webhook_id="+sub["id"].(string))
+		return len(delivered) == 4
+	})
+	assert.Equal(t, events[3].ID, delivered[0].EventID)
+	assert.Len(t, webhookDeliveries(t, "event_id="+events[3].ID), 2)
+	// Event ids are random, so they don't repeat after a restore either.
+	assert.Len(t, events[0].ID, 32)
+	assert.NotEqual(t, events[0].ID, events[2].ID)
+
+	// Failed deliveries wait for another attempt.
+	waitFor(t, "the failed deliveries", func() bool {
+		failed := webhookDeliveries(t, "webhook_id="+all["id"].(string))
+		return len(failed) == 5 && failed[len(failed)-1].Attempts == 1 && failed[0].Attempts == 1
+	})
+	for _, d := range webhookDeliveries(t, "webhook_id="+all["id"].(string)) {
+		assert.Equal(t, "pending", d.Status)
+		assert.Equal(t, http.StatusInternalServerError, d.ResponseStatus)
+		assert.NotEmpty(t, d.NextAttemptAt)
+	}
+
+	for _, hookID := range []any{sub["id"], all["id"]} {
+		status, _ = adminRequest(t, http.MethodDelete, "api/webhooks?id="+hookID.(string))
+		assert.Equal(t, http.StatusOK, status)
+	}
+	status, body := adminRequest(t, http.MethodGet, "api/webhooks")
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, string(body), hook.URL)
+	assert.NotContains(t, string(body), secret)
+}
@@ -0,0 +1,167 @@
+// Package todotxt reads and writes lines of the todo.txt format
+// (https://github.com/todotxt/todo.txt): completion mark, priority, dates and
+// a description with +projects, @contexts and key:value tags.
+package todotxt
+
+import (
+	"strings"
+	"time"
+)
+
+// DateFormat is the date format of todo.txt.
+const DateFormat = "2006-01-02"
+
+// Task is one line of a todo.txt file. Projects, contexts and tags stay in
+// the description, where the line has them.
+type Task struct {
+	Done bool
+	// Priority is 'A'..'Z', or 0 for none.
+	Priority  byte
+	Completed string
+	Created   string
+	// Description is the rest of the line, with words separated by single
+	// spaces.
+	Description string
+}
+
+// cutDate cuts a leading date followed by a space or the end of s.
+func cutDate(s string) (date, rest string, ok bool) {
+	if len(s) < len(DateFormat) {
+		return "", s, false
+	}
+	if _, err := time.Parse(DateFormat, s[:len(DateFormat)]); err != nil {
+		return "", s, false
+	}
+	rest = s[len(DateFormat):]
+	if rest != "" && rest[0] != ' ' {
+		return "", s, false
+	}
+	return s[:len(DateFormat)], strings.TrimLeft(rest, " "), true
+}
+
+// Parse reads a line. Any text is a valid line; the parts that don't match
+// the format become the description.
+func Parse(line string) Task {
+	var t Task
+	rest := strings.TrimSpace(line)
+	if strings.HasPrefix(rest, "x ") {
+		t.Done = true
+		rest = strings.TrimLeft(rest[2:], " ")
+		// The creation date is only allowed after the completion date.
+		if date, r, ok := cutDate(rest); ok {
+			t.Completed, rest = date, r
+			if date, r, ok := cutDate(rest); ok {
+				t.Created, rest = date, r
+			}
+		}
+	} else {
+		if len(rest) > 3 && rest[0] == '(' && rest[1] >= 'A' && rest[1] <= 'Z' && rest[2] == ')' && rest[3] == ' ' {
+			t.Priority = rest[1]
+			rest = strings.TrimLeft(rest[4:], " ")
+		}
+		if date, r, ok := cutDate(rest); ok {
+			t.Created, rest = date, r
+		}
+	}
+	t.Description = strings.Join(strings.Fields(rest), " ")
+	return t
+}
+
+// String formats the task as a line. The priority of a done task is left
+// out, as the format asks.
+func (t Task) String() string {
+	var parts []string
+	if t.Done {
+		parts = append(parts, "x")
+		if t.Completed != "" {
+			parts = append(parts, t.Completed)
+			if t.Created != "" {
+				parts = append(parts, t.Created)
+			}
+		}
+	} else {
+		if t.Priority != 0 {
+			parts = append(parts, "("+string(t.Priority)+")")
+		}
+		if t.Created != "" {
+			parts = append(parts, t.Created)
+		}
+	}
+	if t.Description != "" {
+		parts = append(parts, t.Description)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (t Task) words(prefix byte) []string {
+	var found []string
+	for _, w := range strings.Fields(t.Description) {
+		if len(w) > 1 && w[0] == prefix {
+			found = append(found, w)
+		}
+	}
+	return found
+}
+
+// Projects returns the +project words of the description, with the plus.
+func (t Task) Projects() []string {
+	return t.words('+')
+}
+
+// Contexts returns the @context words of the description, with the at sign.
+func (t Task) Contexts() []string {
+	return t.words('@')
+}
+
+// tag splits a key:value word. Words like http://... are not tags.
+func tag(word string) (key, value string, ok bool) {
+	key, value, ok = strings.Cut(word, ":")
+	if !ok || key == "" || value == "" || strings.HasPrefix(value, "//") {
+		return "", "", false
+	}
+	return key, value, true
+}
+
+// Tag returns the value of the first key:value tag with the key, or "".
+func (t Task) Tag(key string) string {
+	for _, w := range strings.Fields(t.Description) {
+		if k, v, ok := tag(w); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// SetTag replaces the tags with the key by key:value, which is appended if
+// the description has none. An empty value removes the tags.
+func (t *Task) SetTag(key, value string) {
+	var (
+		words []string
+		set   bool
+	)
+	for _, w := range strings.Fields(t.Description) {
+		if k, _, ok := tag(w); ok && k == key {
+			if value != "" && !set {
+				words = append(words, key+":"+value)
+				set = true
+			}
+			continue
+		}
+		words = append(words, w)
+	}
+	if value != "" && !set {
+		words = append(words, key+":"+value)
+	}
+	t.Description = strings.Join(words, " ")
+}
+
+// Remove removes all occurrences of the word from the description.
+func (t *Task) Remove(word string) {
+	var words []string
+	for _, w := range strings.Fields(t.Description) {
+		if w != word {
+			words = append(words, w)
+		}
+	}
+	t.Description = strings.Join(words, " ")
+}
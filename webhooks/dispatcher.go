@@ -0,0 +1,327 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Headers of a delivery. The signature is the HMAC-SHA256 of the
+	// timestamp, a dot and the body, keyed with the secret of the webhook.
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	deliveryTimeout = 10 * time.Second
+	// maxAttempts is how many times an event is sent before its delivery
+	// is given up as failed.
+	maxAttempts = 12
+	// fanOutBatch and deliverBatch limit the work of one run.
+	fanOutBatch  = 1000
+	deliverBatch = 100
+	// logDays is how long finished deliveries and their events are kept.
+	logDays       = 30
+	pruneInterval = time.Hour
+)
+
+// Payload is the body of a delivery. ID is the same for every attempt and
+// every webhook, so receivers can drop duplicates by it; it is the uid of
+// the event, as the row ids repeat after a restore.
+type Payload struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt string          `json:"created_at"`
+	Task      json.RawMessage `json:"task"`
+}
+
+// Sign returns the signature header value of body sent at timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type Dispatcher struct {
+	db        *sql.DB
+	client    *http.Client
+	lastPrune time.Time
+}
+
+func NewDispatcher(db *sql.DB) *Dispatcher {
+	return &Dispatcher{db: db, client: &http.Client{Timeout: deliveryTimeout}}
+}
+
+// Run delivers events every interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Tick(ctx, time.Now()); err != nil {
+			log.Printf("Webhooks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick queues the new events for the webhooks subscribed to them and sends
+// the queued deliveries that are due.
+func (d *Dispatcher) Tick(ctx context.Context, now time.Time) error {
+	if now.Sub(d.lastPrune) >= pruneInterval {
+		if err := d.prune(ctx, now); err != nil {
+			return err
+		}
+		d.lastPrune = now
+	}
+	if err := d.fanOut(ctx, now); err != nil {
+		return err
+	}
+	return d.deliver(ctx, now)
+}
+
+// fanOut adds a delivery for every event after the last one each webhook
+// has seen and that passes its filter.
+func (d *Dispatcher) fanOut(ctx context.Context, now time.Time) error {
+	var maxID int64
+	if err := d.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM task_events").Scan(&maxID); err != nil {
+		return err
+	}
+	rows, err := d.db.QueryContext(ctx, "SELECT id, events, last_event_id FROM webhooks WHERE last_event_id != ?", maxID)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id, last int64
+		events   string
+	}
+	var hooks []pending
+	for rows.Next() {
+		var h pending
+		if err := rows.Scan(&h.id, &h.events, &h.last); err != nil {
+			rows.Close()
+			return err
+		}
+		hooks = append(hooks, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, h := range hooks {
+		if h.last > maxID {
+			// The database was restored from a backup with fewer events;
+			// the ids from maxID on will be used again.
+			_, err := d.db.ExecContext(ctx, "UPDATE webhooks SET last_event_id = ? WHERE id = ?", maxID, h.id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.fanOutTo(ctx, h.id, h.last, splitEvents(h.events), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) fanOutTo(ctx context.Context, webhookID, last int64, events []string, now time.Time) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT id FROM task_events WHERE id > ?"
+	args := []any{last}
+	if len(events) > 0 {
+		query += " AND type IN (?" + strings.Repeat(", ?", len(events)-1) + ")"
+		for _, e := range events {
+			args = append(args, e)
+		}
+	}
+	rows, err := tx.QueryContext(ctx, query+" ORDER BY id LIMIT "+strconv.Itoa(fanOutBatch), args...)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO webhook_deliveries (uid, webhook_id, event_id, created_at)
+			VALUES (lower(hex(randomblob(16))), ?, ?, ?)`,
+			webhookID, id, now.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	// Without a full batch every event up to now has been seen, including
+	// those the filter skipped.
+	seen := "(SELECT COALESCE(MAX(id), 0) FROM task_events)"
+	seenArgs := []any{}
+	if len(ids) == fanOutBatch {
+		seen = "?"
+		seenArgs = append(seenArgs, ids[len(ids)-1])
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE webhooks SET last_event_id = "+seen+" WHERE id = ?", append(seenArgs, webhookID)...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type delivery struct {
+	id              int64
+	uid, eventUID   string
+	attempts        int
+	url, secret     string
+	eventType, task string
+	eventAt         int64
+}
+
+// backoff is the delay before the next attempt after the given number of
+// failed ones: 30 seconds, doubling up to an hour.
+func backoff(attempts int) time.Duration {
+	if attempts > 8 {
+		return time.Hour
+	}
+	return min(30*time.Second<<(attempts-1), time.Hour)
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, now time.Time) error {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT d.id, d.uid, e.uid, d.attempts, w.url, w.secret, e.type, e.task, e.created_at
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		JOIN task_events e ON e.id = d.event_id
+		WHERE d.status = 'pending' AND d.next_attempt_at <= ? ORDER BY d.id LIMIT ?`,
+		now.Unix(), deliverBatch)
+	if err != nil {
+		return err
+	}
+	var queued []delivery
+	for rows.Next() {
+		var q delivery
+		if err := rows.Scan(&q.id, &q.uid, &q.eventUID, &q.attempts, &q.url, &q.secret, &q.eventType, &q.task, &q.eventAt); err != nil {
+			rows.Close()
+			return err
+		}
+		queued = append(queued, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, q := range queued {
+		status, err := d.send(ctx, q)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		attempts := q.attempts + 1
+		switch {
+		case err == nil:
+			_, err = d.db.ExecContext(ctx,
+				`UPDATE webhook_deliveries SET status = 'delivered', attempts = ?, response_status = ?, last_error = '',
+				delivered_at = ? WHERE id = ?`,
+				attempts, status, time.Now().Unix(), q.id)
+		case attempts >= maxAttempts:
+			_, err = d.db.ExecContext(ctx,
+				`UPDATE webhook_deliveries SET status = 'failed', attempts = ?, response_status = ?, last_error = ?
+				WHERE id = ?`,
+				attempts, status, err.Error(), q.id)
+		default:
+			_, err = d.db.ExecContext(ctx,
+				`UPDATE webhook_deliveries SET attempts = ?, response_status = ?, last_error = ?, next_attempt_at = ?
+				WHERE id = ?`,
+				attempts, status, err.Error(), now.Add(backoff(attempts)).Unix(), q.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send posts the event of q and returns the response status, 0 if there was
+// no response.
+func (d *Dispatcher) send(ctx context.Context, q delivery) (int, error) {
+	body, err := json.Marshal(Payload{
+		ID:        q.eventUID,
+		Type:      q.eventType,
+		CreatedAt: time.UnixMilli(q.eventAt).Format(time.RFC3339Nano),
+		Task:      json.RawMessage(q.task),
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, q.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, q.eventType)
+	req.Header.Set(DeliveryHeader, q.uid)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(q.secret, timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// prune removes the finished deliveries older than logDays, and the events
+// no webhook needs any more.
+func (d *Dispatcher) prune(ctx context.Context, now time.Time) error {
+	before := now.AddDate(0, 0, -logDays)
+	_, err := d.db.ExecContext(ctx,
+		"DELETE FROM webhook_deliveries WHERE status != 'pending' AND created_at < ?", before.Unix())
+	if err != nil {
+		return err
+	}
+	_, err = d.db.ExecContext(ctx,
+		`DELETE FROM task_events WHERE created_at < ?
+		AND id <= COALESCE((SELECT MIN(last_event_id) FROM webhooks), id)
+		AND NOT EXISTS (SELECT 1 FROM webhook_deliveries d WHERE d.event_id = task_events.id)`,
+		before.UnixMilli())
+	return err
+}
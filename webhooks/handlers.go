@@ -0,0 +1,209 @@
+package webhooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defLimit = 100
+	maxLimit = 1000
+)
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func respondWithError(w http.ResponseWriter, head int, message string) {
+	w.WriteHeader(head)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+}
+
+// WebhooksHandler serves /api/webhooks: GET lists the subscriptions, POST
+// with {"url", "events", "secret"} adds one and DELETE ?id=... removes one.
+func WebhooksHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			hooks, err := list(r.Context(), db)
+			if err != nil {
+				log.Printf("Webhooks: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]Webhook{"webhooks": hooks})
+		case http.MethodPost:
+			var req Webhook
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+				return
+			}
+			hook, err := create(r.Context(), db, req)
+			if err != nil {
+				if errors.Is(err, ErrURL) || errors.Is(err, ErrEvent) {
+					respondWithError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				log.Printf("Webhooks: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(hook)
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				respondWithError(w, http.StatusBadRequest, "Missed id")
+				return
+			}
+			if err := remove(r.Context(), db, id); err != nil {
+				if errors.Is(err, ErrNotFound) {
+					respondWithError(w, http.StatusNotFound, err.Error())
+					return
+				}
+				log.Printf("Webhooks: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			json.NewEncoder(w).Encode(struct{}{})
+		default:
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+		}
+	}
+}
+
+// Delivery is an entry of the delivery log. NextAttemptAt is set while the
+// delivery is pending, DeliveredAt once it succeeded.
+type Delivery struct {
+	ID             string `json:"id"`
+	WebhookID      string `json:"webhook_id"`
+	EventID        string `json:"event_id"`
+	Event          string `json:"event"`
+	TaskID         string `json:"task_id"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	ResponseStatus int    `json:"response_status,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	CreatedAt      string `json:"created_at"`
+	NextAttemptAt  string `json:"next_attempt_at,omitempty"`
+	DeliveredAt    string `json:"delivered_at,omitempty"`
+}
+
+type DeliveriesResponse struct {
+	Deliveries []Delivery `json:"deliveries"`
+	// NextBeforeID is passed as before_id for the next, older page.
+	NextBeforeID int64 `json:"next_before_id,omitempty"`
+}
+
+// DeliveriesHandler serves GET /api/webhooks/deliveries: the delivery log,
+// newest first, filtered by webhook_id, event_id, task_id and status. Pages
+// are limit entries long and follow each other with before_id.
+func DeliveriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method denied")
+			return
+		}
+		params := r.URL.Query()
+		var where []string
+		var args []any
+		if v := params.Get("event_id"); v != "" {
+			where = append(where, "e.uid = ?")
+			args = append(args, v)
+		}
+		for _, p := range []struct{ name, cond string }{
+			{"webhook_id", "d.webhook_id = ?"},
+			{"task_id", "e.task_id = ?"},
+			{"before_id", "d.id < ?"},
+		} {
+			if v := params.Get(p.name); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					respondWithError(w, http.StatusBadRequest, p.name+" must be a number")
+					return
+				}
+				where = append(where, p.cond)
+				args = append(args, n)
+			}
+		}
+		if v := params.Get("status"); v != "" {
+			if v != "pending" && v != "delivered" && v != "failed" {
+				respondWithError(w, http.StatusBadRequest, "status must be pending, delivered or failed")
+				return
+			}
+			where = append(where, "d.status = ?")
+			args = append(args, v)
+		}
+		limit := defLimit
+		if v := params.Get("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > maxLimit {
+				respondWithError(w, http.StatusBadRequest, "limit must be from 1 to "+strconv.Itoa(maxLimit))
+				return
+			}
+		}
+
+		query := `SELECT d.id, d.uid, d.webhook_id, e.uid, e.type, e.task_id, d.status, d.attempts, d.response_status,
+			d.last_error, d.created_at, d.next_attempt_at, d.delivered_at
+			FROM webhook_deliveries d JOIN task_events e ON e.id = d.event_id`
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+		query += " ORDER BY d.id DESC LIMIT " + strconv.Itoa(limit+1)
+		rows, err := db.QueryContext(r.Context(), query, args...)
+		if err != nil {
+			log.Printf("Webhooks: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		defer rows.Close()
+
+		resp := DeliveriesResponse{Deliveries: []Delivery{}}
+		// last is the row id of the last entry, where the next page starts.
+		var last int64
+		for rows.Next() {
+			var (
+				d                                     Delivery
+				id, webhookID, taskID                 int64
+				createdAt, nextAttemptAt, deliveredAt int64
+			)
+			err := rows.Scan(&id, &d.ID, &webhookID, &d.EventID, &d.Event, &taskID, &d.Status, &d.Attempts, &d.ResponseStatus,
+				&d.LastError, &createdAt, &nextAttemptAt, &deliveredAt)
+			if err != nil {
+				log.Printf("Webhooks: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Server error")
+				return
+			}
+			if len(resp.Deliveries) == limit {
+				resp.NextBeforeID = last
+				break
+			}
+			last = id
+			d.WebhookID = strconv.FormatInt(webhookID, 10)
+			d.TaskID = strconv.FormatInt(taskID, 10)
+			d.CreatedAt = time.Unix(createdAt, 0).Format(time.RFC3339)
+			if d.Status == "pending" {
+				d.NextAttemptAt = time.Unix(max(nextAttemptAt, createdAt), 0).Format(time.RFC3339)
+			}
+			if deliveredAt != 0 {
+				d.DeliveredAt = time.Unix(deliveredAt, 0).Format(time.RFC3339)
+			}
+			resp.Deliveries = append(resp.Deliveries, d)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Webhooks: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,150 @@
+// Package webhooks delivers task events to subscribed URLs. Events are read
+// from the task_events outbox, which the tasks package writes in the
+// transaction of every change, and each delivery is recorded, so that events
+// survive restarts and failed deliveries are retried.
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/tasks"
+)
+
+var (
+	ErrNotFound = errors.New("Webhook not found")
+	ErrURL      = errors.New("url must be an absolute http or https URL")
+	ErrEvent    = errors.New("Unknown event")
+)
+
+// Webhook is a subscription. Events lists the event types sent to URL; an
+// empty list means all of them. Secret signs the payloads and is returned
+// only when the subscription is created.
+type Webhook struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// parseEvents checks the event filter and returns it as stored: the types
+// separated by commas, or empty for all of them.
+func parseEvents(events []string) (string, error) {
+	var list []string
+	for _, e := range events {
+		e = strings.TrimSpace(e)
+		if e == "*" {
+			return "", nil
+		}
+		if !slices.Contains(tasks.EventTypes, e) {
+			return "", fmt.Errorf("%w %q, use %s", ErrEvent, e, strings.Join(tasks.EventTypes, ", "))
+		}
+		if !slices.Contains(list, e) {
+			list = append(list, e)
+		}
+	}
+	return strings.Join(list, ","), nil
+}
+
+func splitEvents(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create adds a subscription. It receives only the events recorded after
+// it is created.
+func create(ctx context.Context, db *sql.DB, w Webhook) (Webhook, error) {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, ErrURL
+	}
+	events, err := parseEvents(w.Events)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if w.Secret == "" {
+		if w.Secret, err = newSecret(); err != nil {
+			return Webhook{}, err
+		}
+	}
+	now := time.Now()
+	res, err := db.ExecContext(ctx,
+		`INSERT INTO webhooks (url, events, secret, created_at, last_event_id)
+		VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(id), 0) FROM task_events))`,
+		u.String(), events, w.Secret, now.Unix())
+	if err != nil {
+		return Webhook{}, err
+	}
+	id, _ := res.LastInsertId()
+	return Webhook{
+		ID:        strconv.FormatInt(id, 10),
+		URL:       u.String(),
+		Events:    splitEvents(events),
+		Secret:    w.Secret,
+		CreatedAt: now.Format(time.RFC3339),
+	}, nil
+}
+
+func list(ctx context.Context, db *sql.DB) ([]Webhook, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, url, events, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		var (
+			w      Webhook
+			id, at int64
+			events string
+		)
+		if err := rows.Scan(&id, &w.URL, &events, &at); err != nil {
+			return nil, err
+		}
+		w.ID = strconv.FormatInt(id, 10)
+		w.Events = splitEvents(events)
+		w.CreatedAt = time.Unix(at, 0).Format(time.RFC3339)
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+// remove deletes a subscription with its delivery log.
+func remove(ctx context.Context, db *sql.DB, id string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}